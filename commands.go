@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/estesp/onimage/pkg/services"
+)
+
+const usage = `usage: onimage [command]
+
+Without a command the onimage daemon is started. Commands:
+  offline [-message text] [-until time]   take the webcam offline
+  online                                  bring the webcam back online
+  render-page [-live] [-date d] [page]    render a page template to stdout
+
+render-page renders one of the website's pages (index, offline, archive-day
+or archive-month; index by default) with sample data, or with -live using
+the current weather and today's or the archive's data. -date selects the
+archive day (or month) and defaults to the latest archived day.
+
+Commands that control the running daemon accept -client to select the
+[[endpoint.clients]] entry to authenticate as, and -insecure to skip TLS
+certificate verification.
+`
+
+func runCommand(name string, args []string) {
+	var err error
+	switch name {
+	case "offline":
+		err = offlineCommand(args)
+	case "online":
+		err = onlineCommand(args)
+	case "render-page":
+		err = renderPageCommand(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "onimage %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// endpointFlags adds the flags shared by commands that call the daemon
+func endpointFlags(fs *flag.FlagSet) (*string, *bool) {
+	client := fs.String("client", "", "name of the endpoint client to authenticate as")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	return client, insecure
+}
+
+func offlineCommand(args []string) error {
+	fs := flag.NewFlagSet("offline", flag.ExitOnError)
+	message := fs.String("message", "", "message shown on the offline page")
+	until := fs.String("until", "", "expected return as a duration (e.g. 2h), RFC 3339 or \"2006-01-02 15:04\" time")
+	client, insecure := endpointFlags(fs)
+	fs.Parse(args)
+
+	req := services.OfflineRequest{Message: *message}
+	if *until != "" {
+		t, err := parseUntil(*until)
+		if err != nil {
+			return err
+		}
+		req.Until = &t
+	}
+	conn, err := services.NewEndpointConn(loadConfig(), *client, *insecure)
+	if err != nil {
+		return err
+	}
+	var resp services.OfflineResponse
+	if err := conn.Do(http.MethodPost, "/offline", req, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("webcam is offline since %s\n", resp.State.Since.Format(time.RFC1123))
+	return nil
+}
+
+func onlineCommand(args []string) error {
+	fs := flag.NewFlagSet("online", flag.ExitOnError)
+	client, insecure := endpointFlags(fs)
+	fs.Parse(args)
+
+	conn, err := services.NewEndpointConn(loadConfig(), *client, *insecure)
+	if err != nil {
+		return err
+	}
+	if err := conn.Do(http.MethodPost, "/online", nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("webcam is online")
+	return nil
+}
+
+func parseUntil(until string) (time.Time, error) {
+	if d, err := time.ParseDuration(until); err == nil {
+		return time.Now().Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, until); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", until, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -until %q", until)
+	}
+	return t, nil
+}
+
+func renderPageCommand(args []string) error {
+	fs := flag.NewFlagSet("render-page", flag.ExitOnError)
+	live := fs.Bool("live", false, "render with live data instead of sample data")
+	date := fs.String("date", "", "archive day (2006-01-02) or month (2006-01) to render")
+	fs.Parse(args)
+	page := services.PageIndex
+	if fs.NArg() > 0 {
+		page = fs.Arg(0)
+	}
+
+	config := loadConfig()
+	// errors are returned directly; the channel only needs to absorb what
+	// the services also report for the daemon's error handler
+	errChan := make(chan error, 16)
+	templates, err := services.NewTemplates(config, errChan)
+	if err != nil {
+		return err
+	}
+	data := templates.SampleData(page)
+	if *live {
+		if data, err = livePageData(config, errChan, templates, page, *date); err != nil {
+			return err
+		}
+	}
+	return templates.Execute(os.Stdout, page, data)
+}
+
+// livePageData builds a page's data the way the daemon does when it
+// publishes the page
+func livePageData(config map[string]interface{}, errChan chan error, templates *services.Templates, page, date string) (interface{}, error) {
+	publisher, err := services.NewPublisher(config, errChan)
+	if err != nil {
+		return nil, err
+	}
+	switch page {
+	case services.PageIndex, services.PageOffline:
+		weatherService, err := services.NewWeatherDataService(config, errChan)
+		if err != nil {
+			return nil, err
+		}
+		today, err := services.NewTodayService(weatherService, publisher, templates, config, errChan)
+		if err != nil {
+			return nil, err
+		}
+		if page == services.PageOffline {
+			return today.OfflinePageData(), nil
+		}
+		return today.PageData(), nil
+	case services.PageArchiveDay, services.PageArchiveMonth:
+		archive, err := services.NewArchiveService(config, errChan, templates, publisher)
+		if err != nil {
+			return nil, err
+		}
+		if date == "" {
+			if date = archive.LatestDay(); date == "" {
+				return nil, fmt.Errorf("the archive has no days")
+			}
+		}
+		if page == services.PageArchiveMonth {
+			if len(date) > len("2006-01") {
+				date = date[:len("2006-01")]
+			}
+			return archive.MonthPage(date)
+		}
+		return archive.DayPage(date)
+	}
+	return nil, fmt.Errorf("unknown page %q", page)
+}
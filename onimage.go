@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/estesp/onimage/pkg/services"
 
@@ -13,20 +14,19 @@ func main() {
 	// TODO: Make logging level configurable
 	logrus.SetLevel(logrus.InfoLevel)
 
+	// subcommands control or inspect the daemon; without one, run it
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	// channel for errors passed to each service; errors written
 	// to this channel will be reported to the monitor service, if enabled
 	errChan := make(chan error)
+	// the most recent errors are kept for the status endpoint
+	errorLog := services.NewErrorLog(20)
 
-	// Read in config; looks for current working directory "onimage.toml" or
-	// looks for "/etc/onimage/onimage.toml"
-	viper.SetConfigName("onimage")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("/etc/onimage")
-	err := viper.ReadInConfig()
-	if err != nil {
-		logrus.Fatalf("can't read config file: %v", err)
-	}
-	config := viper.AllSettings()
+	config := loadConfig()
 
 	// create monitor service
 	monitorService, err := services.NewMonitorService(config, errChan)
@@ -44,9 +44,25 @@ func main() {
 	}
 	logrus.Info(" > weather service started successfully")
 
+	// the publisher uploads generated content to the website's S3 bucket
+	publisher, err := services.NewPublisher(config, errChan)
+	if err != nil {
+		logrus.Fatalf("unable to initialize publisher: %v", err)
+	}
+	// uploads that failed, e.g. during a network outage, are retried from
+	// the outbox in the background
+	publisher.StartOutbox()
+
+	// all page templates are parsed and checked against sample data up
+	// front so that a broken template stops startup with a clear error
+	templates, err := services.NewTemplates(config, errChan)
+	if err != nil {
+		logrus.Fatalf("unable to load website templates: %v", err)
+	}
+
 	// create "today" service which handles storing sunrise/sunset and current date
 	// as well as updating the S3 bucket's "index.html" with today's data
-	todayService, err := services.NewTodayService(weatherService, config, errChan)
+	todayService, err := services.NewTodayService(weatherService, publisher, templates, config, errChan)
 	if err != nil {
 		logrus.Fatalf("unable to initialize 'today' service: %v", err)
 	}
@@ -55,39 +71,183 @@ func main() {
 		logrus.Fatalf("unable to set the initial today page view in s3: %v", err)
 	}
 	dateNotifier := todayService.WatchDate()
+	todayService.WatchMaintenance()
 	logrus.Info(" > today page service started successfully")
 
-	// start the web endpoint service which is called from cron entry
-	// scripts that take the photos; used to determine whether to take
-	// photos (between first light/last light)
-	webEndpointService := services.NewWebEndpoint(todayService)
-
-	webEndpointService.StartWebHandler()
-	logrus.Info(" > endpoint for photo time capture service started successfully")
-
 	// all dependent services are started; now start image processing
 
 	// create the image processor service which will handle the bulk of
 	// processing of each captured webcam image
-	imageProcessor, err := services.NewImageProcessingService(config, errChan, todayService, weatherService)
+	imageProcessor, err := services.NewImageProcessingService(config, errChan, todayService, weatherService, publisher)
 	if err != nil {
 		logrus.Fatalf("unable to initialize image processing service: %v", err)
 	}
 	// the today service notifier channel will be watched to update the
 	//
 	imageProcessor.DateChangeNotifier(dateNotifier)
+	// with immutable image keys today's page links to each new image
+	imageProcessor.OnPublished("today page", todayService.Published)
+
+	// additional steps run after each image is processed, and end of day
+	// steps run against the previous day's captures after the date changes
+	timelapseService, err := services.NewTimelapseService(config, errChan, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize timelapse service: %v", err)
+	}
+	imageProcessor.OnDayEnd("timelapse", timelapseService.Generate)
+
+	keogramService, err := services.NewKeogramService(config, errChan, todayService, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize keogram service: %v", err)
+	}
+	imageProcessor.OnProcessed("keogram", keogramService.AddFrame)
+	imageProcessor.OnDayEnd("keogram", keogramService.Finalize)
+
+	contactSheetService, err := services.NewContactSheetService(config, errChan, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize contact sheet service: %v", err)
+	}
+	imageProcessor.OnDayEnd("contact sheet", contactSheetService.Generate)
+
+	// each published image is added to the day and month archive pages
+	// when [archive] is enabled
+	archiveService, err := services.NewArchiveService(config, errChan, templates, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize archive service: %v", err)
+	}
+	imageProcessor.OnPublished("archive", archiveService.Published)
+	imageProcessor.OnDayEnd("archive", archiveService.DayEnd)
+
+	// the daily highlights feed picks up the day's timelapse and archive
+	// page, so it runs after those end of day steps
+	highlightsService, err := services.NewHighlightsService(config, errChan, timelapseService, archiveService, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize highlights service: %v", err)
+	}
+	imageProcessor.OnDayEnd("highlights", highlightsService.DayEnd)
+
+	// latest.json and today.json describe the published images for
+	// clients that embed the webcam
+	feedService, err := services.NewFeedService(config, errChan, todayService, archiveService, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize feed service: %v", err)
+	}
+	imageProcessor.OnPublished("feed", feedService.Published)
+	imageProcessor.OnAnalyzed("feed", feedService.Analyzed)
+
+	// the watchdog switches to the offline page if captures stop arriving
+	watchdog, err := services.NewWatchdog(config, errChan, todayService, imageProcessor)
+	if err != nil {
+		logrus.Fatalf("unable to initialize capture watchdog: %v", err)
+	}
+	imageProcessor.OnProcessed("watchdog", watchdog.CaptureProcessed)
+	watchdog.Start()
+
+	// new images are pushed to browsers connected to /events when [live]
+	// is enabled
+	liveEvents, err := services.NewLiveEvents(config, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize live events: %v", err)
+	}
+	imageProcessor.OnPublished("live events", liveEvents.Published)
 
 	imageProcessor.StartImageHandler()
 
+	// start the web endpoint service which is called from cron entry
+	// scripts that take the photos; used to determine whether to take
+	// photos (between first light/last light). It also serves the health
+	// and status endpoints for the pipeline
+	webEndpointService, err := services.NewWebEndpoint(config, todayService, weatherService, imageProcessor, errorLog)
+	if err != nil {
+		logrus.Fatalf("unable to initialize web endpoint: %v", err)
+	}
+
+	// cameras can upload captures to the endpoint instead of writing them
+	// to the watched directory when [ingest] is enabled
+	ingestService, err := services.NewIngestService(config, errChan, imageProcessor)
+	if err != nil {
+		logrus.Fatalf("unable to initialize capture ingest service: %v", err)
+	}
+	if err := ingestService.Register(webEndpointService); err != nil {
+		logrus.Fatalf("unable to register capture ingest service: %v", err)
+	}
+	liveEvents.Register(webEndpointService)
+
+	// cameras that can only upload by FTP use the built-in FTP server when
+	// [ftp] is enabled
+	ftpService, err := services.NewFTPService(config, errChan, imageProcessor)
+	if err != nil {
+		logrus.Fatalf("unable to initialize ftp service: %v", err)
+	}
+	if err := ftpService.Start(); err != nil {
+		logrus.Fatalf("unable to start ftp service: %v", err)
+	}
+
+	// cameras that only serve a snapshot URL or MJPEG stream are polled
+	// when [pull] is enabled
+	pullSource, err := services.NewPullSource(config, errChan, todayService, imageProcessor)
+	if err != nil {
+		logrus.Fatalf("unable to initialize pull capture source: %v", err)
+	}
+	pullSource.Start()
+
+	// the scheduler runs a local camera command to take photos itself
+	// when [scheduler] is enabled
+	scheduler, err := services.NewScheduler(config, errChan, todayService, imageProcessor)
+	if err != nil {
+		logrus.Fatalf("unable to initialize capture scheduler: %v", err)
+	}
+	scheduler.Start()
+
+	webEndpointService.StartWebHandler()
+	logrus.Info(" > endpoint for photo time capture service started successfully")
+
+	// the retention service prunes, compacts and expires older capture
+	// directories according to the optional [retention] config section
+	retentionService, err := services.NewRetentionService(config, errChan, todayService, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize retention service: %v", err)
+	}
+	retentionService.Start()
+
+	// the site's static files are uploaded when they change if
+	// 'website.assets_dir' is set
+	assetService, err := services.NewAssetService(config, errChan, publisher)
+	if err != nil {
+		logrus.Fatalf("unable to initialize asset sync: %v", err)
+	}
+	assetService.Start()
+
+	// template changes are picked up without a restart; today's page is
+	// published again right away, archive pages as they next change
+	templates.OnReload("today page", todayService.RefreshPage)
+	if err := templates.Watch(); err != nil {
+		logrus.Errorf("website templates will not be reloaded: %v", err)
+	}
+
 	logrus.Infof("OnImage() Processing started successfully; watching: %s\n", todayService.GetDate())
 
 	// this will wait forever, listening for errors
-	errorHandler(errChan, monitorService)
+	errorHandler(errChan, monitorService, errorLog)
+}
+
+// loadConfig reads in config; looks for current working directory
+// "onimage.toml" or looks for "/etc/onimage/onimage.toml"
+func loadConfig() map[string]interface{} {
+	viper.SetConfigName("onimage")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath("/etc/onimage")
+	err := viper.ReadInConfig()
+	if err != nil {
+		logrus.Fatalf("can't read config file: %v", err)
+	}
+	return viper.AllSettings()
 }
 
-func errorHandler(errors chan error, monitor services.Monitor) {
+func errorHandler(errors chan error, monitor services.Monitor, errorLog *services.ErrorLog) {
 	for {
 		err := <-errors
+		errorLog.Record(err)
 		monitor.SendFailure(fmt.Sprintf("%v", err))
 	}
 }
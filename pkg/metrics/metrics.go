@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const namespace = "onimage"
+
+var (
+	CapturesDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "captures_detected_total",
+		Help:      "Number of new capture directories detected.",
+	})
+	ReadinessTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "capture_readiness_timeouts_total",
+		Help:      "Number of captures abandoned waiting for done.txt.",
+	})
+	CaptureUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "capture_uploads_total",
+		Help:      "Captures uploaded to the ingest endpoint by result.",
+	}, []string{"result"})
+	StepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "step_duration_seconds",
+		Help:      "Duration of each image processing step.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"step"})
+	CommandFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "command_failures_total",
+		Help:      "Number of failed external commands by what they do: enfuse, overlay, analysis, upload, remove, downsize, timelapse or capture.",
+	}, []string{"command"})
+	WeatherLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "weather_request_duration_seconds",
+		Help:      "Latency of weather API requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	WeatherRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "weather_request_retries_total",
+		Help:      "Number of weather API requests that were retried after a failure.",
+	})
+	MonitorPings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "monitor_pings_total",
+		Help:      "Monitor service heartbeats and failure reports by result.",
+	}, []string{"monitor", "type", "result"})
+	OutboxEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outbox_entries",
+		Help:      "Number of failed uploads waiting to be retried.",
+	})
+	OutboxRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_retries_total",
+		Help:      "Retried uploads from the outbox by result.",
+	}, []string{"result"})
+	OutboxDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_dropped_total",
+		Help:      "Queued uploads dropped from the outbox without being published, by reason.",
+	}, []string{"reason"})
+	DarkPercent = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dark_percent",
+		Help:      "Percent of the most recent image assessed as dark.",
+	})
+	Temperature = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "temperature",
+		Help:      "Most recently observed temperature in the configured units.",
+	})
+)
+
+// WatchDiskFree registers a gauge reporting the free space on the
+// filesystem holding dir, as returned by diskFree, each time metrics are
+// collected
+func WatchDiskFree(dir string, diskFree func(string) (uint64, error)) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "disk_free_bytes",
+		Help:        "Bytes available on the filesystem holding the images directory.",
+		ConstLabels: prometheus.Labels{"path": dir},
+	}, func() float64 {
+		free, err := diskFree(dir)
+		if err != nil {
+			logrus.Errorf("unable to determine free space for %s: %v", dir, err)
+			return 0
+		}
+		return float64(free)
+	})
+}
+
+// Result returns the "result" label value for an error
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/dghubble/sling"
+	"github.com/estesp/onimage/pkg/metrics"
 	"github.com/estesp/onimage/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -100,6 +101,7 @@ func (m *Cronitor) sendHeartbeat() error {
 		logrus.Errorf("failed creating sling URL: %v", err)
 	}
 	_, err = client.Do(req)
+	metrics.MonitorPings.WithLabelValues("cronitor", "heartbeat", metrics.Result(err)).Inc()
 	if err != nil {
 		logrus.Errorf("failed to ping cronitor: %v", err)
 	}
@@ -125,6 +127,7 @@ func (m *Cronitor) SendFailure(msg string) error {
 		logrus.Errorf("failed creating sling URL: %v", err)
 	}
 	_, err = client.Do(req)
+	metrics.MonitorPings.WithLabelValues("cronitor", "failure", metrics.Result(err)).Inc()
 	if err != nil {
 		logrus.Errorf("failed to ping cronitor: %v", err)
 	}
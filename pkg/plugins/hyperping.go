@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/dghubble/sling"
+	"github.com/estesp/onimage/pkg/metrics"
 	"github.com/estesp/onimage/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -72,6 +73,7 @@ func (m *Hyperping) sendHeartbeat() error {
 		logrus.Errorf("failed creating sling URL: %v", err)
 	}
 	_, err = client.Do(req)
+	metrics.MonitorPings.WithLabelValues("hyperping", "heartbeat", metrics.Result(err)).Inc()
 	if err != nil {
 		logrus.Errorf("failed to send hyperping: %v", err)
 	}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	j2000     = 2451545.0
+	rad       = math.Pi / 180
+	obliquity = 23.4397 * rad
+
+	// altitudes of the sun's center at sunrise/sunset (allowing for
+	// refraction and the size of the disc) and at civil twilight, and of
+	// the moon's center at moonrise/moonset
+	sunriseAltitude  = -0.833 * rad
+	twilightAltitude = -6 * rad
+	moonriseAltitude = 0.125 * rad
+
+	almanacDays = 7
+)
+
+var moonPhases = []string{
+	"New Moon", "Waxing Crescent", "First Quarter", "Waxing Gibbous",
+	"Full Moon", "Waning Gibbous", "Last Quarter", "Waning Crescent",
+}
+
+// Almanac holds the sun and moon times of a day, calculated locally from
+// the webcam's coordinates. Events that don't happen on the day (e.g. at
+// high latitudes) are zero times
+type Almanac struct {
+	Date      time.Time
+	Sunrise   time.Time
+	Sunset    time.Time
+	SolarNoon time.Time
+	CivilDawn time.Time
+	CivilDusk time.Time
+	DayLength time.Duration
+	// DayLengthChange is the difference from yesterday's day length
+	DayLengthChange time.Duration
+	Moon            Moon
+	// Week holds the sun times of the seven days after Date
+	Week []SunDay
+}
+
+// Moon describes the moon on a day; Age is the fraction of the lunar cycle
+// since the new moon (0.5 is full) and Illumination the fraction of the
+// disc that is lit, both at noon
+type Moon struct {
+	Phase        string
+	Age          float64
+	Illumination float64
+	Rise         time.Time
+	Set          time.Time
+}
+
+// SunDay holds the sun times of one day
+type SunDay struct {
+	Date      time.Time
+	Sunrise   time.Time
+	Sunset    time.Time
+	DayLength time.Duration
+}
+
+type solarDay struct {
+	noon, sunrise, sunset, dawn, dusk time.Time
+}
+
+// newAlmanac calculates the almanac for the day of date in loc at the given
+// latitude and longitude (east positive) in degrees
+func newAlmanac(date time.Time, loc *time.Location, lat, lon float64) *Almanac {
+	y, m, d := date.In(loc).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	sun := solarEvents(day, lat, lon)
+	a := &Almanac{
+		Date:      day,
+		Sunrise:   sun.sunrise.In(loc),
+		Sunset:    sun.sunset.In(loc),
+		SolarNoon: sun.noon.In(loc),
+		CivilDawn: sun.dawn.In(loc),
+		CivilDusk: sun.dusk.In(loc),
+		DayLength: sun.dayLength(lat),
+	}
+	a.DayLengthChange = a.DayLength - solarEvents(day.AddDate(0, 0, -1), lat, lon).dayLength(lat)
+	a.Moon = moonDay(day, lat, lon)
+	for i := 1; i <= almanacDays; i++ {
+		next := day.AddDate(0, 0, i)
+		s := solarEvents(next, lat, lon)
+		a.Week = append(a.Week, SunDay{
+			Date:      next,
+			Sunrise:   s.sunrise.In(loc),
+			Sunset:    s.sunset.In(loc),
+			DayLength: s.dayLength(lat),
+		})
+	}
+	return a
+}
+
+// solarEvents uses the sunrise equation, which is accurate to about a
+// minute away from the poles
+func solarEvents(day time.Time, lat, lon float64) solarDay {
+	y, m, d := day.Date()
+	n := math.Round(julianDay(time.Date(y, m, d, 12, 0, 0, 0, time.UTC)) - j2000)
+	jstar := n - lon/360
+	M := sunMeanAnomaly(jstar)
+	lambda := sunEclipticLongitude(M)
+	transit := j2000 + jstar + 0.0053*math.Sin(M) - 0.0069*math.Sin(2*lambda)
+	dec := math.Asin(math.Sin(lambda) * math.Sin(obliquity))
+
+	sd := solarDay{noon: fromJulian(transit)}
+	sd.sunrise, sd.sunset = hourAngleEvents(transit, lat*rad, dec, sunriseAltitude)
+	sd.dawn, sd.dusk = hourAngleEvents(transit, lat*rad, dec, twilightAltitude)
+	return sd
+}
+
+// dayLength is the time between sunrise and sunset; without them it is a
+// full day in summer and none in winter
+func (sd solarDay) dayLength(lat float64) time.Duration {
+	if !sd.sunrise.IsZero() {
+		return sd.sunset.Sub(sd.sunrise)
+	}
+	_, month, _ := sd.noon.Date()
+	summer := month >= time.April && month <= time.September
+	if summer == (lat > 0) {
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+func hourAngleEvents(transit, phi, dec, h0 float64) (time.Time, time.Time) {
+	cosW := (math.Sin(h0) - math.Sin(phi)*math.Sin(dec)) / (math.Cos(phi) * math.Cos(dec))
+	if cosW < -1 || cosW > 1 {
+		return time.Time{}, time.Time{}
+	}
+	w := math.Acos(cosW) / (2 * math.Pi)
+	return fromJulian(transit - w), fromJulian(transit + w)
+}
+
+func sunMeanAnomaly(d float64) float64 {
+	return (357.5291 + 0.98560028*d) * rad
+}
+
+func sunEclipticLongitude(M float64) float64 {
+	C := (1.9148*math.Sin(M) + 0.0200*math.Sin(2*M) + 0.0003*math.Sin(3*M)) * rad
+	return M + C + math.Pi + 102.9372*rad
+}
+
+// moonPosition returns the moon's right ascension, declination and ecliptic
+// longitude at Julian day j with a low precision series (within about a
+// quarter degree), which is plenty for rise and set times
+func moonPosition(j float64) (float64, float64, float64) {
+	d := j - j2000
+	L := (218.316 + 13.176396*d) * rad
+	M := (134.963 + 13.064993*d) * rad
+	F := (93.272 + 13.229350*d) * rad
+	l := L + 6.289*rad*math.Sin(M)
+	b := 5.128 * rad * math.Sin(F)
+	ra := math.Atan2(math.Sin(l)*math.Cos(obliquity)-math.Tan(b)*math.Sin(obliquity), math.Cos(l))
+	dec := math.Asin(math.Sin(b)*math.Cos(obliquity) + math.Cos(b)*math.Sin(obliquity)*math.Sin(l))
+	return ra, dec, l
+}
+
+func moonAltitude(t time.Time, lat, lon float64) float64 {
+	j := julianDay(t)
+	ra, dec, _ := moonPosition(j)
+	H := (280.16+360.9856235*(j-j2000)+lon)*rad - ra
+	phi := lat * rad
+	return math.Asin(math.Sin(phi)*math.Sin(dec) + math.Cos(phi)*math.Cos(dec)*math.Cos(H))
+}
+
+// moonDay finds the moon's phase at noon and its rise and set times by
+// stepping through the day looking for the altitude crossing the horizon
+func moonDay(day time.Time, lat, lon float64) Moon {
+	j := julianDay(day.Add(12 * time.Hour))
+	_, _, moonLon := moonPosition(j)
+	sunLon := sunEclipticLongitude(sunMeanAnomaly(j - j2000))
+	elongation := math.Mod(moonLon-sunLon, 2*math.Pi)
+	if elongation < 0 {
+		elongation += 2 * math.Pi
+	}
+	moon := Moon{
+		Age:          elongation / (2 * math.Pi),
+		Illumination: (1 - math.Cos(elongation)) / 2,
+	}
+	moon.Phase = moonPhases[int(math.Floor(moon.Age*8+0.5))%8]
+
+	const step = 10 * time.Minute
+	end := day.AddDate(0, 0, 1)
+	prev := moonAltitude(day, lat, lon) - moonriseAltitude
+	for t := day.Add(step); !t.After(end); t = t.Add(step) {
+		cur := moonAltitude(t, lat, lon) - moonriseAltitude
+		if (prev < 0) != (cur < 0) {
+			at := t.Add(-time.Duration(float64(step) * cur / (cur - prev))).Truncate(time.Minute)
+			if cur >= 0 && moon.Rise.IsZero() {
+				moon.Rise = at
+			} else if cur < 0 && moon.Set.IsZero() {
+				moon.Set = at
+			}
+		}
+		prev = cur
+	}
+	return moon
+}
+
+func julianDay(t time.Time) float64 {
+	return float64(t.Unix())/86400 + 2440587.5
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(0, int64((j-2440587.5)*86400*1e9)).Truncate(time.Second)
+}
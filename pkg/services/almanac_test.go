@@ -0,0 +1,175 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	bst := time.FixedZone("BST", 3600)
+	cet := time.FixedZone("CET", 3600)
+	at := func(loc *time.Location, y int, m time.Month, d, hour, min int) time.Time {
+		return time.Date(y, m, d, hour, min, 0, 0, loc)
+	}
+	tests := []struct {
+		name                   string
+		date                   time.Time
+		lat, lon               float64
+		sunrise, sunset, noon  time.Time
+		civilDawn, civilDusk   time.Time
+		dayLength, tolerance   time.Duration
+		noSunrise, noCivilDusk bool
+	}{
+		// published times for London at the solstice are 04:43, 21:21 and
+		// 13:02 with civil twilight from 03:56 to 22:09
+		{
+			name: "London solstice", date: at(bst, 2024, 6, 21, 12, 0), lat: 51.5074, lon: -0.1278,
+			sunrise: at(bst, 2024, 6, 21, 4, 43), sunset: at(bst, 2024, 6, 21, 21, 21), noon: at(bst, 2024, 6, 21, 13, 2),
+			civilDawn: at(bst, 2024, 6, 21, 3, 56), civilDusk: at(bst, 2024, 6, 21, 22, 9),
+			dayLength: 16*time.Hour + 38*time.Minute, tolerance: 2 * time.Minute,
+		},
+		// at the equator on the equinox the day is a few minutes over 12
+		// hours because of refraction and the size of the sun's disc
+		{
+			name: "equator equinox", date: at(time.UTC, 2024, 3, 20, 12, 0), lat: 0, lon: 0,
+			sunrise: at(time.UTC, 2024, 3, 20, 6, 4), sunset: at(time.UTC, 2024, 3, 20, 18, 11), noon: at(time.UTC, 2024, 3, 20, 12, 7),
+			civilDawn: at(time.UTC, 2024, 3, 20, 5, 42), civilDusk: at(time.UTC, 2024, 3, 20, 18, 32),
+			dayLength: 12*time.Hour + 7*time.Minute, tolerance: 2 * time.Minute,
+		},
+		// polar night in Tromsø: no sunrise, but there is civil twilight
+		{
+			name: "polar night", date: at(cet, 2024, 12, 21, 12, 0), lat: 69.65, lon: 18.96,
+			noon: at(cet, 2024, 12, 21, 11, 42), civilDawn: at(cet, 2024, 12, 21, 9, 31), civilDusk: at(cet, 2024, 12, 21, 13, 53),
+			dayLength: 0, tolerance: 5 * time.Minute, noSunrise: true,
+		},
+		// midnight sun in Tromsø: the sun doesn't set
+		{
+			name: "midnight sun", date: at(cet, 2024, 6, 21, 12, 0), lat: 69.65, lon: 18.96,
+			noon:      at(cet, 2024, 6, 21, 11, 44),
+			dayLength: 24 * time.Hour, tolerance: 5 * time.Minute, noSunrise: true, noCivilDusk: true,
+		},
+	}
+	near := func(name, what string, got, want time.Time, tolerance time.Duration) {
+		t.Helper()
+		if d := got.Sub(want); d > tolerance || d < -tolerance {
+			t.Errorf("%s: %s is %v, want %v", name, what, got, want)
+		}
+	}
+	for _, tt := range tests {
+		a := newAlmanac(tt.date, tt.date.Location(), tt.lat, tt.lon)
+		if tt.noSunrise {
+			if !a.Sunrise.IsZero() || !a.Sunset.IsZero() {
+				t.Errorf("%s: sunrise %v and sunset %v, want none", tt.name, a.Sunrise, a.Sunset)
+			}
+		} else {
+			near(tt.name, "sunrise", a.Sunrise, tt.sunrise, tt.tolerance)
+			near(tt.name, "sunset", a.Sunset, tt.sunset, tt.tolerance)
+		}
+		if tt.noCivilDusk {
+			if !a.CivilDawn.IsZero() || !a.CivilDusk.IsZero() {
+				t.Errorf("%s: civil dawn %v and dusk %v, want none", tt.name, a.CivilDawn, a.CivilDusk)
+			}
+		} else {
+			near(tt.name, "civil dawn", a.CivilDawn, tt.civilDawn, tt.tolerance)
+			near(tt.name, "civil dusk", a.CivilDusk, tt.civilDusk, tt.tolerance)
+		}
+		near(tt.name, "solar noon", a.SolarNoon, tt.noon, tt.tolerance)
+		if d := a.DayLength - tt.dayLength; d > tt.tolerance || d < -tt.tolerance {
+			t.Errorf("%s: day length is %v, want %v", tt.name, a.DayLength, tt.dayLength)
+		}
+		if len(a.Week) != almanacDays {
+			t.Fatalf("%s: %d days in the week ahead, want %d", tt.name, len(a.Week), almanacDays)
+		}
+		for i, day := range a.Week {
+			if want := a.Date.AddDate(0, 0, i+1); !day.Date.Equal(want) {
+				t.Errorf("%s: week day %d is %v, want %v", tt.name, i+1, day.Date, want)
+			}
+		}
+	}
+}
+
+func TestDayLengthChange(t *testing.T) {
+	// days get longer in spring and shorter in autumn, by a couple of
+	// minutes a day at London's latitude
+	spring := newAlmanac(time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC), time.UTC, 51.5074, -0.1278)
+	if spring.DayLengthChange < 3*time.Minute || spring.DayLengthChange > 5*time.Minute {
+		t.Errorf("spring day length change is %v, want about +3m 40s", spring.DayLengthChange)
+	}
+	autumn := newAlmanac(time.Date(2024, 9, 22, 12, 0, 0, 0, time.UTC), time.UTC, 51.5074, -0.1278)
+	if autumn.DayLengthChange > -3*time.Minute || autumn.DayLengthChange < -5*time.Minute {
+		t.Errorf("autumn day length change is %v, want about -3m 40s", autumn.DayLengthChange)
+	}
+}
+
+func TestMoonDay(t *testing.T) {
+	bst := time.FixedZone("BST", 3600)
+	tests := []struct {
+		name  string
+		day   time.Time
+		phase string
+		// the age and illumination must be within 0.05 of these
+		age, illumination float64
+	}{
+		// the full moon was at 01:08 UTC on the 22nd
+		{"full", time.Date(2024, 6, 21, 0, 0, 0, 0, bst), "Full Moon", 0.48, 1},
+		// the new moon was at 22:57 UTC on the 5th
+		{"new", time.Date(2024, 7, 6, 0, 0, 0, 0, bst), "New Moon", 0.02, 0},
+		// the first quarter was at 22:18 UTC on the 13th
+		{"first quarter", time.Date(2024, 7, 14, 0, 0, 0, 0, bst), "First Quarter", 0.26, 0.58},
+		// the last quarter was at 02:17 UTC on the 28th
+		{"last quarter", time.Date(2024, 6, 28, 0, 0, 0, 0, bst), "Last Quarter", 0.74, 0.58},
+	}
+	for _, tt := range tests {
+		moon := moonDay(tt.day, 51.5074, -0.1278)
+		if moon.Phase != tt.phase {
+			t.Errorf("%s: phase is %s, want %s", tt.name, moon.Phase, tt.phase)
+		}
+		if d := moon.Age - tt.age; d > 0.05 || d < -0.05 {
+			t.Errorf("%s: age is %.3f, want %.2f", tt.name, moon.Age, tt.age)
+		}
+		if d := moon.Illumination - tt.illumination; d > 0.05 || d < -0.05 {
+			t.Errorf("%s: illumination is %.3f, want %.2f", tt.name, moon.Illumination, tt.illumination)
+		}
+		end := tt.day.AddDate(0, 0, 1)
+		for what, at := range map[string]time.Time{"rise": moon.Rise, "set": moon.Set} {
+			if !at.IsZero() && (at.Before(tt.day) || at.After(end)) {
+				t.Errorf("%s: moon%s at %v is not on %s", tt.name, what, at, tt.day.Format("2006-01-02"))
+			}
+		}
+	}
+
+	// a full moon rises around sunset and sets around sunrise
+	a := newAlmanac(time.Date(2024, 6, 21, 12, 0, 0, 0, bst), bst, 51.5074, -0.1278)
+	if d := a.Moon.Rise.Sub(a.Sunset); d < -time.Hour || d > time.Hour {
+		t.Errorf("full moonrise at %v is not near sunset at %v", a.Moon.Rise, a.Sunset)
+	}
+	if d := a.Moon.Set.Sub(a.Sunrise); d < -2*time.Hour || d > time.Hour {
+		t.Errorf("full moonset at %v is not near sunrise at %v", a.Moon.Set, a.Sunrise)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d      time.Duration
+		signed bool
+		want   string
+	}{
+		{16*time.Hour + 38*time.Minute + 23*time.Second, false, "16h 38m"},
+		{16*time.Hour + 38*time.Minute + 31*time.Second, false, "16h 39m"},
+		{0, false, "0h 00m"},
+		{24 * time.Hour, false, "24h 00m"},
+		{59*time.Minute + 40*time.Second, false, "1h 00m"},
+		// signed changes under an hour include the seconds
+		{3*time.Minute + 41*time.Second, true, "+3m 41s"},
+		{-(3*time.Minute + 41*time.Second), true, "-3m 41s"},
+		{400 * time.Millisecond, true, "+0m 00s"},
+		{0, true, "+0m 00s"},
+		{-(time.Hour + 30*time.Minute), true, "-1h 30m"},
+		{-5 * time.Minute, false, "-0h 05m"},
+	}
+	for _, tt := range tests {
+		if got := formatDuration(tt.d, tt.signed); got != tt.want {
+			t.Errorf("formatDuration(%v, %v) = %q, want %q", tt.d, tt.signed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	archiveIndexDir   = "onimage-archive"
+	archiveImageFile  = "archive.jpg"
+	archiveThumbFile  = "archive-thumb.jpg"
+	archivePageCache  = "public, max-age=300"
+	archiveImageCache = "public, max-age=31536000, immutable"
+)
+
+// Archive publishes a browsable archive of past days to the website: a
+// gallery page for each day at archive/<date>/index.html and a calendar for
+// each month at archive/<month>/index.html. The captures of each day are
+// recorded in a local index so that pages can be regenerated after the
+// capture directories have been removed by retention, and each new capture
+// only regenerates the pages it affects
+type Archive struct {
+	enabled    bool
+	templates  *Templates
+	imageWidth int
+	thumbWidth int
+	indexDir   string
+	publisher  *Publisher
+	errChan    chan error
+
+	lock sync.Mutex
+	// days holds the date of every archived day, in order
+	days []string
+}
+
+// ArchiveCapture is one capture in a day's archive; Image and Thumb are
+// public URLs
+type ArchiveCapture struct {
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	Image    string    `json:"image"`
+	Thumb    string    `json:"thumb"`
+	Temp     *float32  `json:"temp,omitempty"`
+	TempUnit string    `json:"temp_unit,omitempty"`
+	Weather  string    `json:"weather,omitempty"`
+}
+
+// archiveDay is the local index record of one day
+type archiveDay struct {
+	Date     string           `json:"date"`
+	Captures []ArchiveCapture `json:"captures"`
+}
+
+// ArchiveDayPage is passed to the day page template. PrevURL and NextURL
+// link to the adjacent archived days and are empty at either end
+type ArchiveDayPage struct {
+	Date      string
+	Time      time.Time
+	Captures  []ArchiveCapture
+	Highlight *ArchiveCapture
+	MonthURL  string
+	Prev      string
+	PrevURL   string
+	Next      string
+	NextURL   string
+}
+
+// ArchiveMonthPage is passed to the month page template. Weeks holds the
+// calendar, Sunday first, with zero value days padding the first and last
+// weeks
+type ArchiveMonthPage struct {
+	Month    string
+	Time     time.Time
+	Weekdays []string
+	Weeks    [][]ArchiveCalendarDay
+	Days     int
+	Prev     string
+	PrevURL  string
+	Next     string
+	NextURL  string
+}
+
+// ArchiveCalendarDay is one day of a month calendar; URL and Thumb are empty
+// for days without any captures
+type ArchiveCalendarDay struct {
+	Day      int
+	Date     string
+	Captures int
+	URL      string
+	Thumb    string
+}
+
+// NewArchiveService returns the archive service; its page templates are
+// loaded into templates with the rest of the website's templates
+func NewArchiveService(config map[string]interface{}, errChan chan error, templates *Templates, publisher *Publisher) (*Archive, error) {
+	enabled, err := util.GetBoolFromConfig(config, "archive.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Archive{}, nil
+	}
+	homeDir, err := util.GetStringFromConfig(config, "home_dir")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve entry 'home_dir' from config: %w", err)
+	}
+	imageWidth, err := util.GetIntFromConfig(config, "archive.image_width")
+	if err != nil || imageWidth < 0 {
+		imageWidth = 1280
+	}
+	thumbWidth, err := util.GetIntFromConfig(config, "archive.thumb_width")
+	if err != nil || thumbWidth <= 0 {
+		thumbWidth = 320
+	}
+	a := &Archive{
+		enabled:    true,
+		templates:  templates,
+		imageWidth: int(imageWidth),
+		thumbWidth: int(thumbWidth),
+		indexDir:   filepath.Join(homeDir, archiveIndexDir),
+		publisher:  publisher,
+		errChan:    errChan,
+	}
+	if err := os.MkdirAll(a.indexDir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create archive index directory: %w", err)
+	}
+	entries, err := os.ReadDir(a.indexDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read archive index: %w", err)
+	}
+	for _, e := range entries {
+		if date := strings.TrimSuffix(e.Name(), ".json"); dayDirRegex.MatchString(date) {
+			a.days = append(a.days, date)
+		}
+	}
+	sort.Strings(a.days)
+	logrus.Infof("Archive has %d days", len(a.days))
+	return a, nil
+}
+
+// Published is the ImageProcessor publish hook; it adds the capture to its
+// day's archive and regenerates that day's page. The month page is only
+// regenerated when the day is new to the archive and at the end of the day
+func (a *Archive) Published(img PublishedImage) {
+	if !a.enabled {
+		return
+	}
+	date := path.Base(path.Dir(img.Dir))
+	if !dayDirRegex.MatchString(date) {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.addCaptures(date, []string{img.Dir}); err != nil {
+		a.errChan <- fmt.Errorf("unable to archive %s: %w", img.Dir, err)
+	}
+}
+
+// DayEnd is the ImageProcessor end of day step; it archives any of the
+// day's captures that were missed and regenerates the month page with the
+// day's final capture count
+func (a *Archive) DayEnd(date, dayDir string) error {
+	if !a.enabled {
+		return nil
+	}
+	captures, err := listCaptures(dayDir)
+	if err != nil {
+		return fmt.Errorf("unable to list captures in %s: %w", dayDir, err)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.addCaptures(date, captures); err != nil {
+		return err
+	}
+	if _, ok := a.dayIndex(date); !ok {
+		return nil
+	}
+	return a.publishMonth(date[:7])
+}
+
+// addCaptures publishes the archive images of any captures that are not
+// yet in the day's index and updates the affected pages; it must be called
+// with the lock held
+func (a *Archive) addCaptures(date string, dirs []string) error {
+	day, err := a.loadDay(date)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, c := range day.Captures {
+		known[c.Name] = true
+	}
+	added := 0
+	for _, dir := range dirs {
+		if known[path.Base(dir)] {
+			continue
+		}
+		c, err := a.publishCapture(date, dir)
+		if err != nil {
+			return err
+		}
+		day.Captures = append(day.Captures, *c)
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	sort.Slice(day.Captures, func(i, j int) bool {
+		return day.Captures[i].Name < day.Captures[j].Name
+	})
+	if err := a.saveDay(day); err != nil {
+		return err
+	}
+
+	i, ok := a.dayIndex(date)
+	if !ok {
+		// a new day changes the navigation of the days on either side of it
+		// and, when they fall in other months, of those months
+		a.days = append(a.days, "")
+		copy(a.days[i+1:], a.days[i:])
+		a.days[i] = date
+		months := []string{date[:7]}
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(a.days) {
+				continue
+			}
+			if err := a.publishDay(a.days[j]); err != nil {
+				return err
+			}
+			if m := a.days[j][:7]; m != date[:7] {
+				months = append(months, m)
+			}
+		}
+		for _, m := range months {
+			if err := a.publishMonth(m); err != nil {
+				return err
+			}
+		}
+	}
+	return a.publishDay(date)
+}
+
+// publishCapture creates and publishes the archive image and thumbnail of
+// a capture
+func (a *Archive) publishCapture(date, dir string) (*ArchiveCapture, error) {
+	img, err := loadJPEG(path.Join(dir, "final.jpg"))
+	if err != nil {
+		return nil, err
+	}
+	full := img
+	if a.imageWidth > 0 && img.Bounds().Dx() > a.imageWidth {
+		full = resizeImage(img, a.imageWidth, 0)
+	}
+	name := path.Base(dir)
+	c := &ArchiveCapture{Name: name}
+	opts := PublishOptions{ContentType: "image/jpeg", CacheControl: archiveImageCache}
+	for _, f := range []struct {
+		file, key string
+		url       *string
+		width     int
+	}{
+		{archiveImageFile, fmt.Sprintf("archive/%s/%s.jpg", date, name), &c.Image, 0},
+		{archiveThumbFile, fmt.Sprintf("archive/%s/%s-thumb.jpg", date, name), &c.Thumb, a.thumbWidth},
+	} {
+		local := path.Join(dir, f.file)
+		out := full
+		if f.width > 0 {
+			out = resizeImage(img, f.width, 0)
+		}
+		if err := saveJPEG(local, out, 85); err != nil {
+			return nil, fmt.Errorf("unable to save %s: %w", local, err)
+		}
+		if err := a.publisher.Publish(local, f.key, opts); err != nil {
+			return nil, err
+		}
+		*f.url = a.publisher.URL(f.key)
+	}
+	if meta, err := loadCaptureMeta(dir); err == nil {
+		c.Time = meta.Time
+		c.Temp = meta.Temp
+		c.TempUnit = meta.TempUnit
+		if meta.Weather != nil && len(meta.Weather.WeatherDesc) > 0 {
+			c.Weather = meta.Weather.WeatherDesc[0].Description
+		}
+	}
+	return c, nil
+}
+
+// DayCaptures returns the archived captures of a day by name; it returns
+// nil if the archive is not enabled
+func (a *Archive) DayCaptures(date string) map[string]ArchiveCapture {
+	if !a.enabled {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	day, err := a.loadDay(date)
+	if err != nil {
+		logrus.Warnf("unable to load archive index for %s: %v", date, err)
+		return nil
+	}
+	captures := map[string]ArchiveCapture{}
+	for _, c := range day.Captures {
+		captures[c.Name] = c
+	}
+	return captures
+}
+
+func (a *Archive) publishDay(date string) error {
+	page, err := a.dayPage(date)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Publishing archive page for %s", date)
+	return a.publisher.PublishTemplate(a.templates, PageArchiveDay, page, fmt.Sprintf("archive/%s/index.html", date),
+		PublishOptions{ContentType: "text/html", CacheControl: archivePageCache})
+}
+
+func (a *Archive) publishMonth(month string) error {
+	page, err := a.monthPage(month)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Publishing archive calendar for %s", month)
+	return a.publisher.PublishTemplate(a.templates, PageArchiveMonth, page, fmt.Sprintf("archive/%s/index.html", month),
+		PublishOptions{ContentType: "text/html", CacheControl: archivePageCache})
+}
+
+// DayPage returns the data for the archive page of date, e.g. to preview
+// the day template
+func (a *Archive) DayPage(date string) (*ArchiveDayPage, error) {
+	if !a.enabled {
+		return nil, fmt.Errorf("the archive is not enabled")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.dayPage(date)
+}
+
+// MonthPage returns the data for the archive calendar of month
+func (a *Archive) MonthPage(month string) (*ArchiveMonthPage, error) {
+	if !a.enabled {
+		return nil, fmt.Errorf("the archive is not enabled")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.monthPage(month)
+}
+
+// LatestDay returns the date of the most recent archived day, or an empty
+// string if there are none
+func (a *Archive) LatestDay() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.days) == 0 {
+		return ""
+	}
+	return a.days[len(a.days)-1]
+}
+
+// dayPage must be called with the lock held
+func (a *Archive) dayPage(date string) (*ArchiveDayPage, error) {
+	day, err := a.loadDay(date)
+	if err != nil {
+		return nil, err
+	}
+	t, _ := time.ParseInLocation("2006-01-02", date, a.templates.location)
+	page := &ArchiveDayPage{
+		Date:     date,
+		Time:     t,
+		Captures: day.Captures,
+		MonthURL: a.monthURL(date[:7]),
+	}
+	if n := len(day.Captures); n > 0 {
+		// the middle capture of the day stands in for it in the calendar
+		page.Highlight = &day.Captures[n/2]
+	}
+	if i, ok := a.dayIndex(date); ok {
+		if i > 0 {
+			page.Prev = a.days[i-1]
+			page.PrevURL = a.dayURL(page.Prev)
+		}
+		if i < len(a.days)-1 {
+			page.Next = a.days[i+1]
+			page.NextURL = a.dayURL(page.Next)
+		}
+	}
+	return page, nil
+}
+
+// monthPage must be called with the lock held
+func (a *Archive) monthPage(month string) (*ArchiveMonthPage, error) {
+	start, err := time.ParseInLocation("2006-01", month, a.templates.location)
+	if err != nil {
+		return nil, err
+	}
+	page := &ArchiveMonthPage{Month: month, Time: start, Weekdays: weekdayNames()}
+	page.Weeks = calendarWeeks(start, func(cd *ArchiveCalendarDay) {
+		if _, ok := a.dayIndex(cd.Date); !ok {
+			return
+		}
+		day, lerr := a.loadDay(cd.Date)
+		if lerr != nil {
+			err = lerr
+			return
+		}
+		if n := len(day.Captures); n > 0 {
+			cd.Captures = n
+			cd.URL = a.dayURL(cd.Date)
+			cd.Thumb = day.Captures[n/2].Thumb
+			page.Days++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// adjacent months are the nearest ones with archived days
+	for _, date := range a.days {
+		if m := date[:7]; m < month {
+			page.Prev = m
+		} else if m > month && page.Next == "" {
+			page.Next = m
+		}
+	}
+	if page.Prev != "" {
+		page.PrevURL = a.monthURL(page.Prev)
+	}
+	if page.Next != "" {
+		page.NextURL = a.monthURL(page.Next)
+	}
+	return page, nil
+}
+
+// calendarWeeks lays out the days of the month starting at start in weeks
+// from Sunday, calling fill for each day of the month
+func calendarWeeks(start time.Time, fill func(*ArchiveCalendarDay)) [][]ArchiveCalendarDay {
+	var weeks [][]ArchiveCalendarDay
+	week := make([]ArchiveCalendarDay, int(start.Weekday()))
+	for t := start; t.Month() == start.Month(); t = t.AddDate(0, 0, 1) {
+		cd := ArchiveCalendarDay{Day: t.Day(), Date: t.Format("2006-01-02")}
+		fill(&cd)
+		week = append(week, cd)
+		if len(week) == 7 {
+			weeks = append(weeks, week)
+			week = nil
+		}
+	}
+	if len(week) > 0 {
+		weeks = append(weeks, append(week, make([]ArchiveCalendarDay, 7-len(week))...))
+	}
+	return weeks
+}
+
+func weekdayNames() []string {
+	var names []string
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		names = append(names, d.String()[:3])
+	}
+	return names
+}
+
+// DayURL returns the URL of the archive page of date, or an empty string
+// if the archive is not enabled
+func (a *Archive) DayURL(date string) string {
+	if !a.enabled {
+		return ""
+	}
+	return a.dayURL(date)
+}
+
+func (a *Archive) dayURL(date string) string {
+	return a.publisher.URL(fmt.Sprintf("archive/%s/index.html", date))
+}
+
+func (a *Archive) monthURL(month string) string {
+	return a.publisher.URL(fmt.Sprintf("archive/%s/index.html", month))
+}
+
+// dayIndex returns the position of date in the archived days, or where it
+// would be inserted
+func (a *Archive) dayIndex(date string) (int, bool) {
+	i := sort.SearchStrings(a.days, date)
+	return i, i < len(a.days) && a.days[i] == date
+}
+
+func (a *Archive) loadDay(date string) (*archiveDay, error) {
+	data, err := os.ReadFile(filepath.Join(a.indexDir, date+".json"))
+	if os.IsNotExist(err) {
+		return &archiveDay{Date: date}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var day archiveDay
+	if err := json.Unmarshal(data, &day); err != nil {
+		return nil, fmt.Errorf("invalid archive index for %s: %w", date, err)
+	}
+	return &day, nil
+}
+
+func (a *Archive) saveDay(day *archiveDay) error {
+	data, err := json.MarshalIndent(day, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(a.indexDir, day.Date+".json")
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendarWeeks(t *testing.T) {
+	tests := []struct {
+		month string
+		// the day in each cell of the first and last week, 0 for padding
+		first, last []int
+		weeks       int
+	}{
+		// starts on a Thursday, ends on a Friday
+		{"2023-06", []int{0, 0, 0, 0, 1, 2, 3}, []int{25, 26, 27, 28, 29, 30, 0}, 5},
+		// starts on a Sunday and ends on a Saturday: no padding
+		{"2015-02", []int{1, 2, 3, 4, 5, 6, 7}, []int{22, 23, 24, 25, 26, 27, 28}, 4},
+		// starts on a Saturday and needs six weeks
+		{"2023-07", []int{0, 0, 0, 0, 0, 0, 1}, []int{30, 31, 0, 0, 0, 0, 0}, 6},
+		// a leap February
+		{"2024-02", []int{0, 0, 0, 0, 1, 2, 3}, []int{25, 26, 27, 28, 29, 0, 0}, 5},
+	}
+	for _, tt := range tests {
+		start, err := time.ParseInLocation("2006-01", tt.month, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var filled []int
+		weeks := calendarWeeks(start, func(cd *ArchiveCalendarDay) {
+			filled = append(filled, cd.Day)
+			cd.Captures = cd.Day * 10
+		})
+		if len(weeks) != tt.weeks {
+			t.Fatalf("%s: %d weeks, want %d", tt.month, len(weeks), tt.weeks)
+		}
+		for i, week := range weeks {
+			if len(week) != 7 {
+				t.Errorf("%s: week %d has %d days", tt.month, i+1, len(week))
+			}
+		}
+		for name, check := range map[string]struct {
+			week []ArchiveCalendarDay
+			want []int
+		}{"first": {weeks[0], tt.first}, "last": {weeks[len(weeks)-1], tt.last}} {
+			for i, cd := range check.week {
+				if cd.Day != check.want[i] {
+					t.Errorf("%s: %s week day %d is %d, want %d", tt.month, name, i, cd.Day, check.want[i])
+				}
+				if cd.Day == 0 && cd.Date != "" {
+					t.Errorf("%s: padding day has date %s", tt.month, cd.Date)
+				}
+				if cd.Day != 0 && cd.Date != start.AddDate(0, 0, cd.Day-1).Format("2006-01-02") {
+					t.Errorf("%s: day %d has date %s", tt.month, cd.Day, cd.Date)
+				}
+				if cd.Day != 0 && cd.Captures != cd.Day*10 {
+					t.Errorf("%s: day %d was not filled in", tt.month, cd.Day)
+				}
+			}
+		}
+		days := start.AddDate(0, 1, -1).Day()
+		if len(filled) != days {
+			t.Errorf("%s: fill called for %d days, want %d", tt.month, len(filled), days)
+		}
+	}
+}
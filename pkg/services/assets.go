@@ -0,0 +1,400 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	assetManifestFile = "onimage-assets.json"
+	// files smaller than this aren't worth compressing
+	gzipMinSize = 1024
+)
+
+var (
+	// keys and key prefixes the daemon publishes to; an asset at one of
+	// them would overwrite, or be overwritten by, the daemon's object
+	daemonKeys     = []string{"index.html", latestFeedKey, todayFeedKey, "keogram.jpg", "highlights.atom"}
+	daemonPrefixes = []string{"archive/", "images/", "highlights/", "keogram/", "timelapse/"}
+)
+
+// Assets keeps the site's static files (CSS, JS, icons, ...) in
+// 'website.assets_dir' in sync with the bucket. Each file is published to
+// its path relative to the directory; a manifest of the content hash of
+// every published file means only new and changed files are uploaded,
+// both at startup and when the directory changes
+type Assets struct {
+	enabled   bool
+	dir       string
+	gzip      bool
+	reserved  map[string]bool
+	cache     []assetCacheRule
+	manifest  string
+	publisher *Publisher
+	errChan   chan error
+
+	lock      sync.Mutex
+	published map[string]string
+}
+
+type assetCacheRule struct {
+	pattern      string
+	cacheControl string
+}
+
+// NewAssetService returns the asset sync; it does nothing unless
+// 'website.assets_dir' is set
+func NewAssetService(config map[string]interface{}, errChan chan error, publisher *Publisher) (*Assets, error) {
+	dir, err := util.GetStringFromConfig(config, "website.assets_dir")
+	if err != nil || dir == "" {
+		return &Assets{}, nil
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("'website.assets_dir' %s is not a directory", dir)
+	}
+	homeDir, err := util.GetStringFromConfig(config, "home_dir")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve entry 'home_dir' from config: %w", err)
+	}
+	// the bucket doesn't negotiate encodings, so compressed variants are
+	// published next to the plain files for a CDN or rewrite rule to pick
+	gzipAssets, err := util.GetBoolFromConfig(config, "website.assets_gzip")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	reserved := map[string]bool{}
+	for _, key := range daemonKeys {
+		reserved[key] = true
+	}
+	if key, err := util.GetStringFromConfig(config, "highlights.key"); err == nil && key != "" {
+		reserved[key] = true
+	}
+	a := &Assets{
+		enabled:   true,
+		dir:       filepath.Clean(dir),
+		gzip:      gzipAssets,
+		reserved:  reserved,
+		manifest:  filepath.Join(homeDir, assetManifestFile),
+		publisher: publisher,
+		errChan:   errChan,
+		published: map[string]string{},
+	}
+	rules, err := util.GetTableSliceFromConfig(config, "website.asset_cache")
+	if err != nil {
+		rules = nil
+	}
+	for i, rule := range rules {
+		pattern, err := util.GetStringFromConfig(rule, "pattern")
+		if err != nil {
+			return nil, fmt.Errorf("'website.asset_cache' entry %d has no pattern", i+1)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid 'website.asset_cache' pattern %q: %w", pattern, err)
+		}
+		cacheControl, err := util.GetStringFromConfig(rule, "cache_control")
+		if err != nil {
+			return nil, fmt.Errorf("'website.asset_cache' entry %q has no cache_control", pattern)
+		}
+		a.cache = append(a.cache, assetCacheRule{pattern: pattern, cacheControl: cacheControl})
+	}
+	if data, err := os.ReadFile(a.manifest); err == nil {
+		if err := json.Unmarshal(data, &a.published); err != nil {
+			logrus.Warnf("Ignoring unreadable asset manifest %s: %v", a.manifest, err)
+			a.published = map[string]string{}
+		}
+	}
+	return a, nil
+}
+
+// Start syncs the assets directory and then watches it for changes
+func (a *Assets) Start() {
+	if !a.enabled {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("unable to watch assets directory, assets are only synced at startup: %v", err)
+	}
+	go func() {
+		if err := a.Sync(); err != nil {
+			a.errChan <- err
+		}
+		if watcher != nil {
+			a.watch(watcher)
+		}
+	}()
+}
+
+// Sync publishes every asset that is new or changed since it was last
+// published. Files removed from the directory are forgotten but left in
+// the bucket
+func (a *Assets) Sync() error {
+	if !a.enabled {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	seen := map[string]bool{}
+	var uploaded, failed int
+	err := filepath.WalkDir(a.dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip hidden files and directories, e.g. editor swap files
+		if strings.HasPrefix(d.Name(), ".") && file != a.dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(a.dir, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if a.reservedKey(key) {
+			logrus.Warnf("Skipping asset %s: the key is published by onimage", key)
+			return nil
+		}
+		if a.gzip && strings.HasSuffix(key, ".gz") {
+			if _, err := os.Stat(strings.TrimSuffix(file, ".gz")); err == nil {
+				logrus.Warnf("Skipping asset %s: the key is published as the gzip variant of %s", key, strings.TrimSuffix(key, ".gz"))
+				return nil
+			}
+		}
+		seen[key] = true
+		changed, err := a.publishAsset(file, key)
+		if err != nil {
+			logrus.Errorf("unable to publish asset %s: %v", key, err)
+			failed++
+		} else if changed {
+			uploaded++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read assets directory %s: %w", a.dir, err)
+	}
+	for key := range a.published {
+		if !seen[key] {
+			delete(a.published, key)
+		}
+	}
+	if err := a.saveManifest(); err != nil {
+		return err
+	}
+	logrus.Infof("Assets synced: %d uploaded, %d unchanged, %d failed", uploaded, len(seen)-uploaded-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("unable to publish %d assets", failed)
+	}
+	return nil
+}
+
+// publishAsset uploads file to key unless the manifest shows the same
+// content was already published with the same options, along with its
+// gzip variant at key.gz when compression is enabled and worthwhile; it
+// must be called with the lock held
+func (a *Assets) publishAsset(file, key string) (bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	opts := PublishOptions{ContentType: assetContentType(key, data), CacheControl: a.cacheControl(key)}
+	// the options are part of the hash so that changing a cache rule
+	// publishes the affected files again
+	sum := sha256.New()
+	sum.Write(data)
+	fmt.Fprintf(sum, "\x00%s\x00%s\x00%t", opts.ContentType, opts.CacheControl, a.gzip)
+	hash := hex.EncodeToString(sum.Sum(nil))
+	if a.published[key] == hash {
+		return false, nil
+	}
+
+	logrus.Debugf("Publishing asset %s (%s)", key, opts.ContentType)
+	if err := a.publisher.Publish(file, key, opts); err != nil {
+		return false, err
+	}
+	if a.gzip && compressible(opts.ContentType) && len(data) >= gzipMinSize {
+		gzFile, err := gzipAsset(data)
+		if err != nil {
+			return false, err
+		}
+		if gzFile != "" {
+			defer os.Remove(gzFile)
+			opts.ContentEncoding = "gzip"
+			if err := a.publisher.Publish(gzFile, key+".gz", opts); err != nil {
+				return false, err
+			}
+		}
+	}
+	a.published[key] = hash
+	return true, nil
+}
+
+// reservedKey reports whether key is one the daemon publishes to, including
+// the latest image in each size (latest.jpg, latest-640.jpg, ...)
+func (a *Assets) reservedKey(key string) bool {
+	if a.reserved[key] {
+		return true
+	}
+	if ok, _ := path.Match("latest*.jpg", key); ok {
+		return true
+	}
+	for _, prefix := range daemonPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveManifest must be called with the lock held
+func (a *Assets) saveManifest() error {
+	data, err := json.MarshalIndent(a.published, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(a.manifest, data, 0644); err != nil {
+		return fmt.Errorf("unable to write asset manifest: %w", err)
+	}
+	return nil
+}
+
+// cacheControl returns the cache control of the first rule matching key;
+// patterns without a "/" match the file name in any directory
+func (a *Assets) cacheControl(key string) string {
+	for _, rule := range a.cache {
+		name := key
+		if !strings.Contains(rule.pattern, "/") {
+			name = path.Base(key)
+		}
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.cacheControl
+		}
+	}
+	return ""
+}
+
+func (a *Assets) watch(watcher *fsnotify.Watcher) {
+	a.watchTree(watcher, a.dir)
+	// a change usually touches several files, so sync once they settle
+	pending := time.NewTimer(reloadDebounce)
+	pending.Stop()
+	for {
+		select {
+		case e := <-watcher.Events:
+			if strings.HasPrefix(filepath.Base(e.Name), ".") {
+				continue
+			}
+			if e.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+					a.watchTree(watcher, e.Name)
+				}
+			}
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				pending.Reset(reloadDebounce)
+			}
+		case <-pending.C:
+			if err := a.Sync(); err != nil {
+				a.errChan <- err
+			}
+		case err := <-watcher.Errors:
+			logrus.Errorf("assets watcher error: %v", err)
+		}
+	}
+}
+
+// watchTree adds dir and its subdirectories to the watcher, as fsnotify
+// doesn't watch recursively
+func (a *Assets) watchTree(watcher *fsnotify.Watcher, dir string) {
+	filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && file != a.dir {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(file); err != nil {
+			logrus.Warnf("unable to watch assets directory %s: %v", file, err)
+		}
+		return nil
+	})
+}
+
+// assetContentType uses the file extension, falling back to sniffing the
+// content
+func assetContentType(key string, data []byte) string {
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(data)
+}
+
+// compressible reports whether a content type is text-like; images, fonts
+// and other binary formats are already compressed
+func compressible(contentType string) bool {
+	ct, _, _ := strings.Cut(contentType, ";")
+	ct = strings.TrimSpace(ct)
+	if strings.HasPrefix(ct, "text/") || strings.HasSuffix(ct, "+json") || strings.HasSuffix(ct, "+xml") {
+		return true
+	}
+	switch ct {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml", "image/x-icon", "image/vnd.microsoft.icon":
+		return true
+	}
+	return false
+}
+
+// gzipAsset writes the compressed data to a temporary file and returns its
+// name, or an empty name when compression doesn't make it smaller
+func gzipAsset(data []byte) (string, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if buf.Len() >= len(data) {
+		return "", nil
+	}
+	tmpFile, err := os.CreateTemp("/tmp", "asset")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temp file for compressed asset: %w", err)
+	}
+	if _, err := tmpFile.Write(buf.Bytes()); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReservedAssetKeys(t *testing.T) {
+	a, err := NewAssetService(map[string]interface{}{
+		"home_dir": t.TempDir(),
+		"website": map[string]interface{}{
+			"assets_dir": t.TempDir(),
+		},
+		"highlights": map[string]interface{}{
+			"key": "feeds/highlights.xml",
+		},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.gzip {
+		t.Errorf("assets are gzipped by default")
+	}
+	for key, want := range map[string]bool{
+		"index.html":                        true,
+		"latest.jpg":                        true,
+		"latest-640.jpg":                    true,
+		"latest.json":                       true,
+		"today.json":                        true,
+		"keogram.jpg":                       true,
+		"highlights.atom":                   true,
+		"feeds/highlights.xml":              true,
+		"archive/2023-06/index.html":        true,
+		"images/2023-06-01/1230.jpg":        true,
+		"timelapse/2023-06-01.mp4":          true,
+		"highlights/2023-06-01/sunrise.jpg": true,
+		"style.css":                         false,
+		"about/index.html":                  false,
+		"icons/latest.jpg":                  false,
+		"js/today.json":                     false,
+		"archive.css":                       false,
+	} {
+		if got := a.reservedKey(key); got != want {
+			t.Errorf("reservedKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+
+	if _, err := NewAssetService(map[string]interface{}{
+		"home_dir": t.TempDir(),
+		"website": map[string]interface{}{
+			"assets_dir":  t.TempDir(),
+			"assets_gzip": "yes",
+		},
+	}, nil, nil); err == nil {
+		t.Errorf("an invalid 'website.assets_gzip' was accepted")
+	}
+}
+
+func TestAssetsGzip(t *testing.T) {
+	log, _ := fakeAWS(t)
+	dir := t.TempDir()
+	css := strings.Repeat("body { margin: 0; }\n", 100)
+	for name, content := range map[string]string{
+		"style.css":    css,
+		"small.css":    "body { margin: 0; }",
+		"logo.png":     "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 2048),
+		"style.css.gz": "not the variant",
+		"old.js.gz":    "a compressed file without a plain one",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newTestPublisher(t)
+	a, err := NewAssetService(map[string]interface{}{
+		"home_dir": t.TempDir(),
+		"website":  map[string]interface{}{"assets_dir": dir, "assets_gzip": true},
+	}, p.errChan, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the plain file is published as it is, for clients that don't accept
+	// gzip, and the variant next to it
+	if got := bucketObject(t, log, "style.css"); got != css {
+		t.Errorf("style.css is %d bytes, want the %d plain bytes", len(got), len(css))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(bucketObject(t, log, "style.css.gz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(zr); err != nil || string(data) != css {
+		t.Errorf("style.css.gz doesn't decompress to style.css: %v", err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		gz := strings.Contains(line, " s3://bucket/style.css.gz ")
+		if encoded := strings.Contains(line, "--content-encoding gzip"); encoded != gz {
+			t.Errorf("upload %q: content encoding set %v", line, encoded)
+		}
+		if gz && !strings.Contains(line, "--content-type text/css") {
+			t.Errorf("variant upload %q doesn't keep the content type", line)
+		}
+	}
+	// small files and binary formats aren't worth compressing
+	for _, key := range []string{"small.css", "logo.png", "style.css", "old.js.gz"} {
+		if n := uploads(t, log, key); n != 1 {
+			t.Errorf("%s uploaded %d times, want once", key, n)
+		}
+	}
+	for _, key := range []string{"small.css.gz", "logo.png.gz"} {
+		if n := uploads(t, log, key); n != 0 {
+			t.Errorf("%s uploaded %d times", key, n)
+		}
+	}
+	// the asset named like the variant is skipped, leaving the variant
+	// checked above
+	if n := uploads(t, log, "style.css.gz"); n != 1 {
+		t.Errorf("style.css.gz uploaded %d times, want only the variant", n)
+	}
+
+	// unchanged files aren't uploaded again, nor are their variants
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := uploads(t, log, "style.css.gz"); n != 1 {
+		t.Errorf("style.css.gz uploaded %d times after a sync without changes", n)
+	}
+}
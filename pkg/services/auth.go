@@ -0,0 +1,383 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HMAC signed requests carry the client name, a unix timestamp and the
+	// hex encoded HMAC-SHA256 of "METHOD\nREQUEST_URI\nTIMESTAMP\nBODY_SHA256"
+	// keyed by the client's secret, where BODY_SHA256 is the hex SHA-256 of
+	// the request body (of no bytes for a request without one)
+	HeaderClient    = "X-Onimage-Client"
+	HeaderTimestamp = "X-Onimage-Timestamp"
+	HeaderSignature = "X-Onimage-Signature"
+
+	maxSignatureSkew = 5 * time.Minute
+	// signed request bodies are spooled to disk to be hashed before the
+	// handler reads them, up to this size unless the handler is registered
+	// with a larger limit
+	maxSignedBodyBytes = 16 << 10
+
+	// browsers can't set headers for page loads and images, so read-only
+	// requests for the dashboard may also carry a client token in this
+	// cookie or, to set the cookie, the "token" query parameter
+	tokenCookie     = "onimage_token"
+	dashboardPrefix = "/dashboard/"
+)
+
+// EndpointClient is a caller of the endpoint server that authenticates
+// with a bearer token and/or HMAC signed requests
+type EndpointClient struct {
+	Name   string
+	Token  string
+	Secret string
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is shared through the request context so that the logging
+// middleware can report the client set by the auth middleware
+type requestInfo struct {
+	client string
+}
+
+// endpointAuth authenticates requests against the configured clients; when
+// no clients are configured all requests are allowed. Bearer tokens are sent
+// as is with every request, so they are only safe over TLS; signed requests
+// don't reveal the secret, but without TLS their content is still visible
+type endpointAuth struct {
+	clients map[string]EndpointClient
+
+	// the signatures accepted within the allowed skew, by client, timestamp
+	// and signature, so that a captured request can't be replayed
+	seenLock sync.Mutex
+	seen     map[string]int64
+}
+
+func newEndpointAuth(config map[string]interface{}) (*endpointAuth, error) {
+	auth := &endpointAuth{clients: map[string]EndpointClient{}, seen: map[string]int64{}}
+	tables, err := util.GetTableSliceFromConfig(config, "endpoint.clients")
+	if err != nil {
+		switch err.(type) {
+		case *util.NoConfigSectionError, *util.NoConfigEntryError:
+			return auth, nil
+		}
+		return nil, err
+	}
+	for i, table := range tables {
+		client := EndpointClient{}
+		client.Name, _ = table["name"].(string)
+		client.Token, _ = table["token"].(string)
+		client.Secret, _ = table["secret"].(string)
+		if client.Name == "" {
+			return nil, fmt.Errorf("endpoint client %d has no name", i+1)
+		}
+		if client.Token == "" && client.Secret == "" {
+			return nil, fmt.Errorf("endpoint client %q needs a token or secret", client.Name)
+		}
+		if _, ok := auth.clients[client.Name]; ok {
+			return nil, fmt.Errorf("endpoint client %q is defined more than once", client.Name)
+		}
+		auth.clients[client.Name] = client
+	}
+	return auth, nil
+}
+
+func (a *endpointAuth) enabled() bool {
+	return len(a.clients) > 0
+}
+
+// authenticate returns the name of the client making the request; a signed
+// request's body is rejected if it is larger than maxBody
+func (a *endpointAuth) authenticate(r *http.Request, maxBody int64) (string, error) {
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		return a.checkToken(strings.TrimPrefix(authz, "Bearer "))
+	}
+	if sig := r.Header.Get(HeaderSignature); sig != "" {
+		return a.checkSignature(r, sig, maxBody)
+	}
+	// the token query parameter and cookie are only for the dashboard, so
+	// that a token leaked in a URL or cookie can't reach the other endpoints
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(r.URL.Path, dashboardPrefix) {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return a.checkToken(token)
+		}
+		if c, err := r.Cookie(tokenCookie); err == nil {
+			return a.checkToken(c.Value)
+		}
+	}
+	return "", fmt.Errorf("no credentials provided")
+}
+
+func (a *endpointAuth) checkToken(token string) (string, error) {
+	for _, c := range a.clients {
+		if c.Token != "" && subtle.ConstantTimeCompare([]byte(c.Token), []byte(token)) == 1 {
+			return c.Name, nil
+		}
+	}
+	return "", fmt.Errorf("invalid token")
+}
+
+func (a *endpointAuth) checkSignature(r *http.Request, sig string, maxBody int64) (string, error) {
+	name := r.Header.Get(HeaderClient)
+	client, ok := a.clients[name]
+	if !ok || client.Secret == "" {
+		return "", fmt.Errorf("unknown client %q", name)
+	}
+	ts := r.Header.Get(HeaderTimestamp)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q", ts)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return "", fmt.Errorf("timestamp outside of allowed skew")
+	}
+	bodyHash, err := spoolBody(r, maxBody)
+	if err != nil {
+		return "", err
+	}
+	sig = strings.ToLower(sig)
+	expected := SignRequest(client.Secret, r.Method, r.URL.RequestURI(), ts, bodyHash)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return "", fmt.Errorf("invalid signature for client %q", name)
+	}
+	if !a.firstUse(name+"\n"+ts+"\n"+sig, unix) {
+		return "", fmt.Errorf("replayed signature for client %q", name)
+	}
+	return name, nil
+}
+
+// firstUse records a signature and reports whether it hasn't been seen
+// before; signatures are forgotten once their timestamp is outside of the
+// allowed skew, as they are rejected for that anyway
+func (a *endpointAuth) firstUse(key string, unix int64) bool {
+	a.seenLock.Lock()
+	defer a.seenLock.Unlock()
+	oldest := time.Now().Add(-maxSignatureSkew).Unix()
+	for k, ts := range a.seen {
+		if ts < oldest {
+			delete(a.seen, k)
+		}
+	}
+	if _, ok := a.seen[key]; ok {
+		return false
+	}
+	a.seen[key] = unix
+	return true
+}
+
+// spoolBody copies the request body to a temporary file while hashing it
+// and replaces the body with the file, which is removed when the body is
+// closed; it returns the hex SHA-256 of the body, or an error if the body
+// is larger than maxBody
+func spoolBody(r *http.Request, maxBody int64) (string, error) {
+	h := sha256.New()
+	if r.Body == nil || r.Body == http.NoBody {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	f, err := os.CreateTemp("", "onimage-body-")
+	if err != nil {
+		return "", fmt.Errorf("unable to spool request body: %w", err)
+	}
+	body := &spooledBody{f}
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r.Body, maxBody+1))
+	if err == nil && n > maxBody {
+		err = fmt.Errorf("request body too large")
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return "", fmt.Errorf("unable to read request body: %w", err)
+	}
+	r.Body.Close()
+	r.Body = body
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// spooledBody is a request body read back from its spool file
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// SignRequest returns the signature expected in the X-Onimage-Signature
+// header for a request whose body has the hex SHA-256 bodyHash
+func SignRequest(secret, method, requestURI, timestamp, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, requestURI, timestamp, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BodyHash returns the hex SHA-256 of a request body to sign
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// require wraps a handler so that it is only called for authenticated
+// clients, accepting signed request bodies up to maxBody; the client name
+// is available from ClientName
+func (a *endpointAuth) require(next http.Handler, maxBody int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// a spooled request body is only removed once it is closed, whether
+		// or not the request is authenticated
+		defer func() {
+			if r.Body != nil {
+				r.Body.Close()
+			}
+		}()
+		name, err := a.authenticate(r, maxBody)
+		if err != nil {
+			logrus.Warnf("Rejected request from %s for %s: %v", r.RemoteAddr, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="onimage"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+		if !ok {
+			info = &requestInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		}
+		info.client = name
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientName returns the name of the authenticated client for a request,
+// or "-" if the request was not authenticated
+func ClientName(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok && info.client != "" {
+		return info.client
+	}
+	return "-"
+}
+
+// statusRecorder captures the response status for request logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests logs each request with the identity of the client once the
+// response has been written
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{}))
+		next.ServeHTTP(rec, r)
+		logrus.Infof("%s %s %s %d %s client=%s", r.RemoteAddr, r.Method, r.URL.Path, rec.status,
+			time.Since(start).Round(time.Millisecond), ClientName(r))
+	})
+}
+
+// certReloader serves the TLS certificate for the endpoint server and
+// reloads it whenever the certificate or key file changes on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create certificate watcher: %w", err)
+	}
+	// watch the directories rather than the files so that certificates
+	// replaced by rename (e.g. by certbot) are still noticed
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			return nil, fmt.Errorf("unable to watch %s: %w", dir, err)
+		}
+	}
+	go cr.watch(watcher)
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.lock.Unlock()
+	return nil
+}
+
+func (cr *certReloader) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case e := <-watcher.Events:
+			name := filepath.Clean(e.Name)
+			if name != filepath.Clean(cr.certFile) && name != filepath.Clean(cr.keyFile) {
+				continue
+			}
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			// the cert and key are usually replaced together; keep serving the
+			// old pair until both load successfully
+			if err := cr.reload(); err != nil {
+				logrus.Warnf("TLS certificate not reloaded: %v", err)
+				continue
+			}
+			logrus.Infof("Reloaded TLS certificate from %s", cr.certFile)
+		case err := <-watcher.Errors:
+			logrus.Errorf("certificate watcher error: %v", err)
+		}
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
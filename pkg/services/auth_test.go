@@ -0,0 +1,262 @@
+package services
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuth(t *testing.T) *endpointAuth {
+	t.Helper()
+	auth, err := newEndpointAuth(map[string]interface{}{
+		"endpoint": map[string]interface{}{
+			"clients": []interface{}{
+				map[string]interface{}{"name": "camera", "token": "camera-token"},
+				map[string]interface{}{"name": "ops", "secret": "ops-secret"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newEndpointAuth: %v", err)
+	}
+	return auth
+}
+
+func signedRequest(method, uri, body, client, secret string, ts time.Time) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	r.Header.Set(HeaderClient, client)
+	r.Header.Set(HeaderTimestamp, unix)
+	r.Header.Set(HeaderSignature, SignRequest(secret, method, uri, unix, BodyHash([]byte(body))))
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		client  string
+	}{
+		{
+			name: "bearer token",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/status", nil)
+				r.Header.Set("Authorization", "Bearer camera-token")
+				return r
+			},
+			client: "camera",
+		},
+		{
+			name: "wrong bearer token",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/status", nil)
+				r.Header.Set("Authorization", "Bearer ops-secret")
+				return r
+			},
+		},
+		{
+			name:    "no credentials",
+			request: func() *http.Request { return httptest.NewRequest("GET", "/status", nil) },
+		},
+		{
+			name: "signed",
+			request: func() *http.Request {
+				return signedRequest("POST", "/offline", `{"message":"x"}`, "ops", "ops-secret", now)
+			},
+			client: "ops",
+		},
+		{
+			name:    "signed without body",
+			request: func() *http.Request { return signedRequest("GET", "/status?x=1", "", "ops", "ops-secret", now) },
+			client:  "ops",
+		},
+		{
+			name:    "wrong secret",
+			request: func() *http.Request { return signedRequest("GET", "/status", "", "ops", "wrong", now) },
+		},
+		{
+			name:    "client without secret",
+			request: func() *http.Request { return signedRequest("GET", "/status", "", "camera", "", now) },
+		},
+		{
+			name:    "unknown client",
+			request: func() *http.Request { return signedRequest("GET", "/status", "", "nobody", "ops-secret", now) },
+		},
+		{
+			name: "expired timestamp",
+			request: func() *http.Request {
+				return signedRequest("GET", "/status", "", "ops", "ops-secret", now.Add(-maxSignatureSkew-time.Minute))
+			},
+		},
+		{
+			name: "future timestamp",
+			request: func() *http.Request {
+				return signedRequest("GET", "/status", "", "ops", "ops-secret", now.Add(maxSignatureSkew+time.Minute))
+			},
+		},
+		{
+			name: "modified body",
+			request: func() *http.Request {
+				r := signedRequest("POST", "/offline", `{"message":"x"}`, "ops", "ops-secret", now)
+				r.Body = io.NopCloser(strings.NewReader(`{"message":"y"}`))
+				return r
+			},
+		},
+		{
+			name: "modified uri",
+			request: func() *http.Request {
+				r := signedRequest("POST", "/offline", "", "ops", "ops-secret", now)
+				r.URL.Path = "/online"
+				return r
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := testAuth(t)
+			client, err := auth.authenticate(tt.request(), maxSignedBodyBytes)
+			if tt.client == "" {
+				if err == nil {
+					t.Errorf("authenticated as %q, expected an error", client)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if client != tt.client {
+				t.Errorf("client = %q, want %q", client, tt.client)
+			}
+		})
+	}
+}
+
+func TestCheckSignatureKeepsBody(t *testing.T) {
+	auth := testAuth(t)
+	r := signedRequest("POST", "/offline", `{"message":"x"}`, "ops", "ops-secret", time.Now())
+	if _, err := auth.checkSignature(r, r.Header.Get(HeaderSignature), maxSignedBodyBytes); err != nil {
+		t.Fatalf("checkSignature: %v", err)
+	}
+	defer r.Body.Close()
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"message":"x"}` {
+		t.Errorf("body = %q after checking the signature", data)
+	}
+}
+
+func TestCheckSignatureReplay(t *testing.T) {
+	auth := testAuth(t)
+	now := time.Now()
+	first := signedRequest("GET", "/status", "", "ops", "ops-secret", now)
+	if _, err := auth.authenticate(first, maxSignedBodyBytes); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := auth.authenticate(signedRequest("GET", "/status", "", "ops", "ops-secret", now), maxSignedBodyBytes); err == nil {
+		t.Error("replayed request was accepted")
+	}
+	if _, err := auth.authenticate(signedRequest("GET", "/phototimez", "", "ops", "ops-secret", now), maxSignedBodyBytes); err != nil {
+		t.Errorf("different request with the same timestamp: %v", err)
+	}
+}
+
+func TestAuthenticateDashboardToken(t *testing.T) {
+	tests := []struct {
+		method string
+		uri    string
+		cookie bool
+		client string
+	}{
+		{"GET", "/dashboard/?token=camera-token", false, "camera"},
+		{"GET", "/dashboard/api/summary", true, "camera"},
+		{"HEAD", "/dashboard/images/2023-06-01/1200/final.jpg", true, "camera"},
+		// the token is only accepted this way for the dashboard's pages
+		{"GET", "/status?token=camera-token", false, ""},
+		{"GET", "/status", true, ""},
+		{"GET", "/dashboardx/?token=camera-token", false, ""},
+		{"POST", "/dashboard/?token=camera-token", false, ""},
+		{"POST", "/offline", true, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.uri, nil)
+		if tt.cookie {
+			r.AddCookie(&http.Cookie{Name: tokenCookie, Value: "camera-token"})
+		}
+		client, err := testAuth(t).authenticate(r, maxSignedBodyBytes)
+		if tt.client == "" {
+			if err == nil {
+				t.Errorf("%s %s (cookie %v): authenticated as %q, expected an error", tt.method, tt.uri, tt.cookie, client)
+			}
+			continue
+		}
+		if err != nil || client != tt.client {
+			t.Errorf("%s %s (cookie %v): got %q, %v; want %q", tt.method, tt.uri, tt.cookie, client, err, tt.client)
+		}
+	}
+}
+
+func TestRequireSpooledBody(t *testing.T) {
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	auth := testAuth(t)
+	var got string
+	handler := auth.require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got = string(data)
+	}), 16)
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request *http.Request
+		status  int
+	}{
+		{"within the limit", signedRequest("POST", "/offline", `{"message":"x"}`, "ops", "ops-secret", now), http.StatusOK},
+		{"over the limit", signedRequest("POST", "/offline", `{"message":"too long"}`, "ops", "ops-secret", now), http.StatusUnauthorized},
+		{"wrong secret", signedRequest("POST", "/online", `{}`, "ops", "wrong", now), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		got = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tt.request)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && got != `{"message":"x"}` {
+			t.Errorf("%s: handler read %q", tt.name, got)
+		}
+		// the spooled body is removed whether or not the request is accepted
+		if entries, err := os.ReadDir(spool); err != nil || len(entries) != 0 {
+			t.Errorf("%s: %d spooled bodies left, %v", tt.name, len(entries), err)
+		}
+	}
+}
+
+func TestHandlePrivate(t *testing.T) {
+	open := &WebEndpoint{mux: http.NewServeMux(), auth: &endpointAuth{clients: map[string]EndpointClient{}}}
+	if err := open.HandlePrivate("/offline", http.NotFoundHandler(), maxSignedBodyBytes); err == nil {
+		t.Error("a private route was registered without clients")
+	}
+	if _, err := NewWebEndpoint(map[string]interface{}{
+		"endpoint": map[string]interface{}{"dashboard": true},
+	}, nil, nil, nil, nil); err == nil {
+		t.Error("the dashboard was enabled without clients")
+	}
+
+	we := &WebEndpoint{mux: http.NewServeMux(), auth: testAuth(t)}
+	if err := we.HandlePrivate("/offline", http.NotFoundHandler(), maxSignedBodyBytes); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	we.mux.ServeHTTP(w, httptest.NewRequest("POST", "/offline", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request got status %d", w.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+)
+
+// aviWriter writes a Motion-JPEG AVI file; every frame is stored as a
+// complete JPEG image so no codec is needed beyond image/jpeg
+type aviWriter struct {
+	f         *os.File
+	width     int
+	height    int
+	framerate int
+	quality   int
+	frames    int
+	moviStart int64
+	index     []aviIndexEntry
+}
+
+type aviIndexEntry struct {
+	offset uint32
+	size   uint32
+}
+
+const (
+	aviHeaderSize = 224
+	aviFlagKey    = 0x10
+	aviHasIndex   = 0x10
+)
+
+func newAVIWriter(file string, width, height, framerate, quality int) (*aviWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	w := &aviWriter{f: f, width: width, height: height, framerate: framerate, quality: quality}
+	// reserve space for the headers which are written on Close once the
+	// frame count and sizes are known
+	if _, err := f.Write(make([]byte, aviHeaderSize)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.moviStart = aviHeaderSize
+	return w, nil
+}
+
+func (w *aviWriter) AddFrame(img image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: w.quality}); err != nil {
+		return err
+	}
+	if buf.Len()%2 == 1 {
+		// RIFF chunks are word aligned
+		buf.WriteByte(0)
+	}
+	pos, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// index offsets are relative to the 'movi' fourcc
+	w.index = append(w.index, aviIndexEntry{offset: uint32(pos - (w.moviStart - 4)), size: uint32(buf.Len())})
+	if err := w.writeChunk("00dc", buf.Bytes()); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+func (w *aviWriter) Close() error {
+	defer w.f.Close()
+	moviEnd, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	idx := new(bytes.Buffer)
+	var maxSize uint32
+	for _, e := range w.index {
+		idx.WriteString("00dc")
+		binary.Write(idx, binary.LittleEndian, []uint32{aviFlagKey, e.offset, e.size})
+		if e.size > maxSize {
+			maxSize = e.size
+		}
+	}
+	if err := w.writeChunk("idx1", idx.Bytes()); err != nil {
+		return err
+	}
+	fileEnd, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	h := new(bytes.Buffer)
+	le := func(v ...interface{}) {
+		for _, x := range v {
+			binary.Write(h, binary.LittleEndian, x)
+		}
+	}
+	h.WriteString("RIFF")
+	le(uint32(fileEnd - 8))
+	h.WriteString("AVI LIST")
+	le(uint32(192))
+	h.WriteString("hdrlavih")
+	le(uint32(56), uint32(1000000/w.framerate), uint32(0), uint32(0), uint32(aviHasIndex),
+		uint32(w.frames), uint32(0), uint32(1), maxSize, uint32(w.width), uint32(w.height),
+		[4]uint32{})
+	h.WriteString("LIST")
+	le(uint32(116))
+	h.WriteString("strlstrh")
+	le(uint32(56))
+	h.WriteString("vidsMJPG")
+	le(uint32(0), uint16(0), uint16(0), uint32(0), uint32(1), uint32(w.framerate), uint32(0),
+		uint32(w.frames), maxSize, int32(-1), uint32(0), [4]uint16{0, 0, uint16(w.width), uint16(w.height)})
+	h.WriteString("strf")
+	le(uint32(40), uint32(40), int32(w.width), int32(w.height), uint16(1), uint16(24))
+	h.WriteString("MJPG")
+	le(uint32(w.width*w.height*3), int32(0), int32(0), uint32(0), uint32(0))
+	h.WriteString("LIST")
+	le(uint32(moviEnd - w.moviStart + 4))
+	h.WriteString("movi")
+
+	if _, err := w.f.WriteAt(h.Bytes(), 0); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+func (w *aviWriter) writeChunk(fourcc string, data []byte) error {
+	hdr := make([]byte, 8)
+	copy(hdr, fourcc)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	if _, err := w.f.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.f.Write(data)
+	return err
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAVIWriter(t *testing.T) {
+	const width, height, framerate, frames = 64, 48, 12, 3
+	file := path.Join(t.TempDir(), "timelapse.avi")
+	w, err := newAVIWriter(file, width, height, framerate, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for x := 0; x < width; x++ {
+			for y := 0; y < height; y++ {
+				img.Set(x, y, color.RGBA{uint8(x * i * 40), uint8(y * 5), uint8(i * 80), 255})
+			}
+		}
+		if err := w.AddFrame(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(data[off:]) }
+	fourcc := func(off int, want string) {
+		t.Helper()
+		if got := string(data[off : off+4]); got != want {
+			t.Fatalf("fourcc at %d is %q, want %q", off, got, want)
+		}
+	}
+	fourcc(0, "RIFF")
+	if got := u32(4); int(got) != len(data)-8 {
+		t.Errorf("RIFF size is %d, want %d", got, len(data)-8)
+	}
+	fourcc(8, "AVI ")
+
+	// the header list: the main AVI header then one video stream
+	fourcc(12, "LIST")
+	hdrlEnd := 20 + int(u32(16))
+	fourcc(20, "hdrl")
+	fourcc(24, "avih")
+	avih := 32
+	for _, f := range []struct {
+		name string
+		off  int
+		want uint32
+	}{
+		{"microseconds per frame", 0, 1000000 / framerate},
+		{"flags", 12, aviHasIndex},
+		{"total frames", 16, frames},
+		{"streams", 24, 1},
+		{"width", 32, width},
+		{"height", 36, height},
+	} {
+		if got := u32(avih + f.off); got != f.want {
+			t.Errorf("avih %s is %d, want %d", f.name, got, f.want)
+		}
+	}
+	fourcc(avih+56, "LIST")
+	strl := avih + 64
+	if strlEnd := strl + int(u32(avih+60)); strlEnd != hdrlEnd {
+		t.Errorf("stream list ends at %d, header list at %d", strlEnd, hdrlEnd)
+	}
+	fourcc(strl, "strl")
+	fourcc(strl+4, "strh")
+	strh := strl + 12
+	fourcc(strh, "vids")
+	fourcc(strh+4, "MJPG")
+	if scale, rate := u32(strh+20), u32(strh+24); scale != 1 || rate != framerate {
+		t.Errorf("strh rate is %d/%d, want %d/1", rate, scale, framerate)
+	}
+	if got := u32(strh + 32); got != frames {
+		t.Errorf("strh length is %d, want %d", got, frames)
+	}
+	fourcc(strh+56, "strf")
+	strf := strh + 64
+	if w, h := int32(u32(strf+4)), int32(u32(strf+8)); w != width || h != height {
+		t.Errorf("strf size is %dx%d, want %dx%d", w, h, width, height)
+	}
+	fourcc(strf+16, "MJPG")
+	if strf+40 != hdrlEnd {
+		t.Errorf("stream format ends at %d, header list at %d", strf+40, hdrlEnd)
+	}
+
+	// the frames, each a complete JPEG, then the index
+	fourcc(hdrlEnd, "LIST")
+	if hdrlEnd+12 != aviHeaderSize {
+		t.Errorf("frames start at %d, want %d", hdrlEnd+12, aviHeaderSize)
+	}
+	movi := hdrlEnd + 8
+	moviEnd := movi + int(u32(hdrlEnd+4))
+	fourcc(movi, "movi")
+	var offsets, sizes []uint32
+	for off := movi + 4; off < moviEnd; {
+		fourcc(off, "00dc")
+		size := int(u32(off + 4))
+		img, err := jpeg.Decode(bytes.NewReader(data[off+8 : off+8+size]))
+		if err != nil {
+			t.Fatalf("frame %d: %v", len(offsets)+1, err)
+		}
+		if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+			t.Errorf("frame %d is %dx%d", len(offsets)+1, b.Dx(), b.Dy())
+		}
+		if size%2 != 0 {
+			t.Errorf("frame %d has odd size %d", len(offsets)+1, size)
+		}
+		offsets = append(offsets, uint32(off-movi))
+		sizes = append(sizes, uint32(size))
+		off += 8 + size
+	}
+	if len(offsets) != frames {
+		t.Fatalf("%d frames, want %d", len(offsets), frames)
+	}
+
+	fourcc(moviEnd, "idx1")
+	if got := int(u32(moviEnd + 4)); got != frames*16 || moviEnd+8+got != len(data) {
+		t.Fatalf("index size is %d, want %d at the end of the file", got, frames*16)
+	}
+	for i := 0; i < frames; i++ {
+		e := moviEnd + 8 + i*16
+		fourcc(e, "00dc")
+		if flags := u32(e + 4); flags != aviFlagKey {
+			t.Errorf("index entry %d flags are %#x, want key frame", i+1, flags)
+		}
+		// offsets are relative to the 'movi' fourcc
+		if off, size := u32(e+8), u32(e+12); off != offsets[i] || size != sizes[i] {
+			t.Errorf("index entry %d is %d+%d, want %d+%d", i+1, off, size, offsets[i], sizes[i])
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	captureMetaFile = "capture.json"
+	stagingDir      = ".staging"
+	// the most captures committed within the same second
+	maxCaptureSuffix = 99
+)
+
+// CaptureMeta holds the data collected about a capture as it moves through
+// the processing pipeline; it is stored as capture.json in the capture
+// directory so that later steps (and later days) can reuse it
+type CaptureMeta struct {
+	Time     time.Time      `json:"time"`
+	Source   string         `json:"source,omitempty"`
+	Temp     *float32       `json:"temp,omitempty"`
+	TempUnit string         `json:"temp_unit,omitempty"`
+	Weather  *Weather       `json:"weather,omitempty"`
+	Exposure *ExposureStats `json:"exposure,omitempty"`
+	// EVShift is the EV shift the capture was taken with, when the source
+	// knows it; otherwise the recommended shift is assumed to have been used
+	EVShift *float64 `json:"ev_shift,omitempty"`
+}
+
+// steps in the pipeline update capture metadata from different goroutines
+var captureMetaLock sync.Mutex
+
+func loadCaptureMeta(dir string) (*CaptureMeta, error) {
+	meta := &CaptureMeta{}
+	data, err := os.ReadFile(path.Join(dir, captureMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			if t, err := captureTime(dir); err == nil {
+				meta.Time = t
+			}
+			return meta, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path.Join(dir, captureMetaFile), err)
+	}
+	return meta, nil
+}
+
+// updateCaptureMeta applies update to the stored metadata for a capture
+func updateCaptureMeta(dir string, update func(*CaptureMeta)) error {
+	captureMetaLock.Lock()
+	defer captureMetaLock.Unlock()
+
+	meta, err := loadCaptureMeta(dir)
+	if err != nil {
+		return err
+	}
+	update(meta)
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(dir, captureMetaFile), data, 0644)
+}
+
+// NewStagingDir creates an empty directory on the same filesystem as the
+// dated capture directories where a capture can be assembled before it is
+// committed with CommitCapture
+func (ip *ImageProcessor) NewStagingDir() (string, error) {
+	base := path.Join(ip.imagesBaseDir, stagingDir)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(base, "capture-")
+}
+
+// CommitCapture moves a fully written staging directory into the dated
+// directory layout as the capture described by meta and queues it for
+// processing; it returns the capture directory
+func (ip *ImageProcessor) CommitCapture(staging string, meta CaptureMeta) (string, error) {
+	t := meta.Time
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path.Join(staging, captureMetaFile), data, 0644); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path.Join(staging, "done.txt"), nil, 0644); err != nil {
+		return "", err
+	}
+	dayDir := path.Join(ip.imagesBaseDir, t.Format("2006-01-02"))
+	if err := os.MkdirAll(dayDir, 0755); err != nil {
+		return "", err
+	}
+	// a second capture within the same minute gets a HHMMSS directory, and
+	// any more within the same second HHMMSS-2, HHMMSS-3, ..., which all
+	// sort and parse the same as HHMM
+	dir, err := commitDir(staging, dayDir, t)
+	if err != nil {
+		return "", err
+	}
+	// the watcher may notice the new directory too if it is for today;
+	// Enqueue ignores whichever of the two arrives second
+	if ip.Enqueue(dir) {
+		logrus.Infof("Ready for processing: %s", dir)
+	}
+	return dir, nil
+}
+
+// commitDir renames staging to the first free capture directory for t in
+// dayDir and returns it
+func commitDir(staging, dayDir string, t time.Time) (string, error) {
+	var dir string
+	for i := 0; i <= maxCaptureSuffix; i++ {
+		switch i {
+		case 0:
+			dir = path.Join(dayDir, t.Format("1504"))
+		case 1:
+			dir = path.Join(dayDir, t.Format("150405"))
+		default:
+			dir = path.Join(dayDir, fmt.Sprintf("%s-%d", t.Format("150405"), i))
+		}
+		if _, err := os.Lstat(dir); err == nil {
+			continue
+		}
+		// the capture is never empty, so renaming it over a directory
+		// created in the meantime fails rather than replacing it
+		err := os.Rename(staging, dir)
+		if err == nil {
+			return dir, nil
+		}
+		if _, statErr := os.Lstat(dir); statErr != nil {
+			return "", fmt.Errorf("unable to commit capture %s: %w", dir, err)
+		}
+	}
+	return "", fmt.Errorf("unable to commit capture: too many captures at %s", dir)
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+)
+
+// EndpointConn makes authenticated requests to a running onimage endpoint
+// server using the same config file, e.g. for command line control of the
+// daemon
+type EndpointConn struct {
+	baseURL string
+	client  *EndpointClient
+	http    *http.Client
+}
+
+// NewEndpointConn connects to the endpoint server described by config as
+// the named client, or as the first configured client if name is empty
+func NewEndpointConn(config map[string]interface{}, name string, insecure bool) (*EndpointConn, error) {
+	address, _ := util.GetStringFromConfig(config, "endpoint.address")
+	if address == "" || address == "0.0.0.0" || address == "::" {
+		address = "localhost"
+	}
+	port, err := util.GetIntFromConfig(config, "endpoint.port")
+	if err != nil {
+		port = 5000
+	}
+	scheme := "http"
+	if cert, _ := util.GetStringFromConfig(config, "endpoint.tls_cert"); cert != "" {
+		scheme = "https"
+	}
+	auth, err := newEndpointAuth(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'endpoint.clients' config: %w", err)
+	}
+	conn := &EndpointConn{
+		baseURL: fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(address, strconv.Itoa(int(port)))),
+		http: &http.Client{
+			Timeout:   2 * time.Minute,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}},
+		},
+	}
+	if auth.enabled() {
+		if name == "" {
+			names := make([]string, 0, len(auth.clients))
+			for n := range auth.clients {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			name = names[0]
+		}
+		client, ok := auth.clients[name]
+		if !ok {
+			return nil, fmt.Errorf("no endpoint client named %q in config", name)
+		}
+		conn.client = &client
+	}
+	return conn, nil
+}
+
+// Do sends a request with an optional JSON body and decodes a JSON response
+// into out, if non-nil
+func (c *EndpointConn) Do(method, uri string, body, out interface{}) error {
+	var reader io.Reader
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+uri, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.client != nil {
+		if c.client.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.client.Token)
+		} else {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(HeaderClient, c.client.Name)
+			req.Header.Set(HeaderTimestamp, ts)
+			req.Header.Set(HeaderSignature, SignRequest(c.client.Secret, method, req.URL.RequestURI(), ts, BodyHash(data)))
+		}
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %s: %s", method, uri, resp.Status, bytes.TrimSpace(data))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
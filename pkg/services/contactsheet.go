@@ -0,0 +1,131 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+const (
+	contactSheetFile    = "contact-sheet.jpg"
+	contactSheetPadding = 4
+	contactLabelHeight  = 16
+)
+
+// ContactSheet renders a grid of labeled thumbnails of all of a day's
+// processed images at the end of the day
+type ContactSheet struct {
+	enabled    bool
+	columns    int
+	thumbWidth int
+	publisher  *Publisher
+	errChan    chan error
+}
+
+func NewContactSheetService(config map[string]interface{}, errChan chan error, publisher *Publisher) (*ContactSheet, error) {
+	enabled, err := util.GetBoolFromConfig(config, "contact_sheet.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &ContactSheet{}, nil
+	}
+	columns, err := util.GetIntFromConfig(config, "contact_sheet.columns")
+	if err != nil || columns <= 0 {
+		columns = 8
+	}
+	thumbWidth, err := util.GetIntFromConfig(config, "contact_sheet.thumb_width")
+	if err != nil || thumbWidth <= 0 {
+		thumbWidth = 240
+	}
+	return &ContactSheet{
+		enabled:    true,
+		columns:    int(columns),
+		thumbWidth: int(thumbWidth),
+		publisher:  publisher,
+		errChan:    errChan,
+	}, nil
+}
+
+// Generate builds the contact sheet for the captures in dayDir and publishes
+// it with the day's archive
+func (cs *ContactSheet) Generate(date, dayDir string) error {
+	if !cs.enabled {
+		return nil
+	}
+	captures, err := listCaptures(dayDir)
+	if err != nil {
+		return fmt.Errorf("unable to list captures in %s: %w", dayDir, err)
+	}
+	if len(captures) == 0 {
+		logrus.Infof("No captures for a contact sheet of %s", date)
+		return nil
+	}
+
+	var sheet *image.RGBA
+	var cellW, cellH, thumbH, placed int
+	for _, capDir := range captures {
+		img, err := loadJPEG(path.Join(capDir, "final.jpg"))
+		if err != nil {
+			logrus.Warnf("Skipping %s in contact sheet: %v", capDir, err)
+			continue
+		}
+		thumb := resizeImage(img, cs.thumbWidth, 0)
+		if sheet == nil {
+			// size the grid from the first thumbnail; captures all come from
+			// the same camera so they share an aspect ratio
+			thumbH = thumb.Bounds().Dy()
+			cellW = cs.thumbWidth + contactSheetPadding
+			cellH = thumbH + contactLabelHeight + contactSheetPadding
+			rows := (len(captures) + cs.columns - 1) / cs.columns
+			sheet = image.NewRGBA(image.Rect(0, 0, cellW*cs.columns+contactSheetPadding, cellH*rows+contactSheetPadding))
+			draw.Draw(sheet, sheet.Bounds(), image.Black, image.Point{}, draw.Src)
+		}
+		// skipped captures don't leave holes in the grid
+		x := contactSheetPadding + (placed%cs.columns)*cellW
+		y := contactSheetPadding + (placed/cs.columns)*cellH
+		draw.Draw(sheet, image.Rect(x, y, x+cs.thumbWidth, y+thumbH), thumb, image.Point{}, draw.Src)
+		drawLabel(sheet, x+2, y+thumbH+contactLabelHeight-4, captureLabel(capDir), color.White)
+		placed++
+	}
+	if sheet == nil {
+		return fmt.Errorf("no readable images in %s", dayDir)
+	}
+	// drop the rows left empty by skipped captures
+	rows := (placed + cs.columns - 1) / cs.columns
+	sheet = sheet.SubImage(image.Rect(0, 0, sheet.Bounds().Dx(), cellH*rows+contactSheetPadding)).(*image.RGBA)
+
+	output := path.Join(dayDir, contactSheetFile)
+	if err := saveJPEG(output, sheet, 85); err != nil {
+		return fmt.Errorf("unable to save contact sheet: %w", err)
+	}
+	logrus.Infof("Contact sheet for %s created from %d captures: %s", date, placed, output)
+	return cs.publisher.Publish(output, fmt.Sprintf("archive/%s/%s", date, contactSheetFile), PublishOptions{
+		ContentType:  "image/jpeg",
+		CacheControl: "public, max-age=31536000",
+	})
+}
+
+// captureLabel returns "HH:MM" and, if it was recorded, the temperature at
+// the time of a capture; the label font only has ASCII glyphs, so there is
+// no degree sign
+func captureLabel(capDir string) string {
+	meta, err := loadCaptureMeta(capDir)
+	if err != nil {
+		logrus.Warnf("unable to load capture metadata for %s: %v", capDir, err)
+		meta = &CaptureMeta{}
+	}
+	label := path.Base(capDir)
+	if !meta.Time.IsZero() {
+		label = meta.Time.Format("15:04")
+	}
+	if meta.Temp != nil {
+		label = fmt.Sprintf("%s  %.1f %s", label, *meta.Temp, meta.TempUnit)
+	}
+	return label
+}
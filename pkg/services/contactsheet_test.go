@@ -0,0 +1,101 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCaptureLabel(t *testing.T) {
+	dir := path.Join(t.TempDir(), "2023-06-01", "1230")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := captureLabel(dir); got != "12:30" {
+		t.Errorf("label without metadata is %q", got)
+	}
+	temp := float32(21.5)
+	if err := updateCaptureMeta(dir, func(m *CaptureMeta) {
+		m.Temp = &temp
+		m.TempUnit = "C"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := captureLabel(dir)
+	if got != "12:30  21.5 C" {
+		t.Errorf("label is %q", got)
+	}
+	// the label font only has ASCII glyphs
+	for _, r := range got {
+		if r > 0x7f {
+			t.Errorf("label %q has non-ASCII rune %q", got, r)
+		}
+	}
+}
+
+func TestContactSheetGrid(t *testing.T) {
+	fakeAWS(t)
+	cs, err := NewContactSheetService(map[string]interface{}{
+		"contact_sheet": map[string]interface{}{
+			"enabled":     true,
+			"columns":     int64(2),
+			"thumb_width": int64(40),
+		},
+	}, make(chan error, 10), newTestPublisher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dayDir := path.Join(t.TempDir(), "2023-06-01")
+	colors := map[string]color.Color{"1200": color.RGBA{255, 0, 0, 255}, "1220": color.RGBA{0, 255, 0, 255}}
+	for _, capture := range []string{"1200", "1210", "1220"} {
+		dir := path.Join(dayDir, capture)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		final := path.Join(dir, "final.jpg")
+		c, ok := colors[capture]
+		if !ok {
+			// an unreadable capture is skipped
+			if err := os.WriteFile(final, []byte("not a jpeg"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		img := image.NewRGBA(image.Rect(0, 0, 80, 60))
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		if err := saveJPEG(final, img, 95); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cs.Generate("2023-06-01", dayDir); err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := loadJPEG(path.Join(dayDir, contactSheetFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// thumbnails are 40x30; the two readable captures fill the first row
+	// and no empty row is left for the skipped one
+	cellW := 40 + contactSheetPadding
+	cellH := 30 + contactLabelHeight + contactSheetPadding
+	if b := sheet.Bounds(); b.Dx() != 2*cellW+contactSheetPadding || b.Dy() != cellH+contactSheetPadding {
+		t.Errorf("sheet is %dx%d", b.Dx(), b.Dy())
+	}
+	for i, want := range []string{"red", "green"} {
+		x, y := contactSheetPadding+i*cellW+20, contactSheetPadding+15
+		r, g, _, _ := sheet.At(x, y).RGBA()
+		got := "other"
+		switch {
+		case r > 0xc000 && g < 0x4000:
+			got = "red"
+		case g > 0xc000 && r < 0x4000:
+			got = "green"
+		}
+		if got != want {
+			t.Errorf("cell %d is %s, want %s", i, got, want)
+		}
+	}
+}
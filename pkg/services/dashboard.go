@@ -0,0 +1,156 @@
+package services
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const dashboardThumbWidth = 320
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var captureNameRegex = regexp.MustCompile(`^\d{4}(\d{2}(-\d+)?)?$`)
+
+// thumbnails are generated on first request; the lock keeps concurrent
+// requests for the same gallery from generating them twice
+var thumbLock sync.Mutex
+
+type dashboardCapture struct {
+	Name        string    `json:"name"`
+	Time        time.Time `json:"time"`
+	Image       string    `json:"image"`
+	Thumb       string    `json:"thumb"`
+	DarkPercent *float32  `json:"dark_percent,omitempty"`
+	Temp        *float32  `json:"temp,omitempty"`
+	TempUnit    string    `json:"temp_unit,omitempty"`
+}
+
+type dashboardSummary struct {
+	Date     string                 `json:"date"`
+	Now      time.Time              `json:"now"`
+	Sunrise  time.Time              `json:"sunrise"`
+	Sunset   time.Time              `json:"sunset"`
+	InWindow bool                   `json:"in_window"`
+	Exposure ExposureRecommendation `json:"exposure"`
+	Weather  *Weather               `json:"weather,omitempty"`
+	Status   statusz                `json:"status"`
+	Offline  *OfflineState          `json:"offline_state,omitempty"`
+	Captures []dashboardCapture     `json:"captures"`
+}
+
+// registerDashboard serves the operator dashboard, embedded in the binary,
+// at /dashboard/ along with the JSON summary and local capture images it
+// displays; NewWebEndpoint has already checked that clients are configured
+func (we *WebEndpoint) registerDashboard() {
+	static, _ := fs.Sub(dashboardFiles, "dashboard")
+	files := http.StripPrefix(dashboardPrefix, http.FileServer(http.FS(static)))
+	we.HandlePrivate(dashboardPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a token in the query string is exchanged for a cookie so that the
+		// page, its API calls and images are all authenticated
+		if token := r.URL.Query().Get("token"); token != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    token,
+				Path:     dashboardPrefix,
+				HttpOnly: true,
+				Secure:   we.certs != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			u := *r.URL
+			q := u.Query()
+			q.Del("token")
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}), maxSignedBodyBytes)
+	we.HandlePrivate("/dashboard/api/summary", http.HandlerFunc(we.dashboardSummaryHandler), maxSignedBodyBytes)
+	we.HandlePrivate("/dashboard/images/", http.HandlerFunc(we.dashboardImageHandler), maxSignedBodyBytes)
+}
+
+func (we *WebEndpoint) dashboardSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	weather, _ := we.weatherService.CachedWeather()
+	in, _ := we.todayService.captureWindow(now)
+	summary := dashboardSummary{
+		Date:     we.todayService.GetDate(),
+		Now:      now,
+		Sunrise:  time.Unix(we.todayService.GetSunrise(), 0),
+		Sunset:   time.Unix(we.todayService.GetSunset(), 0),
+		InWindow: in,
+		Exposure: we.todayService.RecommendExposure(now),
+		Weather:  weather,
+		Status:   we.status(),
+		Offline:  we.todayService.OfflineStatus(),
+		Captures: []dashboardCapture{},
+	}
+	dayDir := we.imageProcessor.ImageDir()
+	captures, err := listCaptures(dayDir)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("unable to list captures in %s: %v", dayDir, err)
+	}
+	for _, dir := range captures {
+		name := path.Base(dir)
+		imgBase := "images/" + url.PathEscape(summary.Date) + "/" + name + "/"
+		c := dashboardCapture{Name: name, Image: imgBase + "final.jpg", Thumb: imgBase + "thumb.jpg"}
+		if meta, err := loadCaptureMeta(dir); err == nil {
+			c.Time = meta.Time
+			c.Temp = meta.Temp
+			c.TempUnit = meta.TempUnit
+		}
+		if colors, err := loadColors(dir); err == nil {
+			c.DarkPercent = &colors.BlackPercent
+		}
+		summary.Captures = append(summary.Captures, c)
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// dashboardImageHandler serves /dashboard/images/<date>/<capture>/final.jpg
+// or thumb.jpg from the local images directory
+func (we *WebEndpoint) dashboardImageHandler(w http.ResponseWriter, r *http.Request) {
+	date, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/dashboard/images/"), "/")
+	capture, file, _ := strings.Cut(rest, "/")
+	if !dayDirRegex.MatchString(date) || !captureNameRegex.MatchString(capture) || (file != "final.jpg" && file != "thumb.jpg") {
+		http.NotFound(w, r)
+		return
+	}
+	dir := path.Join(we.imageProcessor.ImageBaseDir(), date, capture)
+	img := path.Join(dir, file)
+	if file == "thumb.jpg" {
+		if err := ensureThumbnail(dir); err != nil {
+			logrus.Errorf("unable to create thumbnail for %s: %v", dir, err)
+			http.NotFound(w, r)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, img)
+}
+
+// ensureThumbnail creates thumb.jpg in a capture directory if needed
+func ensureThumbnail(dir string) error {
+	thumbLock.Lock()
+	defer thumbLock.Unlock()
+	thumb := path.Join(dir, "thumb.jpg")
+	if _, err := os.Stat(thumb); err == nil {
+		return nil
+	}
+	img, err := loadJPEG(path.Join(dir, "final.jpg"))
+	if err != nil {
+		return err
+	}
+	return saveJPEG(thumb, resizeImage(img, dashboardThumbWidth, 0), 80)
+}
@@ -0,0 +1,158 @@
+// OnImage() operator dashboard; polls the summary API and renders it
+"use strict";
+
+const refreshSeconds = 30;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function text(id, value) {
+  $(id).textContent = value === undefined || value === null || value === "" ? "–" : value;
+}
+
+function clock(t) {
+  return new Date(t).toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+}
+
+function ago(t) {
+  const secs = Math.round((Date.now() - new Date(t)) / 1000);
+  if (secs < 90) return secs + "s ago";
+  if (secs < 5400) return Math.round(secs / 60) + "m ago";
+  return Math.round(secs / 3600) + "h ago";
+}
+
+function temp(c) {
+  return c.temp === undefined ? "" : c.temp.toFixed(1) + "°" + (c.temp_unit || "");
+}
+
+function renderSun(s) {
+  text("date", s.date);
+  text("sunrise", clock(s.sunrise));
+  text("sunset", clock(s.sunset));
+  text("in-window", s.in_window ? "yes" : "no");
+  const e = s.exposure;
+  text("exposure", `${e.phase}: ${e.frames} frames [${e.brackets.join(", ")}] EV ${e.ev_shift >= 0 ? "+" : ""}${e.ev_shift}`);
+  $("offline").classList.toggle("hidden", !s.offline_state);
+  if (s.offline_state) {
+    $("offline").title = s.offline_state.reason + ": " + (s.offline_state.message || "");
+  }
+}
+
+function renderWeather(s) {
+  const w = s.weather;
+  if (!w) return;
+  text("temp", `${w.main.temp.toFixed(1)}° (feels like ${w.main.feels_like.toFixed(1)}°), ${w.main.humidity}% humidity`);
+  text("conditions", (w.weather || []).map((d) => d.description).join(", "));
+  text("wind", `${w.wind.speed} at ${w.wind.deg}°`);
+  const age = s.status.weather_age_seconds;
+  text("weather-age", age === undefined ? "" : Math.round(age / 60) + "m ago");
+}
+
+function renderPipeline(st) {
+  text("watched", st.watched_dir + (st.watcher_active ? "" : " (inactive)"));
+  text("queue", st.queue_depth);
+  text("last-processed", st.last_processed ? `${st.last_capture} (${ago(st.last_processed)})` : "");
+  const p = st.last_publish;
+  text("last-publish", p ? `${p.error ? "failed: " + p.error : (p.keys || []).join(", ")} (${ago(p.time)})` : "");
+  const o = st.outbox;
+  if (!o) {
+    text("outbox", "disabled");
+  } else if (!o.entries) {
+    text("outbox", "empty");
+  } else {
+    text("outbox", `${o.entries} uploads, oldest queued ${ago(o.oldest)}, next retry ${clock(o.next_attempt)}: ${o.last_error}`);
+  }
+  const steps = Object.entries(st.step_seconds || {}).map(([k, v]) => `${k} ${v.toFixed(1)}s`);
+  text("steps", steps.join(", "));
+
+  const body = $("errors").tBodies[0];
+  body.replaceChildren();
+  for (const e of st.recent_errors || []) {
+    const row = body.insertRow();
+    row.insertCell().textContent = new Date(e.time).toLocaleString();
+    row.insertCell().textContent = e.error;
+  }
+  if (!body.rows.length) {
+    body.insertRow().insertCell().textContent = "none";
+  }
+}
+
+// renderCurve plots the dark percent of each capture over the day, with the
+// sunrise to sunset period shaded
+function renderCurve(s) {
+  const svg = $("dark-curve");
+  const ns = "http://www.w3.org/2000/svg";
+  svg.replaceChildren();
+  const day = new Date(s.date + "T00:00:00");
+  const x = (t) => ((new Date(t) - day) / 86400000) * 800;
+  const y = (p) => 160 - (p / 100) * 160;
+
+  const sun = document.createElementNS(ns, "rect");
+  sun.setAttribute("class", "sun");
+  sun.setAttribute("x", x(s.sunrise));
+  sun.setAttribute("width", x(s.sunset) - x(s.sunrise));
+  sun.setAttribute("y", 0);
+  sun.setAttribute("height", 160);
+  svg.appendChild(sun);
+
+  // photos stop being taken after sunset once 95% of the image is dark
+  const limit = document.createElementNS(ns, "line");
+  limit.setAttribute("x1", 0);
+  limit.setAttribute("x2", 800);
+  limit.setAttribute("y1", y(95));
+  limit.setAttribute("y2", y(95));
+  svg.appendChild(limit);
+
+  const points = s.captures
+    .filter((c) => c.dark_percent !== undefined)
+    .map((c) => `${x(c.time).toFixed(1)},${y(c.dark_percent).toFixed(1)}`);
+  const line = document.createElementNS(ns, "polyline");
+  line.setAttribute("points", points.join(" "));
+  svg.appendChild(line);
+}
+
+function renderGallery(s) {
+  const gallery = $("gallery");
+  gallery.replaceChildren();
+  for (const c of s.captures.slice().reverse()) {
+    const fig = document.createElement("figure");
+    const link = document.createElement("a");
+    link.href = c.image;
+    link.target = "_blank";
+    const img = document.createElement("img");
+    img.loading = "lazy";
+    img.src = c.thumb;
+    img.alt = c.name;
+    link.appendChild(img);
+    const caption = document.createElement("figcaption");
+    caption.textContent = `${clock(c.time)} ${temp(c)}` + (c.dark_percent !== undefined ? ` · ${c.dark_percent.toFixed(0)}% dark` : "");
+    fig.append(link, caption);
+    gallery.appendChild(fig);
+  }
+  const latest = s.captures[s.captures.length - 1];
+  if (latest) {
+    $("latest").src = latest.image;
+    $("latest-link").href = latest.image;
+    text("latest-caption", `${clock(latest.time)} ${temp(latest)}`);
+  }
+}
+
+async function refresh() {
+  try {
+    const resp = await fetch("api/summary", { credentials: "same-origin" });
+    if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+    const s = await resp.json();
+    renderSun(s);
+    renderWeather(s);
+    renderPipeline(s.status);
+    renderCurve(s);
+    renderGallery(s);
+    text("updated", "updated " + new Date().toLocaleTimeString());
+  } catch (err) {
+    text("updated", "update failed: " + err.message);
+  }
+}
+
+refresh();
+setInterval(refresh, refreshSeconds * 1000);
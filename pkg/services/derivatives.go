@@ -0,0 +1,248 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/estesp/onimage/pkg/util"
+)
+
+const (
+	minDerivativeQuality = 40
+	// immutableCache is the cache control of images published under keys
+	// that are never overwritten
+	immutableCache = "public, max-age=31536000, immutable"
+	// immutableHashLen is the number of hex digits of the content hash in an
+	// immutable key
+	immutableHashLen = 12
+)
+
+// Derivative is one published size of the latest image; a Width of zero is
+// the full size image
+type Derivative struct {
+	Name  string
+	Width int
+}
+
+// derivativeConfig describes the sizes of the latest image to publish and
+// the quality or byte size each should be encoded to. When immutable, each
+// image is published under its own key instead of overwriting latest.jpg
+type derivativeConfig struct {
+	sizes     []Derivative
+	quality   int
+	maxBytes  int
+	immutable bool
+}
+
+func getDerivativeConfig(config map[string]interface{}) (*derivativeConfig, error) {
+	dc := &derivativeConfig{quality: 85}
+	if immutable, err := util.GetBoolFromConfig(config, "derivatives.immutable"); err == nil {
+		dc.immutable = immutable
+	}
+	widths, err := util.GetIntSliceFromConfig(config, "derivatives.sizes")
+	if err != nil {
+		if _, ok := err.(*util.NoConfigSectionError); ok {
+			// without any derivatives config only the full size image is published
+			dc.sizes = []Derivative{{Name: "latest.jpg"}}
+			return dc, nil
+		}
+		if _, ok := err.(*util.NoConfigEntryError); !ok {
+			return nil, err
+		}
+		widths = []int64{0}
+	}
+	sort.Slice(widths, func(i, j int) bool {
+		// smallest first with the full size (0) last
+		if widths[i] == 0 || widths[j] == 0 {
+			return widths[j] == 0 && widths[i] != 0
+		}
+		return widths[i] < widths[j]
+	})
+	// latest.jpg is the site's public image URL, so the full size image is
+	// always published even when the sizes leave it out
+	if len(widths) == 0 || widths[len(widths)-1] != 0 {
+		widths = append(widths, 0)
+	}
+	for i, w := range widths {
+		if w < 0 {
+			return nil, fmt.Errorf("invalid derivative width %d", w)
+		}
+		if i > 0 && w == widths[i-1] {
+			continue
+		}
+		name := "latest.jpg"
+		if w > 0 {
+			name = fmt.Sprintf("latest-%d.jpg", w)
+		}
+		dc.sizes = append(dc.sizes, Derivative{Name: name, Width: int(w)})
+	}
+	if q, err := util.GetIntFromConfig(config, "derivatives.quality"); err == nil {
+		if q < minDerivativeQuality || q > 100 {
+			return nil, fmt.Errorf("invalid 'derivatives.quality' %d; must be between %d and 100", q, minDerivativeQuality)
+		}
+		dc.quality = int(q)
+	}
+	if kb, err := util.GetIntFromConfig(config, "derivatives.max_kb"); err == nil && kb > 0 {
+		dc.maxBytes = int(kb) * 1024
+	}
+	return dc, nil
+}
+
+// key returns the bucket key a derivative of the capture in dir, written to
+// file, is published to: its name, or with immutable keys one made from the
+// capture's date and time and a hash of the content, e.g.
+// "images/2021-06-01/1230-640-3f2a9c1b7d4e.jpg". The hash gives reprocessed
+// images a new key, so a cached copy of the old content is never served
+// under it
+func (dc *derivativeConfig) key(dir string, d Derivative, file string) (string, error) {
+	if !dc.immutable {
+		return d.Name, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])[:immutableHashLen]
+	capture := path.Join(path.Base(path.Dir(dir)), path.Base(dir))
+	if d.Width == 0 {
+		return fmt.Sprintf("images/%s-%s.jpg", capture, hash), nil
+	}
+	return fmt.Sprintf("images/%s-%d-%s.jpg", capture, d.Width, hash), nil
+}
+
+// reencodeFull reports whether the full size image needs to be re-encoded
+// rather than published as is
+func (dc *derivativeConfig) reencodeFull(finalImg string) bool {
+	if dc.maxBytes == 0 {
+		return false
+	}
+	info, err := os.Stat(finalImg)
+	return err == nil && info.Size() > int64(dc.maxBytes)
+}
+
+// generate writes each configured derivative of the final image in dir and
+// returns the local file for each one along with the full image width
+func (dc *derivativeConfig) generate(dir string) (map[string]string, int, error) {
+	finalImg := path.Join(dir, "final.jpg")
+	files := map[string]string{}
+
+	needDecode := dc.reencodeFull(finalImg)
+	for _, d := range dc.sizes {
+		if d.Width > 0 {
+			needDecode = true
+		}
+	}
+	if !needDecode {
+		cfg, err := decodeJPEGConfig(finalImg)
+		if err != nil {
+			return nil, 0, err
+		}
+		files[dc.sizes[0].Name] = finalImg
+		return files, cfg.Width, nil
+	}
+
+	img, err := loadJPEG(finalImg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to load %s: %w", finalImg, err)
+	}
+	fullWidth := img.Bounds().Dx()
+	for _, d := range dc.sizes {
+		if d.Width == 0 && !dc.reencodeFull(finalImg) {
+			files[d.Name] = finalImg
+			continue
+		}
+		var src image.Image = img
+		if d.Width > 0 && d.Width < fullWidth {
+			src = resizeImage(img, d.Width, 0)
+		}
+		data, err := dc.encode(src)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to encode %s: %w", d.Name, err)
+		}
+		file := path.Join(dir, fmt.Sprintf("final-%d.jpg", d.Width))
+		if d.Width == 0 {
+			file = path.Join(dir, "final-full.jpg")
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return nil, 0, err
+		}
+		files[d.Name] = file
+	}
+	return files, fullWidth, nil
+}
+
+// encode encodes img at the configured quality, stepping the quality down
+// until the result fits under the maximum byte size
+func (dc *derivativeConfig) encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	for q := dc.quality; ; q -= 5 {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		if dc.maxBytes == 0 || buf.Len() <= dc.maxBytes || q-5 < minDerivativeQuality {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// srcset returns an HTML srcset attribute value for the sized derivatives.
+// Sizes at least as wide as the full image aren't resized, so they are
+// left out in favor of the full size image
+func srcset(sizes []Derivative, fullWidth int) string {
+	var entries []string
+	for _, d := range sizes {
+		w := d.Width
+		if w == 0 {
+			w = fullWidth
+		} else if fullWidth > 0 && w >= fullWidth {
+			continue
+		}
+		if w > 0 {
+			entries = append(entries, fmt.Sprintf("%s %dw", d.Name, w))
+		}
+	}
+	return strings.Join(entries, ", ")
+}
+
+// latestImageWidth returns the width of the most recently processed image
+// under the images directory, or 0 if there is none
+func latestImageWidth(baseDir string) int {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return 0
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].IsDir() || !dayDirRegex.MatchString(entries[i].Name()) {
+			continue
+		}
+		captures, err := listCaptures(path.Join(baseDir, entries[i].Name()))
+		if err != nil || len(captures) == 0 {
+			continue
+		}
+		cfg, err := decodeJPEGConfig(path.Join(captures[len(captures)-1], "final.jpg"))
+		if err != nil {
+			return 0
+		}
+		return cfg.Width
+	}
+	return 0
+}
+
+func decodeJPEGConfig(file string) (image.Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	return jpeg.DecodeConfig(f)
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGetDerivativeConfigSizes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   []Derivative
+	}{
+		{
+			name:   "no section",
+			config: map[string]interface{}{},
+			want:   []Derivative{{Name: "latest.jpg"}},
+		},
+		{
+			name:   "no sizes",
+			config: map[string]interface{}{"derivatives": map[string]interface{}{"quality": int64(80)}},
+			want:   []Derivative{{Name: "latest.jpg"}},
+		},
+		{
+			name:   "sorted with full size last",
+			config: map[string]interface{}{"derivatives": map[string]interface{}{"sizes": []interface{}{int64(0), int64(1280), int64(640)}}},
+			want:   []Derivative{{Name: "latest-640.jpg", Width: 640}, {Name: "latest-1280.jpg", Width: 1280}, {Name: "latest.jpg"}},
+		},
+		{
+			name:   "full size added",
+			config: map[string]interface{}{"derivatives": map[string]interface{}{"sizes": []interface{}{int64(640)}}},
+			want:   []Derivative{{Name: "latest-640.jpg", Width: 640}, {Name: "latest.jpg"}},
+		},
+		{
+			name:   "duplicates removed",
+			config: map[string]interface{}{"derivatives": map[string]interface{}{"sizes": []interface{}{int64(640), int64(640), int64(0), int64(0)}}},
+			want:   []Derivative{{Name: "latest-640.jpg", Width: 640}, {Name: "latest.jpg"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc, err := getDerivativeConfig(tt.config)
+			if err != nil {
+				t.Fatalf("getDerivativeConfig: %v", err)
+			}
+			if !reflect.DeepEqual(dc.sizes, tt.want) {
+				t.Errorf("sizes = %v, want %v", dc.sizes, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDerivativeConfigInvalid(t *testing.T) {
+	for name, derivatives := range map[string]map[string]interface{}{
+		"negative width": {"sizes": []interface{}{int64(-1)}},
+		"low quality":    {"quality": int64(10)},
+		"high quality":   {"quality": int64(101)},
+	} {
+		if _, err := getDerivativeConfig(map[string]interface{}{"derivatives": derivatives}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	sizes := []Derivative{{Name: "latest-640.jpg", Width: 640}, {Name: "latest-4096.jpg", Width: 4096}, {Name: "latest.jpg"}}
+	tests := []struct {
+		fullWidth int
+		want      string
+	}{
+		{4056, "latest-640.jpg 640w, latest.jpg 4056w"},
+		{8000, "latest-640.jpg 640w, latest-4096.jpg 4096w, latest.jpg 8000w"},
+		{640, "latest.jpg 640w"},
+		// the full width isn't known yet
+		{0, "latest-640.jpg 640w, latest-4096.jpg 4096w"},
+	}
+	for _, tt := range tests {
+		if got := srcset(sizes, tt.fullWidth); got != tt.want {
+			t.Errorf("srcset(%d) = %q, want %q", tt.fullWidth, got, tt.want)
+		}
+	}
+}
+
+func TestDerivativeKey(t *testing.T) {
+	dir := path.Join(t.TempDir(), "2021-06-01", "1230")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) string {
+		file := path.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	full := write("final.jpg", "full size image")
+	small := write("final-640.jpg", "resized image")
+	fullSize := Derivative{Name: "latest.jpg"}
+	smallSize := Derivative{Name: "latest-640.jpg", Width: 640}
+
+	mutable := &derivativeConfig{}
+	for _, d := range []Derivative{fullSize, smallSize} {
+		if key, err := mutable.key(dir, d, full); err != nil || key != d.Name {
+			t.Errorf("mutable key of %s = %q, %v", d.Name, key, err)
+		}
+	}
+
+	immutable := &derivativeConfig{immutable: true}
+	keyRegex := regexp.MustCompile(`^images/2021-06-01/1230(-640)?-[0-9a-f]{12}\.jpg$`)
+	fullKey, err := immutable.key(dir, fullSize, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallKey, err := immutable.key(dir, smallSize, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{fullKey, smallKey} {
+		if !keyRegex.MatchString(key) {
+			t.Errorf("unexpected immutable key %q", key)
+		}
+	}
+	if !strings.Contains(smallKey, "-640-") || strings.Contains(fullKey, "-640-") {
+		t.Errorf("keys %q and %q don't match their widths", fullKey, smallKey)
+	}
+	if again, _ := immutable.key(dir, fullSize, full); again != fullKey {
+		t.Errorf("key of unchanged content changed from %q to %q", fullKey, again)
+	}
+	// a reprocessed image gets a new key
+	write("final.jpg", "reprocessed image")
+	if changed, _ := immutable.key(dir, fullSize, full); changed == fullKey {
+		t.Errorf("key of changed content is still %q", changed)
+	}
+	if _, err := immutable.key(dir, fullSize, path.Join(dir, "missing.jpg")); err == nil {
+		t.Errorf("key of a missing file didn't fail")
+	}
+}
+
+func TestLatestKeysFile(t *testing.T) {
+	file := path.Join(t.TempDir(), latestKeysFile)
+	if keys, err := loadLatestKeys(file); err != nil || keys != nil {
+		t.Fatalf("loading a missing file = %v, %v", keys, err)
+	}
+	want := map[string]string{"latest.jpg": "images/2021-06-01/1230-3f2a9c1b7d4e.jpg"}
+	if err := saveLatestKeys(file, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	keys, err := loadLatestKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("loaded keys %v, want %v", keys, want)
+	}
+}
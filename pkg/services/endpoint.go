@@ -1,10 +1,17 @@
 package services
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,43 +22,152 @@ type suntimez struct {
 	NowUnix    int64  `json:"now_unix"`
 	SunriseStr string `json:"sunrise_str"`
 	SunsetStr  string `json:"sunset_str"`
+	// Exposure suggests the bracket for the next capture based on the
+	// last image and the time of day
+	Exposure ExposureRecommendation `json:"exposure"`
+}
+
+type statusz struct {
+	ProcessorStatus
+	WeatherAgeSeconds *float64     `json:"weather_age_seconds,omitempty"`
+	DarkPercent       float32      `json:"dark_percent"`
+	Offline           bool         `json:"offline"`
+	RecentErrors      []ErrorEntry `json:"recent_errors"`
+}
+
+type readyz struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
 }
 
 type WebEndpoint struct {
-	todayService *Today
+	listenAddr     string
+	mux            *http.ServeMux
+	dashboard      bool
+	certs          *certReloader
+	auth           *endpointAuth
+	todayService   *Today
+	weatherService *WeatherData
+	imageProcessor *ImageProcessor
+	errorLog       *ErrorLog
 }
 
-func NewWebEndpoint(tService *Today) *WebEndpoint {
+func NewWebEndpoint(config map[string]interface{}, tService *Today, wService *WeatherData, imageProcessor *ImageProcessor, errorLog *ErrorLog) (*WebEndpoint, error) {
+	// the [endpoint] section is optional; the defaults match the original
+	// plain HTTP listener on port 5000
+	address, _ := util.GetStringFromConfig(config, "endpoint.address")
+	port, err := util.GetIntFromConfig(config, "endpoint.port")
+	if err != nil {
+		port = 5000
+	}
+	var certs *certReloader
+	certFile, _ := util.GetStringFromConfig(config, "endpoint.tls_cert")
+	keyFile, _ := util.GetStringFromConfig(config, "endpoint.tls_key")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both 'endpoint.tls_cert' and 'endpoint.tls_key' must be set to enable TLS")
+		}
+		certs, err = newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dashboard, _ := util.GetBoolFromConfig(config, "endpoint.dashboard")
+	auth, err := newEndpointAuth(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'endpoint.clients' config: %w", err)
+	}
+	if dashboard && !auth.enabled() {
+		return nil, fmt.Errorf("'endpoint.dashboard' requires at least one [[endpoint.clients]]")
+	}
 	return &WebEndpoint{
-		todayService: tService,
+		listenAddr:     net.JoinHostPort(address, strconv.Itoa(int(port))),
+		mux:            http.NewServeMux(),
+		dashboard:      dashboard,
+		certs:          certs,
+		auth:           auth,
+		todayService:   tService,
+		weatherService: wService,
+		imageProcessor: imageProcessor,
+		errorLog:       errorLog,
+	}, nil
+}
+
+// Handle registers an additional handler on the endpoint server; like all
+// endpoints other than /healthz it requires an authenticated client when
+// clients are configured
+func (we *WebEndpoint) Handle(pattern string, handler http.Handler) {
+	we.mux.Handle(pattern, we.auth.require(handler, maxSignedBodyBytes))
+}
+
+// HandlePrivate registers a handler that changes the pipeline's state or
+// serves private data, accepting signed request bodies up to maxBody; as
+// it must never be open to anyone, it is refused unless clients are
+// configured
+func (we *WebEndpoint) HandlePrivate(pattern string, handler http.Handler, maxBody int64) error {
+	if !we.auth.enabled() {
+		return fmt.Errorf("%s requires at least one [[endpoint.clients]]", pattern)
 	}
+	we.mux.Handle(pattern, we.auth.require(handler, maxBody))
+	return nil
+}
+
+// HandlePublic registers a handler that is served without authentication,
+// for endpoints meant to be used directly by the public web page
+func (we *WebEndpoint) HandlePublic(pattern string, handler http.Handler) {
+	we.mux.Handle(pattern, handler)
 }
 
 func (we *WebEndpoint) StartWebHandler() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/phototimez", we.handler)
-	go we.listenerRoutine(mux)
+	// liveness is left open so that simple health checkers don't need
+	// credentials; everything else requires an authenticated client when
+	// clients are configured, and offline mode can only be switched over
+	// HTTP by one
+	we.mux.HandleFunc("/healthz", we.healthHandler)
+	we.Handle("/phototimez", http.HandlerFunc(we.handler))
+	we.Handle("/readyz", http.HandlerFunc(we.readyHandler))
+	we.Handle("/status", http.HandlerFunc(we.statusHandler))
+	we.Handle("/metrics", promhttp.Handler())
+	for pattern, handler := range map[string]http.HandlerFunc{
+		"/offline": we.offlineHandler,
+		"/online":  we.onlineHandler,
+	} {
+		if err := we.HandlePrivate(pattern, handler, maxSignedBodyBytes); err != nil {
+			logrus.Warnf("Not serving %s: %v", pattern, err)
+		}
+	}
+	if we.dashboard {
+		we.registerDashboard()
+	}
+	go we.listenerRoutine(logRequests(we.mux))
 }
 
-func (we *WebEndpoint) listenerRoutine(mux *http.ServeMux) {
-	if err := http.ListenAndServe(":5000", mux); err != nil {
+func (we *WebEndpoint) listenerRoutine(handler http.Handler) {
+	server := &http.Server{
+		Addr:    we.listenAddr,
+		Handler: handler,
+	}
+	var err error
+	if we.certs != nil {
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: we.certs.getCertificate,
+		}
+		logrus.Infof("Endpoint listening on %s (TLS)", we.listenAddr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logrus.Infof("Endpoint listening on %s", we.listenAddr)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		logrus.Errorf("endpoint listener failed: %v", err)
 	}
 }
 
 func (we *WebEndpoint) handler(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
-	sunrisePre := we.todayService.GetSunrise() - 1800
-	sunsetPost := we.todayService.GetSunset() + 1800
 	resp := 0
-	if now.Unix() >= sunrisePre && now.Unix() <= sunsetPost {
-		resp = 1
-	}
-	// since sometimes the light lingers longer than 30 min after sunset
-	// use the color profile of the last photo to extend photo hours as
-	// necessary
-	if now.Unix() > sunsetPost && we.todayService.GetDarkPercent() < 95.0 {
-		logrus.Infof("Extending photo hours; still some light (%f) at %v", we.todayService.GetDarkPercent(), now)
+	if we.todayService.InCaptureWindow(now) {
 		resp = 1
 	}
 	riseTime := time.Unix(we.todayService.GetSunrise(), 0)
@@ -63,6 +179,7 @@ func (we *WebEndpoint) handler(w http.ResponseWriter, r *http.Request) {
 		NowUnix:    now.Unix(),
 		SunriseStr: riseTime.String(),
 		SunsetStr:  setTime.String(),
+		Exposure:   we.todayService.RecommendExposure(now),
 	}
 	b, err := json.Marshal(sresp)
 	if err != nil {
@@ -70,3 +187,130 @@ func (we *WebEndpoint) handler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(b)
 }
+
+// healthHandler reports liveness; if the process can answer, it is alive
+func (we *WebEndpoint) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyHandler reports whether the weather service is reachable, the
+// directory watcher is active and today's capture directory exists
+func (we *WebEndpoint) readyHandler(w http.ResponseWriter, r *http.Request) {
+	resp := readyz{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Ready = false
+			resp.Checks[name] = err.Error()
+			return
+		}
+		resp.Checks[name] = "ok"
+	}
+
+	// only call out to the weather API if the cached observation is stale,
+	// and at most once per interval however often the probe runs
+	check("weather", we.weatherService.check(10*time.Minute))
+
+	var watcherErr error
+	if !we.imageProcessor.WatcherActive() {
+		watcherErr = fmt.Errorf("no directory is being watched")
+	}
+	check("watcher", watcherErr)
+
+	var dirErr error
+	if fi, err := os.Stat(we.imageProcessor.ImageDir()); err != nil {
+		dirErr = err
+	} else if !fi.IsDir() {
+		dirErr = fmt.Errorf("%s is not a directory", we.imageProcessor.ImageDir())
+	}
+	check("today_dir", dirErr)
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+func (we *WebEndpoint) statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, we.status())
+}
+
+func (we *WebEndpoint) status() statusz {
+	resp := statusz{
+		ProcessorStatus: we.imageProcessor.Status(),
+		DarkPercent:     we.todayService.GetDarkPercent(),
+		Offline:         we.todayService.IsOffline(),
+		RecentErrors:    we.errorLog.Recent(),
+	}
+	if _, fetched := we.weatherService.CachedWeather(); !fetched.IsZero() {
+		age := time.Since(fetched).Seconds()
+		resp.WeatherAgeSeconds = &age
+	}
+	return resp
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("can't marshal JSON response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// OfflineRequest is the optional body of a POST to /offline
+type OfflineRequest struct {
+	Message string     `json:"message,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// OfflineResponse reports the offline state from /offline and /online
+type OfflineResponse struct {
+	Offline bool          `json:"offline"`
+	State   *OfflineState `json:"state,omitempty"`
+}
+
+// offlineHandler reports the offline state (GET) or takes the webcam
+// offline (POST)
+func (we *WebEndpoint) offlineHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		req := OfflineRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		logrus.Infof("Offline mode requested by %s", ClientName(r))
+		if err := we.todayService.SetOffline(OfflineManual, req.Message, req.Until); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state := we.todayService.OfflineStatus()
+	writeJSON(w, http.StatusOK, OfflineResponse{Offline: state != nil, State: state})
+}
+
+// onlineHandler returns the webcam to online mode (POST)
+func (we *WebEndpoint) onlineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logrus.Infof("Online mode requested by %s", ClientName(r))
+	if err := we.todayService.SetOnline(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, OfflineResponse{Offline: false})
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mean luma a well exposed frame is expected to have
+	targetLuminance = 118.0
+	// the EV shift is split between shutter and gain; shutter takes up to
+	// this many stops before gain is raised, and gain is capped
+	maxShutterStops = 2.0
+	maxGain         = 8.0
+	maxEVShift      = 4.0
+	twilightWindow  = 45 * time.Minute
+)
+
+// ExposureStats summarizes the luminance histogram of a capture's metered
+// frame
+type ExposureStats struct {
+	Mean   float64 `json:"mean"`
+	Median int     `json:"median"`
+	// fraction of pixels crushed to near black and clipped to near white
+	Shadows    float64 `json:"shadows"`
+	Highlights float64 `json:"highlights"`
+}
+
+// ExposureRecommendation is returned by /phototimez so that the capture
+// script can adapt its bracket as the light changes. EVShift is relative to
+// the camera's metered exposure; ShutterScale and Gain split it into a
+// multiplier for the base shutter time and an analog gain
+type ExposureRecommendation struct {
+	Phase        string    `json:"phase"`
+	Frames       int       `json:"frames"`
+	Brackets     []float64 `json:"brackets"`
+	EVShift      float64   `json:"ev_shift"`
+	ShutterScale float64   `json:"shutter_scale"`
+	Gain         float64   `json:"gain"`
+}
+
+// exposureStats builds a luminance histogram of img on a coarse grid
+func exposureStats(img image.Image) ExposureStats {
+	var hist [256]int
+	b := img.Bounds()
+	step := b.Dx() / 200
+	if step < 1 {
+		step = 1
+	}
+	var sum float64
+	var n int
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			l := luminance(img.At(x, y))
+			hist[int(math.Min(l, 255))]++
+			sum += l
+			n++
+		}
+	}
+	stats := ExposureStats{}
+	if n == 0 {
+		return stats
+	}
+	stats.Mean = sum / float64(n)
+	var seen, shadows, highlights int
+	stats.Median = -1
+	for v, count := range hist {
+		seen += count
+		if stats.Median < 0 && seen*2 >= n {
+			stats.Median = v
+		}
+		if v < 16 {
+			shadows += count
+		} else if v > 240 {
+			highlights += count
+		}
+	}
+	stats.Shadows = float64(shadows) / float64(n)
+	stats.Highlights = float64(highlights) / float64(n)
+	return stats
+}
+
+// meteringFrame returns the frame whose exposure best represents what the
+// camera metered: the middle frame of the bracket, or the fused image if
+// the frames are gone
+func meteringFrame(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var frames []string
+	for _, e := range entries {
+		if frameRegex.MatchString(e.Name()) {
+			frames = append(frames, e.Name())
+		}
+	}
+	if len(frames) == 0 {
+		return path.Join(dir, "prefinal.jpg"), nil
+	}
+	sort.Strings(frames)
+	return path.Join(dir, frames[len(frames)/2]), nil
+}
+
+func (ip *ImageProcessor) assessExposure(dir string) {
+	frame, err := meteringFrame(dir)
+	if err != nil {
+		logrus.Errorf("Error finding metering frame in %s: %v", dir, err)
+		return
+	}
+	img, err := loadJPEG(frame)
+	if err != nil {
+		logrus.Errorf("Error loading metering frame %s: %v", frame, err)
+		return
+	}
+	stats := exposureStats(img)
+	used := ip.todayService.EVShift()
+	if err := updateCaptureMeta(dir, func(m *CaptureMeta) {
+		m.Exposure = &stats
+		if m.EVShift != nil {
+			used = *m.EVShift
+		}
+	}); err != nil {
+		logrus.Errorf("Error writing capture metadata for %s: %v", dir, err)
+	}
+	ip.todayService.SetExposure(stats, used)
+}
+
+// exposureCorrection returns the change in EV needed to bring the metered
+// frame to the target luminance; small errors are ignored and large ones
+// damped so that the recommendation doesn't oscillate between captures.
+// It is relative to the shift the frame was taken with
+func exposureCorrection(stats ExposureStats) float64 {
+	ev := math.Log2(targetLuminance / math.Max(stats.Mean, 1))
+	if math.Abs(ev) < 0.5 {
+		return 0
+	}
+	return roundHalf(ev * 0.75)
+}
+
+// recommendExposure suggests a bracket for a capture at now given the
+// current EV shift and the most recent exposure statistics, if any
+func recommendExposure(now time.Time, sunrise, sunset int64, darkPercent float32, evShift float64, stats *ExposureStats) ExposureRecommendation {
+	rise, set := time.Unix(sunrise, 0), time.Unix(sunset, 0)
+	phase := "day"
+	switch {
+	case now.Before(rise.Add(-30*time.Minute)) || (now.After(set.Add(30*time.Minute)) && darkPercent >= 95):
+		phase = "night"
+	case now.Sub(rise) < twilightWindow:
+		phase = "dawn"
+	case set.Sub(now) < twilightWindow:
+		phase = "dusk"
+	}
+
+	frames, step := 5, 1.0
+	center := 0.0
+	switch phase {
+	case "day":
+		// a scene without clipping at either end needs a narrower bracket
+		if stats != nil && stats.Shadows < 0.1 && stats.Highlights < 0.02 {
+			frames = 3
+		}
+	case "dawn", "dusk":
+		if darkPercent > 50 {
+			step = 1.5
+		}
+	case "night":
+		frames, step = 7, 1.5
+	}
+	if stats != nil {
+		// skew the bracket away from whichever end is clipping
+		if stats.Highlights > 0.05 {
+			center -= 0.5
+		} else if stats.Shadows > 0.3 {
+			center += 0.5
+		}
+	}
+	brackets := make([]float64, 0, frames)
+	for i := -(frames / 2); i <= frames/2; i++ {
+		brackets = append(brackets, center+float64(i)*step)
+	}
+
+	shutterStops := math.Min(evShift, maxShutterStops)
+	gain := math.Min(math.Pow(2, evShift-shutterStops), maxGain)
+	return ExposureRecommendation{
+		Phase:        phase,
+		Frames:       frames,
+		Brackets:     brackets,
+		EVShift:      evShift,
+		ShutterScale: roundTo(math.Pow(2, shutterStops), 100),
+		Gain:         roundTo(gain, 100),
+	}
+}
+
+func roundHalf(v float64) float64 {
+	return math.Round(v*2) / 2
+}
+
+func roundTo(v float64, scale float64) float64 {
+	return math.Round(v*scale) / scale
+}
+
+func (s ExposureStats) String() string {
+	return fmt.Sprintf("mean %.1f, median %d, shadows %.1f%%, highlights %.1f%%", s.Mean, s.Median, s.Shadows*100, s.Highlights*100)
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExposureCorrection(t *testing.T) {
+	tests := []struct {
+		mean float64
+		want float64
+	}{
+		{targetLuminance, 0},
+		// errors under half a stop are ignored
+		{100, 0},
+		{140, 0},
+		// larger errors are damped and rounded to half stops
+		{targetLuminance / 2, 1},
+		{targetLuminance / 4, 1.5},
+		{targetLuminance / 8, 2.5},
+		{targetLuminance * 2, -1},
+		{255, -1},
+		// a black frame doesn't divide by zero
+		{0, 5},
+	}
+	for _, tt := range tests {
+		if got := exposureCorrection(ExposureStats{Mean: tt.mean}); got != tt.want {
+			t.Errorf("exposureCorrection(mean %.2f) = %v, want %v", tt.mean, got, tt.want)
+		}
+	}
+}
+
+func TestRecommendExposure(t *testing.T) {
+	day := func(hour, min int) time.Time { return time.Date(2023, 6, 1, hour, min, 0, 0, time.Local) }
+	sunrise, sunset := day(6, 0).Unix(), day(20, 0).Unix()
+	tests := []struct {
+		name     string
+		now      time.Time
+		dark     float32
+		stats    *ExposureStats
+		phase    string
+		brackets []float64
+	}{
+		{"day", day(12, 0), 0, nil, "day", []float64{-2, -1, 0, 1, 2}},
+		{"day without clipping", day(12, 0), 0, &ExposureStats{Shadows: 0.05, Highlights: 0.01}, "day", []float64{-1, 0, 1}},
+		{"day with highlights", day(12, 0), 0, &ExposureStats{Shadows: 0.05, Highlights: 0.1}, "day", []float64{-2.5, -1.5, -0.5, 0.5, 1.5}},
+		{"day with shadows", day(12, 0), 0, &ExposureStats{Shadows: 0.4, Highlights: 0.01}, "day", []float64{-1.5, -0.5, 0.5, 1.5, 2.5}},
+		{"before sunrise", day(5, 0), 100, nil, "night", []float64{-4.5, -3, -1.5, 0, 1.5, 3, 4.5}},
+		{"dark dawn", day(6, 10), 60, nil, "dawn", []float64{-3, -1.5, 0, 1.5, 3}},
+		{"light dawn", day(6, 10), 20, nil, "dawn", []float64{-2, -1, 0, 1, 2}},
+		{"dusk", day(19, 30), 10, nil, "dusk", []float64{-2, -1, 0, 1, 2}},
+		{"lingering light after sunset", day(20, 45), 50, nil, "dusk", []float64{-2, -1, 0, 1, 2}},
+		{"after sunset", day(20, 45), 96, nil, "night", []float64{-4.5, -3, -1.5, 0, 1.5, 3, 4.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := recommendExposure(tt.now, sunrise, sunset, tt.dark, 0, tt.stats)
+			if rec.Phase != tt.phase {
+				t.Errorf("phase = %s, want %s", rec.Phase, tt.phase)
+			}
+			if rec.Frames != len(tt.brackets) || !reflect.DeepEqual(rec.Brackets, tt.brackets) {
+				t.Errorf("%d frames %v, want %v", rec.Frames, rec.Brackets, tt.brackets)
+			}
+		})
+	}
+}
+
+func TestRecommendExposureShift(t *testing.T) {
+	tests := []struct {
+		evShift float64
+		shutter float64
+		gain    float64
+	}{
+		{0, 1, 1},
+		{1, 2, 1},
+		// the shutter takes the first stops before gain is raised
+		{3, 4, 2},
+		{4, 4, 4},
+		{-1, 0.5, 1},
+		{-2.5, 0.18, 1},
+	}
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.Local)
+	for _, tt := range tests {
+		rec := recommendExposure(now, now.Add(-6*time.Hour).Unix(), now.Add(6*time.Hour).Unix(), 0, tt.evShift, nil)
+		if rec.EVShift != tt.evShift || rec.ShutterScale != tt.shutter || rec.Gain != tt.gain {
+			t.Errorf("shift %v: got shift %v, shutter %v, gain %v; want shutter %v, gain %v",
+				tt.evShift, rec.EVShift, rec.ShutterScale, rec.Gain, tt.shutter, tt.gain)
+		}
+	}
+}
+
+func TestSetExposure(t *testing.T) {
+	dark := ExposureStats{Mean: targetLuminance / 4}
+	tests := []struct {
+		name  string
+		stats []ExposureStats
+		used  []float64
+		want  float64
+	}{
+		{"well exposed", []ExposureStats{{Mean: targetLuminance}}, []float64{1}, 1},
+		{"corrected from the shift used", []ExposureStats{dark}, []float64{1}, 2.5},
+		// a camera that ignores the recommendation keeps metering the same
+		// error, which must not accumulate
+		{"shift not applied", []ExposureStats{dark, dark, dark}, []float64{0, 0, 0}, 1.5},
+		{"clamped", []ExposureStats{dark}, []float64{maxEVShift}, maxEVShift},
+		{"clamped below", []ExposureStats{{Mean: 255}}, []float64{-maxEVShift}, -maxEVShift},
+	}
+	for _, tt := range tests {
+		today := &Today{}
+		for i := range tt.stats {
+			today.SetExposure(tt.stats[i], tt.used[i])
+		}
+		if got := today.EVShift(); got != tt.want {
+			t.Errorf("%s: EV shift %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
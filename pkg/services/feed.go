@@ -0,0 +1,300 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FeedVersion is the schema version of latest.json and today.json; it
+	// changes whenever a field is removed or changes meaning
+	FeedVersion = 1
+
+	latestFeedKey = "latest.json"
+	todayFeedKey  = "today.json"
+	feedCache     = "public, max-age=60"
+)
+
+// Feed publishes machine readable descriptions of the latest image
+// (latest.json) and of all of today's images (today.json) alongside the
+// images themselves
+type Feed struct {
+	enabled   bool
+	today     *Today
+	archive   *Archive
+	publisher *Publisher
+	errChan   chan error
+
+	lock      sync.Mutex
+	latest    *LatestFeed
+	latestDir string
+	// the entries of today.json by capture name, for the day in todayDir;
+	// each capture is loaded once after its analysis rather than reloading
+	// the whole day for every image
+	todayDir    string
+	todayImages map[string]TodayFeedImage
+}
+
+// LatestFeed is the schema of latest.json
+type LatestFeed struct {
+	Version int `json:"version"`
+	// Time is when the image was captured and Published when it was
+	// uploaded
+	Time      time.Time `json:"time"`
+	Published time.Time `json:"published"`
+	// Image is the URL of the full size image and Images lists every
+	// published size, smallest first
+	Image    string      `json:"image"`
+	Images   []FeedImage `json:"images"`
+	Sunrise  time.Time   `json:"sunrise"`
+	Sunset   time.Time   `json:"sunset"`
+	Temp     *float32    `json:"temp,omitempty"`
+	TempUnit string      `json:"temp_unit,omitempty"`
+	Weather  *Weather    `json:"weather,omitempty"`
+	// DarkPercent and Colors come from the color analysis of the image,
+	// which completes shortly after it is published; latest.json is
+	// updated again once they are known
+	DarkPercent *float32    `json:"dark_percent,omitempty"`
+	Colors      []FeedColor `json:"colors,omitempty"`
+}
+
+// FeedImage is one published size of an image; URLs change with every
+// image so they are never served from a stale cache
+type FeedImage struct {
+	Name  string `json:"name"`
+	Width int    `json:"width,omitempty"`
+	URL   string `json:"url"`
+}
+
+// FeedColor is one of the dominant colors of an image, as reported by the
+// color analysis, with the percentage of the image it covers
+type FeedColor struct {
+	Color   []float32 `json:"color"`
+	Percent float32   `json:"percent"`
+}
+
+// TodayFeed is the schema of today.json
+type TodayFeed struct {
+	Version int              `json:"version"`
+	Date    string           `json:"date"`
+	Updated time.Time        `json:"updated"`
+	Sunrise time.Time        `json:"sunrise"`
+	Sunset  time.Time        `json:"sunset"`
+	Images  []TodayFeedImage `json:"images"`
+}
+
+// TodayFeedImage is one of today's images; Image and Thumb are the URLs of
+// the image in the archive and are only set when [archive] is enabled
+type TodayFeedImage struct {
+	Name        string    `json:"name"`
+	Time        time.Time `json:"time"`
+	Image       string    `json:"image,omitempty"`
+	Thumb       string    `json:"thumb,omitempty"`
+	Temp        *float32  `json:"temp,omitempty"`
+	TempUnit    string    `json:"temp_unit,omitempty"`
+	Weather     string    `json:"weather,omitempty"`
+	DarkPercent *float32  `json:"dark_percent,omitempty"`
+}
+
+// NewFeedService returns the feed publisher; unlike most optional services
+// the feed is published unless [feed] sets enabled = false. With immutable
+// image keys latest.json is how clients find the latest image, so the feed
+// can't be disabled
+func NewFeedService(config map[string]interface{}, errChan chan error, today *Today, archive *Archive, publisher *Publisher) (*Feed, error) {
+	enabled, err := util.GetBoolFromConfig(config, "feed.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if err == nil && !enabled {
+		if immutable, err := util.GetBoolFromConfig(config, "derivatives.immutable"); err == nil && immutable {
+			return nil, fmt.Errorf("the feed can't be disabled with 'derivatives.immutable' set; latest.json points to the latest image")
+		}
+		return &Feed{}, nil
+	}
+	return &Feed{
+		enabled:   true,
+		today:     today,
+		archive:   archive,
+		publisher: publisher,
+		errChan:   errChan,
+	}, nil
+}
+
+// Published is the ImageProcessor publish hook; it publishes latest.json
+// for the new image. today.json is published once the image has been
+// analyzed
+func (f *Feed) Published(img PublishedImage) {
+	if !f.enabled {
+		return
+	}
+	latest := &LatestFeed{
+		Version:   FeedVersion,
+		Time:      img.Time,
+		Published: time.Now(),
+		Sunrise:   time.Unix(f.today.GetSunrise(), 0),
+		Sunset:    time.Unix(f.today.GetSunset(), 0),
+	}
+	width := f.today.ImageWidth()
+	for _, d := range f.today.Derivatives() {
+		url, ok := img.URL(f.publisher, d.Name)
+		if !ok {
+			continue
+		}
+		fi := FeedImage{Name: d.Name, Width: d.Width, URL: url}
+		if fi.Width == 0 {
+			fi.Width = width
+			latest.Image = fi.URL
+		}
+		latest.Images = append(latest.Images, fi)
+	}
+	if latest.Image == "" && len(latest.Images) > 0 {
+		latest.Image = latest.Images[len(latest.Images)-1].URL
+	}
+	if meta, err := loadCaptureMeta(img.Dir); err == nil {
+		latest.Temp = meta.Temp
+		latest.TempUnit = meta.TempUnit
+		latest.Weather = meta.Weather
+	}
+	setFeedColors(latest, img.Dir)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.latest = latest
+	f.latestDir = img.Dir
+	if err := f.publishLatest(); err != nil {
+		f.errChan <- err
+	}
+}
+
+// Analyzed is the ImageProcessor analysis step; it adds the dark percent
+// and colors of an image to latest.json and publishes today.json with the
+// image included
+func (f *Feed) Analyzed(dir string) error {
+	if !f.enabled {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if dir == f.latestDir {
+		setFeedColors(f.latest, dir)
+		if err := f.publishLatest(); err != nil {
+			return err
+		}
+	}
+	return f.publishToday(dir)
+}
+
+// publishLatest must be called with the lock held
+func (f *Feed) publishLatest() error {
+	return f.publishJSON(path.Join(f.latestDir, latestFeedKey), latestFeedKey, f.latest)
+}
+
+// publishToday publishes today.json with the entry for the capture in dir
+// added or refreshed; it must be called with the lock held
+func (f *Feed) publishToday(dir string) error {
+	dayDir := path.Dir(dir)
+	if dayDir != f.todayDir {
+		// a new day, or the first image since starting; load the captures
+		// already in the day directory
+		captures, err := listCaptures(dayDir)
+		if err != nil {
+			return fmt.Errorf("unable to list captures in %s: %w", dayDir, err)
+		}
+		f.todayDir = dayDir
+		f.todayImages = map[string]TodayFeedImage{}
+		for _, c := range captures {
+			f.todayImages[path.Base(c)] = loadTodayFeedImage(c)
+		}
+	}
+	f.todayImages[path.Base(dir)] = loadTodayFeedImage(dir)
+
+	date := path.Base(dayDir)
+	feed := TodayFeed{
+		Version: FeedVersion,
+		Date:    date,
+		Updated: time.Now(),
+		Sunrise: time.Unix(f.today.GetSunrise(), 0),
+		Sunset:  time.Unix(f.today.GetSunset(), 0),
+		Images:  []TodayFeedImage{},
+	}
+	names := make([]string, 0, len(f.todayImages))
+	for name := range f.todayImages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	archived := f.archive.DayCaptures(date)
+	for _, name := range names {
+		img := f.todayImages[name]
+		if c, ok := archived[name]; ok {
+			img.Image = c.Image
+			img.Thumb = c.Thumb
+		}
+		feed.Images = append(feed.Images, img)
+	}
+	return f.publishJSON(path.Join(dayDir, todayFeedKey), todayFeedKey, feed)
+}
+
+// loadTodayFeedImage returns the today.json entry for the capture in dir
+// from its metadata and color analysis
+func loadTodayFeedImage(dir string) TodayFeedImage {
+	img := TodayFeedImage{Name: path.Base(dir)}
+	if meta, err := loadCaptureMeta(dir); err == nil {
+		img.Time = meta.Time
+		img.Temp = meta.Temp
+		img.TempUnit = meta.TempUnit
+		if meta.Weather != nil && len(meta.Weather.WeatherDesc) > 0 {
+			img.Weather = meta.Weather.WeatherDesc[0].Description
+		}
+	}
+	if colors, err := loadColors(dir); err == nil {
+		img.DarkPercent = &colors.BlackPercent
+	}
+	return img
+}
+
+func (f *Feed) publishJSON(file, key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal %s: %w", key, err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", file, err)
+	}
+	logrus.Debugf("Publishing %s", key)
+	return f.publisher.Publish(file, key, PublishOptions{ContentType: "application/json", CacheControl: feedCache})
+}
+
+// setFeedColors adds the results of the color analysis of dir, if it has
+// completed, to latest
+func setFeedColors(latest *LatestFeed, dir string) {
+	colors, err := loadColors(dir)
+	if err != nil {
+		return
+	}
+	latest.DarkPercent = &colors.BlackPercent
+	latest.Colors = nil
+	for _, c := range colors.Colors {
+		latest.Colors = append(latest.Colors, FeedColor{Color: c.Color, Percent: c.Percent})
+	}
+}
+
+// loadColors returns the color analysis stored in a capture directory
+func loadColors(dir string) (*ColorJson, error) {
+	data, err := os.ReadFile(path.Join(dir, "colors.json"))
+	if err != nil {
+		return nil, err
+	}
+	var colors ColorJson
+	if err := json.Unmarshal(data, &colors); err != nil {
+		return nil, err
+	}
+	return &colors, nil
+}
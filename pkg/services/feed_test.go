@@ -0,0 +1,222 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeFeedCapture creates a processed capture in dayDir taken at hhmm with
+// its metadata, and its color analysis if dark is not negative
+func makeFeedCapture(t *testing.T, dayDir, hhmm string, temp float32, dark float32) (string, time.Time) {
+	t.Helper()
+	dir := path.Join(dayDir, hhmm)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	at, err := time.ParseInLocation("2006-01-02 1504", path.Base(dayDir)+" "+hhmm, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := CaptureMeta{
+		Time:     at,
+		Temp:     &temp,
+		TempUnit: "C",
+		Weather:  &Weather{WeatherDesc: []WeatherDesc{{Description: "clear sky"}}},
+	}
+	files := map[string]interface{}{captureMetaFile: meta}
+	if dark >= 0 {
+		files["colors.json"] = map[string]interface{}{
+			"black_percent": dark,
+			"colors":        []interface{}{map[string]interface{}{"color": []float32{10, 20, 30}, "percent": 60}},
+		}
+	}
+	for file, v := range files {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path.Join(dir, "final.jpg"), testFrame(1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, at
+}
+
+func newTestFeed(t *testing.T) (*Feed, string) {
+	t.Helper()
+	log, _ := fakeAWS(t)
+	p := newTestPublisher(t)
+	p.baseURL = "https://cdn.example.com/"
+	today := newTestToday(t, p)
+	today.derivatives = []Derivative{{Name: "640", Width: 640}, {Name: "full"}}
+	today.imageWidth = 1920
+	today.sunrise = time.Date(2023, 6, 30, 5, 40, 0, 0, time.Local).Unix()
+	today.sunset = time.Date(2023, 6, 30, 21, 5, 0, 0, time.Local).Unix()
+	f, err := NewFeedService(map[string]interface{}{}, p.errChan, today, &Archive{}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, log
+}
+
+func latestFeed(t *testing.T, log string) LatestFeed {
+	t.Helper()
+	var latest LatestFeed
+	if err := json.Unmarshal([]byte(bucketObject(t, log, latestFeedKey)), &latest); err != nil {
+		t.Fatal(err)
+	}
+	return latest
+}
+
+// uploads returns how many times key was uploaded
+func uploads(t *testing.T, log, key string) int {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), " s3://bucket/"+key+" ")
+}
+
+func TestFeedLatest(t *testing.T) {
+	f, log := newTestFeed(t)
+	dayDir := path.Join(t.TempDir(), "2023-06-30")
+	dir, at := makeFeedCapture(t, dayDir, "1200", 21.5, -1)
+	f.Published(PublishedImage{Dir: dir, Time: at, Keys: map[string]string{"640": "latest-640.jpg", "full": "latest.jpg"}})
+
+	latest := latestFeed(t, log)
+	version := fmt.Sprintf("?v=%d", at.Unix())
+	want := []FeedImage{
+		{Name: "640", Width: 640, URL: "https://cdn.example.com/latest-640.jpg" + version},
+		{Name: "full", Width: 1920, URL: "https://cdn.example.com/latest.jpg" + version},
+	}
+	if latest.Version != FeedVersion || !latest.Time.Equal(at) || !reflect.DeepEqual(latest.Images, want) {
+		t.Errorf("latest.json %+v", latest)
+	}
+	if latest.Image != want[1].URL {
+		t.Errorf("latest image is %s, want the full size %s", latest.Image, want[1].URL)
+	}
+	if latest.Temp == nil || *latest.Temp != 21.5 || latest.TempUnit != "C" || latest.Weather == nil {
+		t.Errorf("latest.json weather %v %s %v", latest.Temp, latest.TempUnit, latest.Weather)
+	}
+	if latest.Sunrise.Unix() != f.today.GetSunrise() || latest.Sunset.Unix() != f.today.GetSunset() {
+		t.Errorf("latest.json sun times %v, %v", latest.Sunrise, latest.Sunset)
+	}
+	// the color analysis comes later, and today.json with it
+	if latest.DarkPercent != nil || latest.Colors != nil {
+		t.Errorf("latest.json has colors before the analysis")
+	}
+	if n := uploads(t, log, todayFeedKey); n != 0 {
+		t.Errorf("today.json published %d times before the analysis", n)
+	}
+
+	// immutable keys are linked to as they are
+	f.Published(PublishedImage{Dir: dir, Time: at, Immutable: true,
+		Keys: map[string]string{"640": "images/1200-640.jpg", "full": "images/1200.jpg"}})
+	if latest := latestFeed(t, log); latest.Image != "https://cdn.example.com/images/1200.jpg" {
+		t.Errorf("latest image with immutable keys is %s", latest.Image)
+	}
+}
+
+func TestFeedAnalyzed(t *testing.T) {
+	f, log := newTestFeed(t)
+	dayDir := path.Join(t.TempDir(), "2023-06-30")
+	keys := map[string]string{"full": "latest.jpg"}
+	// a capture from before a restart, already analyzed
+	makeFeedCapture(t, dayDir, "1150", 20, 40)
+	dir, at := makeFeedCapture(t, dayDir, "1200", 21.5, 12.5)
+	f.Published(PublishedImage{Dir: dir, Time: at, Keys: keys})
+	if err := f.Analyzed(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := latestFeed(t, log)
+	if latest.DarkPercent == nil || *latest.DarkPercent != 12.5 ||
+		!reflect.DeepEqual(latest.Colors, []FeedColor{{Color: []float32{10, 20, 30}, Percent: 60}}) {
+		t.Errorf("latest.json colors %v %v after the analysis", latest.DarkPercent, latest.Colors)
+	}
+	if n := uploads(t, log, latestFeedKey); n != 2 {
+		t.Errorf("latest.json published %d times, want once when published and once when analyzed", n)
+	}
+
+	var today TodayFeed
+	if err := json.Unmarshal([]byte(bucketObject(t, log, todayFeedKey)), &today); err != nil {
+		t.Fatal(err)
+	}
+	if today.Version != FeedVersion || today.Date != "2023-06-30" || len(today.Images) != 2 {
+		t.Fatalf("today.json %+v", today)
+	}
+	if img := today.Images[0]; img.Name != "1150" || img.DarkPercent == nil || *img.DarkPercent != 40 {
+		t.Errorf("earlier capture %+v", img)
+	}
+	img := today.Images[1]
+	if img.Name != "1200" || !img.Time.Equal(at) || img.Weather != "clear sky" || img.TempUnit != "C" ||
+		img.Temp == nil || *img.Temp != 21.5 || img.DarkPercent == nil || *img.DarkPercent != 12.5 {
+		t.Errorf("analyzed capture %+v", img)
+	}
+	// without [archive] the feed has no archive links
+	if img.Image != "" || img.Thumb != "" {
+		t.Errorf("archive links %s, %s without an archive", img.Image, img.Thumb)
+	}
+
+	// the analysis of an earlier image than the latest only updates
+	// today.json
+	next, nextAt := makeFeedCapture(t, dayDir, "1210", 22, -1)
+	f.Published(PublishedImage{Dir: next, Time: nextAt, Keys: keys})
+	if err := f.Analyzed(dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := uploads(t, log, latestFeedKey); n != 3 {
+		t.Errorf("latest.json published %d times, want 3", n)
+	}
+	if latest := latestFeed(t, log); !latest.Time.Equal(nextAt) || latest.DarkPercent != nil {
+		t.Errorf("latest.json is for %v with dark percent %v, want the unanalyzed %v", latest.Time, latest.DarkPercent, nextAt)
+	}
+	makeFeedCapture(t, dayDir, "1210", 22, 10)
+	if err := f.Analyzed(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(bucketObject(t, log, todayFeedKey)), &today); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, img := range today.Images {
+		names = append(names, img.Name)
+	}
+	if want := []string{"1150", "1200", "1210"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("today.json lists %v, want %v", names, want)
+	}
+}
+
+func TestFeedEnabled(t *testing.T) {
+	f, err := NewFeedService(map[string]interface{}{}, nil, nil, nil, nil)
+	if err != nil || !f.enabled {
+		t.Errorf("without a [feed] section: enabled %v, %v; want enabled", f != nil && f.enabled, err)
+	}
+	f, err = NewFeedService(map[string]interface{}{
+		"feed": map[string]interface{}{"enabled": false},
+	}, nil, nil, nil, nil)
+	if err != nil || f.enabled {
+		t.Errorf("with enabled = false: enabled %v, %v", f != nil && f.enabled, err)
+	}
+	for name, config := range map[string]map[string]interface{}{
+		"enabled not a bool": {"feed": map[string]interface{}{"enabled": "no"}},
+		"disabled with immutable keys": {
+			"feed":        map[string]interface{}{"enabled": false},
+			"derivatives": map[string]interface{}{"immutable": true},
+		},
+	} {
+		if _, err := NewFeedService(config, nil, nil, nil, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
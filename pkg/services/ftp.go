@@ -0,0 +1,475 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+)
+
+// FTPServer is a minimal passive mode FTP server for cameras that can only
+// upload snapshots by FTP. Each JPEG stored by an authenticated account is
+// added as the next frame of that account's pending capture, which is
+// committed for processing once it has the configured number of frames or
+// no more frames arrive within the batch window
+type FTPServer struct {
+	enabled          bool
+	address          string
+	publicIP         net.IP
+	passiveMin       int
+	passiveMax       int
+	accounts         map[string]string
+	framesPerCapture int
+	batchWindow      time.Duration
+	maxUploadBytes   int64
+	imageProcessor   *ImageProcessor
+	errChan          chan error
+
+	lock     sync.Mutex
+	batches  map[string]*ftpBatch
+	nextPort int
+}
+
+// ftpBatch is a capture being assembled from an account's uploads
+type ftpBatch struct {
+	staging string
+	frames  int
+	started time.Time
+	timer   *time.Timer
+}
+
+type ftpSession struct {
+	server  *FTPServer
+	conn    net.Conn
+	reader  *bufio.Reader
+	user    string
+	authed  bool
+	cwd     string
+	passive net.Listener
+}
+
+func NewFTPService(config map[string]interface{}, errChan chan error, imageProcessor *ImageProcessor) (*FTPServer, error) {
+	enabled, err := util.GetBoolFromConfig(config, "ftp.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &FTPServer{}, nil
+	}
+	address, err := util.GetStringFromConfig(config, "ftp.address")
+	if err != nil || address == "" {
+		address = ":2121"
+	}
+	var publicIP net.IP
+	if host, err := util.GetStringFromConfig(config, "ftp.public_host"); err == nil && host != "" {
+		if publicIP = net.ParseIP(host).To4(); publicIP == nil {
+			return nil, fmt.Errorf("invalid 'ftp.public_host' %q; must be an IPv4 address", host)
+		}
+	}
+	passiveMin, passiveMax := 30000, 30009
+	if ports, err := util.GetStringFromConfig(config, "ftp.passive_ports"); err == nil && ports != "" {
+		if passiveMin, passiveMax, err = parsePortRange(ports); err != nil {
+			return nil, fmt.Errorf("invalid 'ftp.passive_ports': %w", err)
+		}
+	}
+	frames, err := util.GetIntFromConfig(config, "ftp.frames_per_capture")
+	if err != nil || frames < 0 {
+		frames = 0
+	}
+	if frames > 99 {
+		return nil, fmt.Errorf("invalid 'ftp.frames_per_capture' %d; must be at most 99", frames)
+	}
+	batchSecs, err := util.GetIntFromConfig(config, "ftp.batch_seconds")
+	if err != nil || batchSecs <= 0 {
+		batchSecs = 5
+	}
+	maxMB, err := util.GetIntFromConfig(config, "ftp.max_upload_mb")
+	if err != nil || maxMB <= 0 {
+		maxMB = 20
+	}
+	tables, err := util.GetTableSliceFromConfig(config, "ftp.accounts")
+	if err != nil {
+		return nil, fmt.Errorf("the ftp server requires at least one [[ftp.accounts]] entry: %w", err)
+	}
+	accounts := map[string]string{}
+	for i, table := range tables {
+		name, _ := table["name"].(string)
+		password, _ := table["password"].(string)
+		if name == "" || password == "" {
+			return nil, fmt.Errorf("ftp account %d needs a name and password", i+1)
+		}
+		accounts[name] = password
+	}
+	return &FTPServer{
+		enabled:          true,
+		address:          address,
+		publicIP:         publicIP,
+		passiveMin:       passiveMin,
+		passiveMax:       passiveMax,
+		accounts:         accounts,
+		framesPerCapture: int(frames),
+		batchWindow:      time.Duration(batchSecs) * time.Second,
+		maxUploadBytes:   maxMB * 1024 * 1024,
+		imageProcessor:   imageProcessor,
+		errChan:          errChan,
+		batches:          map[string]*ftpBatch{},
+		nextPort:         passiveMin,
+	}, nil
+}
+
+func parsePortRange(ports string) (int, int, error) {
+	lo, hi, found := strings.Cut(ports, "-")
+	if !found {
+		hi = lo
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, err
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("%q is not a valid port range", ports)
+	}
+	return min, max, nil
+}
+
+// Start listens for FTP connections in the background
+func (fs *FTPServer) Start() error {
+	if !fs.enabled {
+		return nil
+	}
+	l, err := net.Listen("tcp", fs.address)
+	if err != nil {
+		return fmt.Errorf("unable to listen for ftp connections: %w", err)
+	}
+	go fs.Serve(l)
+	return nil
+}
+
+// Serve accepts FTP control connections on l until it is closed
+func (fs *FTPServer) Serve(l net.Listener) {
+	logrus.Infof("FTP server listening on %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logrus.Errorf("ftp listener failed: %v", err)
+			return
+		}
+		s := &ftpSession{server: fs, conn: conn, reader: bufio.NewReader(conn), cwd: "/"}
+		go s.serve()
+	}
+}
+
+func (s *ftpSession) reply(code int, msg string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, msg)
+}
+
+func (s *ftpSession) serve() {
+	defer s.conn.Close()
+	defer s.closePassive()
+	s.reply(220, "onimage FTP ready")
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		cmd = strings.ToUpper(cmd)
+		if !s.authed && cmd != "USER" && cmd != "PASS" && cmd != "QUIT" && cmd != "FEAT" && cmd != "SYST" && cmd != "AUTH" {
+			s.reply(530, "Please log in with USER and PASS")
+			continue
+		}
+		switch cmd {
+		case "USER":
+			s.user, s.authed = arg, false
+			s.reply(331, "Password required")
+		case "PASS":
+			password, ok := s.server.accounts[s.user]
+			if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(arg)) != 1 {
+				logrus.Warnf("Rejected ftp login for %q from %s", s.user, s.conn.RemoteAddr())
+				s.reply(530, "Login incorrect")
+				continue
+			}
+			s.authed = true
+			s.reply(230, "Logged in")
+		case "AUTH":
+			s.reply(502, "TLS is not supported")
+		case "SYST":
+			s.reply(215, "UNIX Type: L8")
+		case "FEAT":
+			fmt.Fprintf(s.conn, "211-Features:\r\n EPSV\r\n PASV\r\n UTF8\r\n211 End\r\n")
+		case "OPTS", "TYPE", "MODE", "STRU", "NOOP":
+			s.reply(200, "OK")
+		case "PWD", "XPWD":
+			s.reply(257, fmt.Sprintf("%q is the current directory", s.cwd))
+		case "CWD", "XCWD":
+			// directories are virtual; every upload becomes a frame of the
+			// account's current capture regardless of where it is stored
+			s.cwd = path.Join(s.cwd, arg)
+			if strings.HasPrefix(arg, "/") {
+				s.cwd = path.Clean(arg)
+			}
+			s.reply(250, "Directory changed")
+		case "CDUP", "XCUP":
+			s.cwd = path.Dir(s.cwd)
+			s.reply(250, "Directory changed")
+		case "MKD", "XMKD":
+			s.reply(257, fmt.Sprintf("%q created", arg))
+		case "DELE", "RMD", "XRMD":
+			s.reply(250, "OK")
+		case "PASV":
+			s.enterPassive(false)
+		case "EPSV":
+			s.enterPassive(true)
+		case "LIST", "NLST":
+			s.sendEmptyListing()
+		case "STOR", "APPE":
+			s.store(arg)
+		case "QUIT":
+			s.reply(221, "Goodbye")
+			return
+		default:
+			s.reply(502, "Command not implemented")
+		}
+	}
+}
+
+func (s *ftpSession) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// enterPassive opens a data listener on the next free passive port
+func (s *ftpSession) enterPassive(extended bool) {
+	s.closePassive()
+	host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+	ip := s.server.publicIP
+	if ip == nil {
+		ip = net.ParseIP(host).To4()
+	}
+	if ip == nil && !extended {
+		s.reply(425, "PASV requires IPv4; use EPSV")
+		return
+	}
+	l, err := s.server.listenPassive(host)
+	if err != nil {
+		logrus.Errorf("unable to open ftp data port: %v", err)
+		s.reply(425, "Can't open data connection")
+		return
+	}
+	s.passive = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+func (fs *FTPServer) listenPassive(host string) (net.Listener, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var err error
+	for i := 0; i <= fs.passiveMax-fs.passiveMin; i++ {
+		port := fs.nextPort
+		if fs.nextPort++; fs.nextPort > fs.passiveMax {
+			fs.nextPort = fs.passiveMin
+		}
+		var l net.Listener
+		if l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no passive ports available in %d-%d: %w", fs.passiveMin, fs.passiveMax, err)
+}
+
+// acceptData accepts the data connection for a transfer; only the client of
+// the control connection may connect
+func (s *ftpSession) acceptData() (net.Conn, error) {
+	defer s.closePassive()
+	s.passive.(*net.TCPListener).SetDeadline(time.Now().Add(ftpDataTimeout))
+	conn, err := s.passive.Accept()
+	if err != nil {
+		return nil, err
+	}
+	controlHost, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	dataHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if controlHost != dataHost {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from unexpected address %s", dataHost)
+	}
+	conn.SetDeadline(time.Now().Add(ftpIdleTimeout))
+	return conn, nil
+}
+
+func (s *ftpSession) sendEmptyListing() {
+	if s.passive == nil {
+		s.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	s.reply(150, "Opening data connection")
+	conn, err := s.acceptData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	conn.Close()
+	s.reply(226, "Transfer complete")
+}
+
+func (s *ftpSession) store(name string) {
+	if s.passive == nil {
+		s.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	s.reply(150, "Ok to send data")
+	conn, err := s.acceptData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	staging, err := s.server.imageProcessor.NewStagingDir()
+	if err != nil {
+		logrus.Errorf("unable to create ftp staging directory: %v", err)
+		s.reply(451, "Local error")
+		return
+	}
+	defer os.RemoveAll(staging)
+	tmp := path.Join(staging, "upload.jpg")
+	f, err := os.Create(tmp)
+	if err != nil {
+		s.reply(451, "Local error")
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(conn, s.server.maxUploadBytes+1))
+	f.Close()
+	if err != nil {
+		s.reply(426, "Transfer aborted")
+		return
+	}
+	if n > s.server.maxUploadBytes {
+		s.reply(552, "File too large")
+		return
+	}
+	if !isJPEG(tmp) {
+		// cameras often upload a test file to check write access; accept and
+		// discard anything that is not an image
+		logrus.Infof("Discarding non-JPEG ftp upload %s from %s", name, s.user)
+		s.reply(226, "Transfer complete")
+		return
+	}
+	if err := s.server.addFrame(s.user, tmp); err != nil {
+		logrus.Errorf("unable to add ftp upload from %s: %v", s.user, err)
+		s.server.errChan <- err
+		s.reply(451, "Local error")
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+func isJPEG(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(jpegMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && bytes.Equal(magic, jpegMagic)
+}
+
+// addFrame moves an uploaded image into the account's pending capture,
+// committing it if it is complete
+func (fs *FTPServer) addFrame(account, file string) error {
+	batch, err := fs.appendFrame(account, file)
+	if err != nil || batch == nil {
+		return err
+	}
+	return fs.commitBatch(account, batch)
+}
+
+// appendFrame adds an uploaded image to the account's pending capture and
+// returns the capture, no longer pending, once it is complete
+func (fs *FTPServer) appendFrame(account, file string) (*ftpBatch, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	batch, ok := fs.batches[account]
+	if !ok {
+		staging, err := fs.imageProcessor.NewStagingDir()
+		if err != nil {
+			return nil, err
+		}
+		batch = &ftpBatch{staging: staging, started: time.Now()}
+		fs.batches[account] = batch
+	}
+	batch.frames++
+	if err := os.Rename(file, path.Join(batch.staging, fmt.Sprintf("%02d.jpg", batch.frames))); err != nil {
+		batch.frames--
+		return nil, err
+	}
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	if batch.frames == fs.framesPerCapture || batch.frames == 99 {
+		delete(fs.batches, account)
+		return batch, nil
+	}
+	batch.timer = time.AfterFunc(fs.batchWindow, func() { fs.expireBatch(account, batch) })
+	return nil, nil
+}
+
+// expireBatch commits the account's pending capture once no more frames
+// arrived within the batch window, unless it was completed in the meantime
+func (fs *FTPServer) expireBatch(account string, batch *ftpBatch) {
+	fs.lock.Lock()
+	current := fs.batches[account] == batch
+	if current {
+		delete(fs.batches, account)
+	}
+	fs.lock.Unlock()
+	if !current {
+		return
+	}
+	if err := fs.commitBatch(account, batch); err != nil {
+		logrus.Errorf("unable to commit ftp capture from %s: %v", account, err)
+		fs.errChan <- err
+	}
+}
+
+// commitBatch commits a capture that has been removed from the pending ones;
+// it is called without the lock so that uploads aren't held up by it
+func (fs *FTPServer) commitBatch(account string, batch *ftpBatch) error {
+	// the camera isn't told the recommended shift, so it takes the frames
+	// without one
+	dir, err := fs.imageProcessor.CommitCapture(batch.staging, CaptureMeta{Time: batch.started, Source: "ftp:" + account, EVShift: new(float64)})
+	if err != nil {
+		os.RemoveAll(batch.staging)
+		return err
+	}
+	logrus.Infof("Received capture %s with %d frames by ftp from %s", dir, batch.frames, account)
+	return nil
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startFTP(t *testing.T, ip *ImageProcessor, frames, batchSeconds int) string {
+	t.Helper()
+	// a single passive port is enough for uploads made one at a time
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pl.Addr().(*net.TCPAddr).Port
+	pl.Close()
+	fs, err := NewFTPService(map[string]interface{}{
+		"ftp": map[string]interface{}{
+			"enabled":            true,
+			"passive_ports":      strconv.Itoa(port),
+			"frames_per_capture": int64(frames),
+			"batch_seconds":      int64(batchSeconds),
+			"accounts":           []interface{}{map[string]interface{}{"name": "camera", "password": "secret"}},
+		},
+	}, make(chan error, 10), ip)
+	if err != nil {
+		t.Fatalf("NewFTPService: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go fs.Serve(l)
+	return l.Addr().String()
+}
+
+// ftpClient is just enough of an FTP client to log in and upload files
+type ftpClient struct {
+	t    *testing.T
+	conn *textproto.Conn
+}
+
+func dialFTP(t *testing.T, addr string) *ftpClient {
+	t.Helper()
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &ftpClient{t: t, conn: conn}
+	c.expect(220)
+	return c
+}
+
+// cmd sends a command and returns the reply code and message
+func (c *ftpClient) cmd(format string, args ...interface{}) (int, string) {
+	c.t.Helper()
+	if _, err := c.conn.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *ftpClient) read() (int, string) {
+	c.t.Helper()
+	code, msg, err := c.conn.ReadResponse(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return code, msg
+}
+
+func (c *ftpClient) expect(want int) string {
+	c.t.Helper()
+	code, msg := c.read()
+	if code != want {
+		c.t.Fatalf("reply %d %s, want %d", code, msg, want)
+	}
+	return msg
+}
+
+func (c *ftpClient) login(user, password string) int {
+	c.t.Helper()
+	if code, msg := c.cmd("USER %s", user); code != 331 {
+		c.t.Fatalf("USER: %d %s", code, msg)
+	}
+	code, _ := c.cmd("PASS %s", password)
+	return code
+}
+
+func (c *ftpClient) stor(name string, data []byte) {
+	c.t.Helper()
+	code, msg := c.cmd("EPSV")
+	if code != 229 {
+		c.t.Fatalf("EPSV: %d %s", code, msg)
+	}
+	port := strings.TrimSuffix(msg[strings.Index(msg, "|||")+3:], "|)")
+	dataConn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if code, msg := c.cmd("STOR %s", name); code != 150 {
+		c.t.Fatalf("STOR: %d %s", code, msg)
+	}
+	dataConn.Write(data)
+	dataConn.Close()
+	c.expect(226)
+}
+
+func TestFTPLoginFailure(t *testing.T) {
+	ip := newTestProcessor(t)
+	c := dialFTP(t, startFTP(t, ip, 1, 5))
+	if code := c.login("camera", "wrong"); code != 530 {
+		t.Errorf("login with the wrong password: %d, want 530", code)
+	}
+	if code := c.login("nobody", "secret"); code != 530 {
+		t.Errorf("login as an unknown user: %d, want 530", code)
+	}
+	if code, _ := c.cmd("EPSV"); code != 530 {
+		t.Errorf("EPSV before logging in: %d, want 530", code)
+	}
+	if code, _ := c.cmd("STOR snap.jpg"); code != 530 {
+		t.Errorf("STOR before logging in: %d, want 530", code)
+	}
+}
+
+func TestFTPCompleteBatch(t *testing.T) {
+	ip := newTestProcessor(t)
+	// the batch window is long enough that only the frame count commits
+	c := dialFTP(t, startFTP(t, ip, 3, 3600))
+	if code := c.login("camera", "secret"); code != 230 {
+		t.Fatalf("login: %d", code)
+	}
+	frames := [][]byte{testFrame(1), testFrame(2), testFrame(3)}
+	for i, f := range frames {
+		c.stor(fmt.Sprintf("snap%d.jpg", i), f)
+	}
+	// a file that isn't a JPEG, such as a write test, is discarded
+	c.stor("test.txt", []byte("test"))
+	checkCapture(t, nextCapture(t, ip, 5*time.Second), frames, "ftp:camera")
+
+	c.stor("snap4.jpg", testFrame(4))
+	select {
+	case dir := <-ip.readyDirs:
+		t.Errorf("capture %s committed with a single frame", dir)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFTPPartialBatch(t *testing.T) {
+	ip := newTestProcessor(t)
+	c := dialFTP(t, startFTP(t, ip, 3, 1))
+	if code := c.login("camera", "secret"); code != 230 {
+		t.Fatalf("login: %d", code)
+	}
+	frames := [][]byte{testFrame(1), testFrame(2)}
+	for i, f := range frames {
+		c.stor(fmt.Sprintf("snap%d.jpg", i), f)
+	}
+	start := time.Now()
+	dir := nextCapture(t, ip, 5*time.Second)
+	if time.Since(start) < 500*time.Millisecond {
+		t.Errorf("partial capture committed before the batch window")
+	}
+	checkCapture(t, dir, frames, "ftp:camera")
+}
+
+func TestFTPEnabledInvalid(t *testing.T) {
+	if _, err := NewFTPService(map[string]interface{}{
+		"ftp": map[string]interface{}{"enabled": "yes"},
+	}, nil, nil); err == nil {
+		t.Errorf("an invalid 'ftp.enabled' was accepted")
+	}
+	s, err := NewFTPService(map[string]interface{}{}, nil, nil)
+	if err != nil || s.enabled {
+		t.Errorf("without a [ftp] section: %+v, %v", s, err)
+	}
+}
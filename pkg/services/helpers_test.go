@@ -0,0 +1,181 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fixtures shared by the service tests
+
+// newTestProcessor returns an image processor whose committed captures are
+// only queued, for checking what an ingest source commits
+func newTestProcessor(t *testing.T) *ImageProcessor {
+	t.Helper()
+	return &ImageProcessor{
+		imagesBaseDir: t.TempDir(),
+		readyDirs:     make(chan string, 10),
+		queuedDirs:    map[string]struct{}{},
+	}
+}
+
+// nextCapture waits for a capture to be committed to ip
+func nextCapture(t *testing.T, ip *ImageProcessor, timeout time.Duration) string {
+	t.Helper()
+	select {
+	case dir := <-ip.readyDirs:
+		return dir
+	case <-time.After(timeout):
+		t.Fatalf("no capture committed within %v", timeout)
+		return ""
+	}
+}
+
+// checkCapture checks that dir holds the numbered frames and the metadata
+// of a capture from source
+func checkCapture(t *testing.T, dir string, frames [][]byte, source string) {
+	t.Helper()
+	for i, want := range frames {
+		got, err := os.ReadFile(path.Join(dir, fmt.Sprintf("%02d.jpg", i+1)))
+		if err != nil {
+			t.Fatalf("frame %d: %v", i+1, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d has different content", i+1)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, fmt.Sprintf("%02d.jpg", len(frames)+1))); err == nil {
+		t.Errorf("capture has more than %d frames", len(frames))
+	}
+	if _, err := os.Stat(path.Join(dir, "done.txt")); err != nil {
+		t.Errorf("capture is not marked done: %v", err)
+	}
+	data, err := os.ReadFile(path.Join(dir, captureMetaFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta CaptureMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Source != source {
+		t.Errorf("capture source = %q, want %q", meta.Source, source)
+	}
+}
+
+func testFrame(i int) []byte {
+	return append(append([]byte{}, jpegMagic...), []byte(fmt.Sprintf("frame %d", i))...)
+}
+
+// checkNoStaging checks that nothing was left behind in the staging area
+func checkNoStaging(t *testing.T, ip *ImageProcessor) {
+	t.Helper()
+	entries, err := os.ReadDir(path.Join(ip.imagesBaseDir, stagingDir))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("staging directory %s left behind", e.Name())
+	}
+}
+
+// fakeAWS puts an aws command on the PATH that logs its arguments to the
+// returned file and fails while the returned fail file exists; otherwise
+// it keeps a copy of each uploaded object for bucketObject
+func fakeAWS(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	log := path.Join(dir, "aws.log")
+	fail := path.Join(dir, "fail")
+	bucket := path.Join(dir, "bucket")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n[ -e " + fail + " ] && exit 1\n" +
+		"case \"$2\" in\n" +
+		"cp) obj=\"" + bucket + "/${4#s3://*/}\"; mkdir -p \"$(dirname \"$obj\")\" && cp \"$3\" \"$obj\" ;;\n" +
+		"rm) rm -rf \"" + bucket + "/${3#s3://*/}\" ;;\n" +
+		"esac\nexit 0\n"
+	if err := os.WriteFile(path.Join(dir, "aws"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return log, fail
+}
+
+// bucketObject returns the content of the object last uploaded to key with
+// the fakeAWS command that logs to log, or fails the test if there is none
+func bucketObject(t *testing.T, log, key string) string {
+	t.Helper()
+	data, err := os.ReadFile(path.Join(path.Dir(log), "bucket", key))
+	if err != nil {
+		t.Fatalf("object %s wasn't uploaded: %v", key, err)
+	}
+	return string(data)
+}
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	file := path.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// newTestPublisher returns a publisher to the "bucket" bucket that uploads
+// directly, without an outbox; use fakeAWS to run its uploads
+func newTestPublisher(t *testing.T) *Publisher {
+	t.Helper()
+	return &Publisher{bucket: "bucket", homeDir: t.TempDir(), errChan: make(chan error, 10)}
+}
+
+// newTestTemplates writes the index and offline page templates to a
+// template directory and loads them
+func newTestTemplates(t *testing.T, index, offline string) *Templates {
+	t.Helper()
+	dir := t.TempDir()
+	for file, content := range map[string]string{"index.html": index, "offline.html": offline} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err := NewTemplates(map[string]interface{}{
+		"website": map[string]interface{}{
+			"template_dir":  dir,
+			"page_template": "index.html",
+			"offline_page":  "offline.html",
+		},
+	}, make(chan error, 10))
+	if err != nil {
+		t.Fatalf("NewTemplates: %v", err)
+	}
+	return ts
+}
+
+// newTestToday returns today's state for 2023-06-30, keeping its state
+// files in its own home directory and publishing pages rendered as
+// "index <date>" and "offline <message>" with p
+func newTestToday(t *testing.T, p *Publisher) *Today {
+	t.Helper()
+	home := t.TempDir()
+	return &Today{
+		dateStr:             "2023-06-30",
+		homeDir:             home,
+		weatherService:      &WeatherData{},
+		darkPercent:         100,
+		publisher:           p,
+		templates:           newTestTemplates(t, "index {{.Today}}", "offline {{.Message}}"),
+		offlineStateFile:    filepath.Join(home, offlineStateFile),
+		maintenanceSkipFile: filepath.Join(home, maintenanceSkipFile),
+		latestKeysFile:      filepath.Join(home, latestKeysFile),
+		errChan:             p.errChan,
+	}
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	highlightsStateFile = "onimage-highlights.json"
+	highlightsCache     = "public, max-age=3600"
+)
+
+// Highlights maintains an Atom feed with an entry for each day showing its
+// sunrise and sunset frames, a link to its timelapse and its high and low
+// temperatures. Entries are added at the end of each day and kept in the
+// home directory so the feed survives restarts
+type Highlights struct {
+	enabled    bool
+	title      string
+	key        string
+	entries    int
+	imageWidth int
+	stateFile  string
+	timelapse  *Timelapse
+	archive    *Archive
+	publisher  *Publisher
+	errChan    chan error
+}
+
+// HighlightDay holds the highlights of one day
+type HighlightDay struct {
+	Date      string          `json:"date"`
+	Updated   time.Time       `json:"updated"`
+	Captures  int             `json:"captures"`
+	Sunrise   *HighlightFrame `json:"sunrise,omitempty"`
+	Sunset    *HighlightFrame `json:"sunset,omitempty"`
+	Timelapse string          `json:"timelapse,omitempty"`
+	Link      string          `json:"link,omitempty"`
+	High      *float32        `json:"high,omitempty"`
+	Low       *float32        `json:"low,omitempty"`
+	TempUnit  string          `json:"temp_unit,omitempty"`
+}
+
+// HighlightFrame is the capture nearest to sunrise or sunset
+type HighlightFrame struct {
+	Time time.Time `json:"time"`
+	URL  string    `json:"url"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Summary string      `xml:"summary"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+var highlightContent = template.Must(template.New("highlight").Parse(`
+{{- with .Sunrise}}<p>Sunrise, {{.Time.Format "15:04"}}<br><img src="{{.URL}}" alt="sunrise"></p>{{end}}
+{{- with .Sunset}}<p>Sunset, {{.Time.Format "15:04"}}<br><img src="{{.URL}}" alt="sunset"></p>{{end}}
+{{- if .Timelapse}}<p><a href="{{.Timelapse}}">Timelapse of the day</a></p>{{end}}
+<p>{{.Summary}}</p>`))
+
+func NewHighlightsService(config map[string]interface{}, errChan chan error, timelapse *Timelapse, archive *Archive, publisher *Publisher) (*Highlights, error) {
+	enabled, err := util.GetBoolFromConfig(config, "highlights.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Highlights{}, nil
+	}
+	title, err := util.GetStringFromConfig(config, "highlights.title")
+	if err != nil || title == "" {
+		siteText, err := util.GetStringFromConfig(config, "images.site_text")
+		if err != nil {
+			return nil, fmt.Errorf("can't retrieve entry 'images.site_text' from config: %w", err)
+		}
+		title = siteText + " daily highlights"
+	}
+	key, err := util.GetStringFromConfig(config, "highlights.key")
+	if err != nil || key == "" {
+		key = "highlights.atom"
+	}
+	entries, err := util.GetIntFromConfig(config, "highlights.entries")
+	if err != nil || entries <= 0 {
+		entries = 30
+	}
+	imageWidth, err := util.GetIntFromConfig(config, "highlights.image_width")
+	if err != nil || imageWidth < 0 {
+		imageWidth = 1280
+	}
+	homeDir, err := util.GetStringFromConfig(config, "home_dir")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve entry 'home_dir' from config: %w", err)
+	}
+	return &Highlights{
+		enabled:    true,
+		title:      title,
+		key:        key,
+		entries:    int(entries),
+		imageWidth: int(imageWidth),
+		stateFile:  filepath.Join(homeDir, highlightsStateFile),
+		timelapse:  timelapse,
+		archive:    archive,
+		publisher:  publisher,
+		errChan:    errChan,
+	}, nil
+}
+
+// DayEnd is the ImageProcessor end of day step; it collects the highlights
+// of the day from the captures' metadata, adds them to the feed and
+// publishes it. It should run after the timelapse step
+func (h *Highlights) DayEnd(date, dayDir string) error {
+	if !h.enabled {
+		return nil
+	}
+	captures, err := listCaptures(dayDir)
+	if err != nil {
+		return fmt.Errorf("unable to list captures in %s: %w", dayDir, err)
+	}
+	if len(captures) == 0 {
+		logrus.Infof("No captures for the highlights of %s", date)
+		return nil
+	}
+	day, err := h.collect(date, dayDir, captures)
+	if err != nil {
+		return err
+	}
+
+	days, err := h.loadDays()
+	if err != nil {
+		return err
+	}
+	// replace any earlier entry for the day and keep the newest entries
+	kept := []HighlightDay{*day}
+	for _, d := range days {
+		if d.Date != date {
+			kept = append(kept, d)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Date > kept[j].Date
+	})
+	if len(kept) > h.entries {
+		kept = kept[:h.entries]
+	}
+	if err := h.saveDays(kept); err != nil {
+		return err
+	}
+	return h.publishFeed(kept)
+}
+
+// collect picks the sunrise and sunset frames and temperature range of a day
+// and publishes the frames
+func (h *Highlights) collect(date, dayDir string, captures []string) (*HighlightDay, error) {
+	day := &HighlightDay{Date: date, Updated: time.Now(), Captures: len(captures)}
+	var (
+		sunrise, sunset time.Time
+		metas           = make([]*CaptureMeta, len(captures))
+	)
+	for i, dir := range captures {
+		meta, err := loadCaptureMeta(dir)
+		if err != nil {
+			logrus.Warnf("unable to load capture metadata for %s: %v", dir, err)
+			meta = &CaptureMeta{}
+		}
+		metas[i] = meta
+		if meta.Weather != nil && sunrise.IsZero() && meta.Weather.Sys.Sunrise != 0 {
+			sunrise = time.Unix(meta.Weather.Sys.Sunrise, 0)
+			sunset = time.Unix(meta.Weather.Sys.Sunset, 0)
+		}
+		if meta.Temp != nil {
+			if day.High == nil || *meta.Temp > *day.High {
+				day.High = meta.Temp
+			}
+			if day.Low == nil || *meta.Temp < *day.Low {
+				day.Low = meta.Temp
+			}
+			day.TempUnit = meta.TempUnit
+		}
+	}
+	// without an observation of the sun times the first and last captures
+	// stand in for sunrise and sunset
+	riseIdx, setIdx := 0, len(captures)-1
+	if !sunrise.IsZero() {
+		riseIdx = nearestCapture(metas, sunrise)
+		setIdx = nearestCapture(metas, sunset)
+	}
+	for _, f := range []struct {
+		name  string
+		idx   int
+		frame **HighlightFrame
+	}{{"sunrise", riseIdx, &day.Sunrise}, {"sunset", setIdx, &day.Sunset}} {
+		url, err := h.publishFrame(date, f.name, captures[f.idx])
+		if err != nil {
+			return nil, err
+		}
+		*f.frame = &HighlightFrame{Time: metas[f.idx].Time, URL: url}
+	}
+	if key := h.timelapse.Key(date, dayDir); key != "" {
+		day.Timelapse = h.publisher.URL(key)
+	}
+	day.Link = h.archive.DayURL(date)
+	return day, nil
+}
+
+func nearestCapture(metas []*CaptureMeta, t time.Time) int {
+	best, bestDiff := 0, math.MaxFloat64
+	for i, meta := range metas {
+		if meta.Time.IsZero() {
+			continue
+		}
+		if diff := math.Abs(meta.Time.Sub(t).Seconds()); diff < bestDiff {
+			best, bestDiff = i, diff
+		}
+	}
+	return best
+}
+
+func (h *Highlights) publishFrame(date, name, capDir string) (string, error) {
+	img, err := loadJPEG(path.Join(capDir, "final.jpg"))
+	if err != nil {
+		return "", err
+	}
+	if h.imageWidth > 0 && img.Bounds().Dx() > h.imageWidth {
+		img = resizeImage(img, h.imageWidth, 0)
+	}
+	local := path.Join(capDir, fmt.Sprintf("highlight-%s.jpg", name))
+	if err := saveJPEG(local, img, 85); err != nil {
+		return "", fmt.Errorf("unable to save %s: %w", local, err)
+	}
+	key := fmt.Sprintf("highlights/%s/%s.jpg", date, name)
+	if err := h.publisher.Publish(local, key, PublishOptions{
+		ContentType:  "image/jpeg",
+		CacheControl: "public, max-age=31536000",
+	}); err != nil {
+		return "", err
+	}
+	return h.publisher.URL(key), nil
+}
+
+func (h *Highlights) publishFeed(days []HighlightDay) error {
+	feed := atomFeed{
+		ID:      h.publisher.URL(h.key),
+		Title:   h.title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: h.title},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: h.publisher.URL(h.key)},
+			{Rel: "alternate", Type: "text/html", Href: h.publisher.URL("")},
+		},
+	}
+	for _, day := range days {
+		entry, err := h.entry(day)
+		if err != nil {
+			return err
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal highlights feed: %w", err)
+	}
+	tmpFile, err := os.CreateTemp("/tmp", "highlights")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(append([]byte(xml.Header), data...)); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	logrus.Infof("Publishing highlights feed with %d days", len(days))
+	return h.publisher.Publish(tmpFile.Name(), h.key, PublishOptions{
+		ContentType:  "application/atom+xml",
+		CacheControl: highlightsCache,
+	})
+}
+
+func (h *Highlights) entry(day HighlightDay) (atomEntry, error) {
+	summary := fmt.Sprintf("%d captures", day.Captures)
+	if day.High != nil && day.Low != nil {
+		summary = fmt.Sprintf("High %.1f°%s, low %.1f°%s; %s", *day.High, day.TempUnit, *day.Low, day.TempUnit, summary)
+	}
+	var content bytes.Buffer
+	err := highlightContent.Execute(&content, struct {
+		HighlightDay
+		Summary string
+	}{day, summary})
+	if err != nil {
+		return atomEntry{}, fmt.Errorf("unable to render highlights for %s: %w", day.Date, err)
+	}
+	link := day.Link
+	if link == "" {
+		link = h.publisher.URL("")
+	}
+	title := day.Date
+	if t, err := time.ParseInLocation("2006-01-02", day.Date, time.Local); err == nil {
+		title = t.Format("Monday, January 2, 2006")
+	}
+	return atomEntry{
+		ID:      h.publisher.URL("highlights/" + day.Date),
+		Title:   title,
+		Updated: day.Updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: link}},
+		Summary: summary,
+		Content: atomContent{Type: "html", Body: content.String()},
+	}, nil
+}
+
+func (h *Highlights) loadDays() ([]HighlightDay, error) {
+	data, err := os.ReadFile(h.stateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var days []HighlightDay
+	if err := json.Unmarshal(data, &days); err != nil {
+		return nil, fmt.Errorf("invalid highlights state in %s: %w", h.stateFile, err)
+	}
+	return days, nil
+}
+
+func (h *Highlights) saveDays(days []HighlightDay) error {
+	data, err := json.MarshalIndent(days, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := h.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.stateFile)
+}
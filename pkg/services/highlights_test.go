@@ -0,0 +1,185 @@
+package services
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"image"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNearestCapture(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 1504", "2023-06-30 "+hhmm, time.Local)
+		return t
+	}
+	metas := []*CaptureMeta{
+		{Time: at("0550")},
+		{},
+		{Time: at("0615")},
+		{Time: at("1200")},
+		{Time: at("2005")},
+		{Time: at("2020")},
+	}
+	tests := []struct {
+		name   string
+		metas  []*CaptureMeta
+		target time.Time
+		want   int
+	}{
+		{"nearest after", metas, at("0608"), 2},
+		{"nearest before", metas, at("0559"), 0},
+		{"before the first capture", metas, at("0400"), 0},
+		{"after the last capture", metas, at("2300"), 5},
+		{"between captures", metas, at("2010"), 4},
+		// a capture without a time is never picked
+		{"only untimed captures", []*CaptureMeta{{}, {}}, at("1200"), 0},
+		{"skips untimed", []*CaptureMeta{{}, {Time: at("1300")}}, at("1200"), 1},
+		// the earlier of two equally near captures
+		{"tie", []*CaptureMeta{{Time: at("1150")}, {Time: at("1210")}}, at("1200"), 0},
+	}
+	for _, tt := range tests {
+		if got := nearestCapture(tt.metas, tt.target); got != tt.want {
+			t.Errorf("%s: got capture %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// makeHighlightCapture creates a processed capture in dayDir at hhmm with a
+// 200 pixel wide image, the temperature and, if sunrise is set, the sun times
+// of a weather observation
+func makeHighlightCapture(t *testing.T, dayDir, hhmm string, temp float32, sunrise, sunset time.Time) {
+	t.Helper()
+	dir := path.Join(dayDir, hhmm)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	at, err := time.ParseInLocation("2006-01-02 1504", path.Base(dayDir)+" "+hhmm, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := CaptureMeta{Time: at, Temp: &temp, TempUnit: "C"}
+	if !sunrise.IsZero() {
+		meta.Weather = &Weather{Sys: SysSection{Sunrise: sunrise.Unix(), Sunset: sunset.Unix()}}
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, captureMetaFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveJPEG(path.Join(dir, "final.jpg"), image.NewRGBA(image.Rect(0, 0, 200, 100)), 85); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestHighlights(t *testing.T, entries int) (*Highlights, string) {
+	t.Helper()
+	log, _ := fakeAWS(t)
+	p := newTestPublisher(t)
+	p.baseURL = "https://cdn.example.com/"
+	h, err := NewHighlightsService(map[string]interface{}{
+		"home_dir": t.TempDir(),
+		"highlights": map[string]interface{}{
+			"enabled":     true,
+			"title":       "Test highlights",
+			"entries":     int64(entries),
+			"image_width": int64(100),
+		},
+	}, p.errChan, &Timelapse{}, &Archive{}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, log
+}
+
+func TestHighlightsDayEnd(t *testing.T) {
+	h, log := newTestHighlights(t, 2)
+	base := t.TempDir()
+	sun := func(date, hhmm string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 1504", date+" "+hhmm, time.Local)
+		return t
+	}
+	date := "2023-06-30"
+	dayDir := path.Join(base, date)
+	rise, set := sun(date, "0540"), sun(date, "2105")
+	for hhmm, temp := range map[string]float32{"0500": 12, "0545": 12.5, "1400": 24.5, "2100": 18, "2130": 16} {
+		makeHighlightCapture(t, dayDir, hhmm, temp, rise, set)
+	}
+	if err := h.DayEnd(date, dayDir); err != nil {
+		t.Fatal(err)
+	}
+
+	days, err := h.loadDays()
+	if err != nil || len(days) != 1 {
+		t.Fatalf("saved days %v, %v", days, err)
+	}
+	day := days[0]
+	// the frames nearest the observed sun times are picked
+	if day.Sunrise == nil || !day.Sunrise.Time.Equal(sun(date, "0545")) {
+		t.Errorf("sunrise frame %+v, want the 05:45 capture", day.Sunrise)
+	}
+	if day.Sunset == nil || !day.Sunset.Time.Equal(sun(date, "2100")) {
+		t.Errorf("sunset frame %+v, want the 21:00 capture", day.Sunset)
+	}
+	if day.Sunrise.URL != "https://cdn.example.com/highlights/2023-06-30/sunrise.jpg" {
+		t.Errorf("sunrise frame URL %s", day.Sunrise.URL)
+	}
+	if day.Captures != 5 || *day.High != 24.5 || *day.Low != 12 || day.TempUnit != "C" {
+		t.Errorf("day %+v with high %v and low %v", day, *day.High, *day.Low)
+	}
+	// the frames are scaled down to image_width
+	frame, err := loadJPEG(path.Join(dayDir, "0545", "highlight-sunrise.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := frame.Bounds().Dx(); w != 100 {
+		t.Errorf("sunrise frame is %d wide, want 100", w)
+	}
+	bucketObject(t, log, "highlights/2023-06-30/sunset.jpg")
+
+	var feed atomFeed
+	if err := xml.Unmarshal([]byte(bucketObject(t, log, "highlights.atom")), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if feed.Title != "Test highlights" || len(feed.Entries) != 1 || feed.Entries[0].Title != "Friday, June 30, 2023" {
+		t.Fatalf("feed %+v", feed)
+	}
+	if s := feed.Entries[0].Summary; s != "High 24.5°C, low 12.0°C; 5 captures" {
+		t.Errorf("entry summary %q", s)
+	}
+	if c := feed.Entries[0].Content.Body; !strings.Contains(c, "Sunrise, 05:45") || !strings.Contains(c, "Sunset, 21:00") {
+		t.Errorf("entry content %q", c)
+	}
+
+	// without sun times the first and last captures stand in, and only
+	// the newest entries are kept
+	for _, date := range []string{"2023-06-28", "2023-07-01"} {
+		dayDir := path.Join(base, date)
+		for _, hhmm := range []string{"0600", "1200", "1800"} {
+			makeHighlightCapture(t, dayDir, hhmm, 20, time.Time{}, time.Time{})
+		}
+		if err := h.DayEnd(date, dayDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	days, err = h.loadDays()
+	if err != nil || len(days) != 2 || days[0].Date != "2023-07-01" || days[1].Date != "2023-06-30" {
+		t.Fatalf("saved days %v, %v; want the two newest", days, err)
+	}
+	if !days[0].Sunrise.Time.Equal(sun("2023-07-01", "0600")) || !days[0].Sunset.Time.Equal(sun("2023-07-01", "1800")) {
+		t.Errorf("frames without sun times %+v, %+v", days[0].Sunrise, days[0].Sunset)
+	}
+
+	// running a day again replaces its entry
+	if err := h.DayEnd(date, dayDir); err != nil {
+		t.Fatal(err)
+	}
+	if days, err := h.loadDays(); err != nil || len(days) != 2 {
+		t.Errorf("saved days %v, %v after running a day again", days, err)
+	}
+}
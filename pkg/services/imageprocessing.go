@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
 	"path"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/estesp/onimage/pkg/metrics"
 	"github.com/estesp/onimage/pkg/util"
 	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
@@ -17,15 +20,87 @@ import (
 
 type ImageProcessor struct {
 	imagesBaseDir  string
-	s3bucket       string
 	siteText       string
 	runtime        string
 	opencv2Image   string
 	frequency      time.Duration
 	todayService   *Today
 	weatherService *WeatherData
+	publisher      *Publisher
+	derivatives    *derivativeConfig
+	dayEndFuncs    []dayEndEntry
+	processedFuncs []processedEntry
+	publishedFuncs []publishedEntry
+	analyzedFuncs  []processedEntry
 	watcher        *fsnotify.Watcher
 	errChan        chan error
+
+	// captures ready for processing, whether found by the watcher or
+	// handed over directly by an ingest source
+	readyDirs  chan string
+	queueLock  sync.Mutex
+	queuedDirs map[string]struct{}
+
+	// pipeline state reported by the status endpoint
+	statusLock    sync.Mutex
+	queued        int32
+	lastCapture   string
+	lastProcessed time.Time
+	stepTimes     map[string]time.Duration
+	lastPublish   *PublishResult
+}
+
+// DayEndFunc is run once a day has rolled over with the date and directory
+// holding that day's capture directories
+type DayEndFunc func(date, dayDir string) error
+
+type dayEndEntry struct {
+	name string
+	fn   DayEndFunc
+}
+
+// ProcessedFunc is run with the capture directory of each image after it
+// has been processed and published
+type ProcessedFunc func(dir string) error
+
+type processedEntry struct {
+	name string
+	fn   ProcessedFunc
+}
+
+// PublishedImage describes a processed capture whose image has just been
+// published to the website
+type PublishedImage struct {
+	Dir  string
+	Time time.Time
+	// Keys maps each published derivative name to its key in the bucket.
+	// Immutable keys are unique to the image; otherwise the keys are
+	// overwritten by every image
+	Keys      map[string]string
+	Immutable bool
+}
+
+// URL returns the public URL of the named derivative; URLs of keys that
+// are overwritten get a version parameter so that they change with every
+// image and are never served from a stale cache
+func (img PublishedImage) URL(publisher *Publisher, name string) (string, bool) {
+	key, ok := img.Keys[name]
+	if !ok {
+		return "", false
+	}
+	if img.Immutable {
+		return publisher.URL(key), true
+	}
+	return fmt.Sprintf("%s?v=%d", publisher.URL(key), img.Time.Unix()), true
+}
+
+// PublishedFunc is called after each image is published; it should return
+// quickly as it runs as part of the processing pipeline
+type PublishedFunc func(img PublishedImage)
+
+type publishedEntry struct {
+	name string
+	fn   PublishedFunc
 }
 
 type ColorJson struct {
@@ -39,22 +114,21 @@ type ColorJson struct {
 var (
 	replaceNNNN = regexp.MustCompile(`NNNN`)
 
-	enfuseCmd = []string{"enfuse", "-o", "prefinal.jpg", "01.jpg", "02.jpg", "03.jpg", "04.jpg", "05.jpg"}
+	enfuseCmd = []string{"enfuse", "-o", "prefinal.jpg"}
+
+	frameRegex = regexp.MustCompile(`^\d{2}\.jpg$`)
 
 	overlayCmd = []string{"convert", "prefinal.jpg", "-pointsize", "36",
 		"-draw", "gravity southwest fill white text 20,20 'NNNN' ",
 		"-draw", "gravity southeast fill white text 20,20 'NNNN' ", "-pointsize", "28",
 		"-draw", "gravity south fill white text 0,20 'NNNN' ", "final.jpg"}
 
-	awscpCmd = []string{"aws", "s3", "cp", "SOMEFILE", "BUCKETNAME", "--acl", "public-read",
-		"--metadata-directive", "REPLACE", "--expires"}
-
 	assessDarkCmd = []string{"sudo", "ctr", "run", "--rm", "--mount", "type=bind,src=NNNN,dst=/mnt,options=rbind:ro",
 		"docker.io/estesp/opencv2:4.8.0", "ocv2", "python", "color_percents.py", "/mnt/final.jpg"}
 	assessDarkCmdDocker = []string{"docker", "run", "--rm", "-v", "NNNN:/mnt", "estesp/opencv2:4.8.0", "/mnt/final.jpg"}
 )
 
-func NewImageProcessingService(config map[string]interface{}, errChan chan error, todayService *Today, weatherService *WeatherData) (*ImageProcessor, error) {
+func NewImageProcessingService(config map[string]interface{}, errChan chan error, todayService *Today, weatherService *WeatherData, publisher *Publisher) (*ImageProcessor, error) {
 	baseDir, err := util.GetStringFromConfig(config, "images.directory")
 	if err != nil {
 		return nil, fmt.Errorf("can't retrieve entry 'images.directory' from config: %w", err)
@@ -73,29 +147,34 @@ func NewImageProcessingService(config map[string]interface{}, errChan chan error
 	if err != nil {
 		return nil, fmt.Errorf("can't retrieve entry 'images.photo_frequency' from config: %w", err)
 	}
-	s3bucketName, err := util.GetStringFromConfig(config, "website.bucket")
-	if err != nil {
-		return nil, fmt.Errorf("can't retrieve entry 'website.bucket' from config: %w", err)
+	if freq <= 0 {
+		return nil, fmt.Errorf("invalid 'images.photo_frequency' %d; must be a positive number of minutes", freq)
 	}
 	opencv2ImgRef, err := util.GetStringFromConfig(config, "images.opencv2_image")
 	if err != nil {
 		return nil, fmt.Errorf("can't retrieve entry 'images.opencv2_image' from config: %w", err)
 	}
+	derivatives, err := getDerivativeConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'derivatives' config: %w", err)
+	}
+	metrics.WatchDiskFree(baseDir, util.DiskFree)
 
-	// set up the proper bucket based on the config settings
-	awscpCmd[4] = fmt.Sprintf("s3://%s/latest.jpg", s3bucketName)
 	overlayCmd[11] = replaceNNNN.ReplaceAllLiteralString(overlayCmd[11], siteText)
 
 	return &ImageProcessor{
 		todayService:   todayService,
 		weatherService: weatherService,
+		publisher:      publisher,
+		derivatives:    derivatives,
 		imagesBaseDir:  baseDir,
 		siteText:       siteText,
 		frequency:      time.Duration(freq) * time.Minute,
-		s3bucket:       s3bucketName,
 		errChan:        errChan,
 		runtime:        runtime,
 		opencv2Image:   opencv2ImgRef,
+		readyDirs:      make(chan string, 64),
+		queuedDirs:     map[string]struct{}{},
 	}, nil
 }
 
@@ -103,6 +182,30 @@ func (ip *ImageProcessor) DateChangeNotifier(notifier chan string) {
 	go ip.watchDate(notifier)
 }
 
+// OnProcessed registers a step to run after each captured image has been
+// processed and published; steps run sequentially in registration order
+func (ip *ImageProcessor) OnProcessed(name string, fn ProcessedFunc) {
+	ip.processedFuncs = append(ip.processedFuncs, processedEntry{name: name, fn: fn})
+}
+
+// OnPublished registers a hook to be notified each time an image has been
+// published, e.g. to push it to connected browsers
+func (ip *ImageProcessor) OnPublished(name string, fn PublishedFunc) {
+	ip.publishedFuncs = append(ip.publishedFuncs, publishedEntry{name: name, fn: fn})
+}
+
+// OnAnalyzed registers a step to run after the exposure and color analysis
+// of each image, which completes some time after the image is published
+func (ip *ImageProcessor) OnAnalyzed(name string, fn ProcessedFunc) {
+	ip.analyzedFuncs = append(ip.analyzedFuncs, processedEntry{name: name, fn: fn})
+}
+
+// OnDayEnd registers a step to run against the previous day's captures after
+// the date changes; steps run sequentially in the order they are registered
+func (ip *ImageProcessor) OnDayEnd(name string, fn DayEndFunc) {
+	ip.dayEndFuncs = append(ip.dayEndFuncs, dayEndEntry{name: name, fn: fn})
+}
+
 func (ip *ImageProcessor) StartImageHandler() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -125,8 +228,12 @@ func (ip *ImageProcessor) StartImageHandler() {
 }
 
 func (ip *ImageProcessor) watchDate(notifier chan string) {
+	prevDir := ip.getImageDir()
 	for {
 		newDate := <-notifier
+		go ip.finishDay(prevDir)
+		ip.forgetQueued(prevDir)
+		prevDir = ip.getImageDir()
 		logrus.Infof("New day %s; changing current watch folder to: %s\n", newDate, ip.getImageDir())
 		if err := os.Mkdir(ip.getImageDir(), os.FileMode(0755)); err != nil {
 			if !os.IsExist(err) {
@@ -147,37 +254,186 @@ func (ip *ImageProcessor) watchDate(notifier chan string) {
 	}
 }
 
+func (ip *ImageProcessor) finishDay(dayDir string) {
+	date := path.Base(dayDir)
+	for _, step := range ip.dayEndFuncs {
+		logrus.Infof("Running end of day step '%s' for %s", step.name, date)
+		if err := step.fn(date, dayDir); err != nil {
+			ip.errChan <- fmt.Errorf("end of day step '%s' failed for %s: %w", step.name, date, err)
+			logrus.Errorf("end of day step '%s' failed for %s: %v", step.name, date, err)
+		}
+	}
+}
+
+// Enqueue queues a complete capture directory for processing; it returns
+// false if the directory has already been queued
+func (ip *ImageProcessor) Enqueue(dir string) bool {
+	dir = path.Clean(dir)
+	ip.queueLock.Lock()
+	if _, ok := ip.queuedDirs[dir]; ok {
+		ip.queueLock.Unlock()
+		return false
+	}
+	ip.queuedDirs[dir] = struct{}{}
+	ip.queueLock.Unlock()
+
+	atomic.AddInt32(&ip.queued, 1)
+	ip.readyDirs <- dir
+	return true
+}
+
+// forgetQueued drops the record of queued captures from a finished day
+func (ip *ImageProcessor) forgetQueued(dayDir string) {
+	ip.queueLock.Lock()
+	defer ip.queueLock.Unlock()
+	for dir := range ip.queuedDirs {
+		if path.Dir(dir) == path.Clean(dayDir) {
+			delete(ip.queuedDirs, dir)
+		}
+	}
+}
+
 func (ip *ImageProcessor) processImages() {
 	newDirs := make(chan string)
-	readyDirs := make(chan string)
 	tempUnit := "F"
 	if ip.weatherService.units == "metric" {
 		tempUnit = "C"
 	}
 	go listen(ip.watcher, newDirs)
-	go handleNewDirs(newDirs, readyDirs)
+	go ip.handleNewDirs(newDirs)
 
 	for {
-		dir := <-readyDirs
+		dir := <-ip.readyDirs
+		ip.startCapture(dir)
 		// create final image (enfuse)
-		ip.enfuseImages(dir)
+		ip.timeStep(dir, "enfuse", func() { ip.enfuseImages(dir) })
 		// overlay text: date/time, temp
-		ip.overlayImage(dir, tempUnit)
+		ip.timeStep(dir, "overlay", func() { ip.overlayImage(dir, tempUnit) })
 		// copy latest to S3 bucket for kwcam.live
-		ip.copyImagetoS3(dir)
+		ip.timeStep(dir, "publish", func() { ip.copyImagetoS3(dir) })
+		// run any additional per-image steps
+		for _, step := range ip.processedFuncs {
+			ip.timeStep(dir, step.name, func() {
+				if err := step.fn(dir); err != nil {
+					ip.errChan <- fmt.Errorf("processing step '%s' failed for %s: %w", step.name, dir, err)
+					logrus.Errorf("processing step '%s' failed for %s: %v", step.name, dir, err)
+				}
+			})
+		}
+		atomic.AddInt32(&ip.queued, -1)
 		// assess percent dark in image; run as goroutine since it can take 30s to run
 		// and only sets a data point in the today service to determine whether to continue
 		// taking photos after twilight
-		go ip.assessDarkPercent(dir)
+		go func() {
+			ip.timeStep(dir, "exposure", func() { ip.assessExposure(dir) })
+			ip.timeStep(dir, "analysis", func() { ip.assessDarkPercent(dir) })
+			for _, step := range ip.analyzedFuncs {
+				if err := step.fn(dir); err != nil {
+					ip.errChan <- fmt.Errorf("analysis step '%s' failed for %s: %w", step.name, dir, err)
+					logrus.Errorf("analysis step '%s' failed for %s: %v", step.name, dir, err)
+				}
+			}
+		}()
 	}
 }
 
+func (ip *ImageProcessor) startCapture(dir string) {
+	ip.statusLock.Lock()
+	defer ip.statusLock.Unlock()
+	ip.lastCapture = dir
+	ip.lastProcessed = time.Now()
+	ip.stepTimes = map[string]time.Duration{}
+}
+
+// timeStep runs a pipeline step and records its duration against the
+// capture it was run for
+func (ip *ImageProcessor) timeStep(dir, name string, step func()) {
+	start := time.Now()
+	step()
+	metrics.StepDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	ip.statusLock.Lock()
+	defer ip.statusLock.Unlock()
+	if ip.lastCapture == dir {
+		ip.stepTimes[name] = time.Since(start)
+	}
+}
+
+// Status returns a snapshot of the state of the processing pipeline
+func (ip *ImageProcessor) Status() ProcessorStatus {
+	ip.statusLock.Lock()
+	defer ip.statusLock.Unlock()
+	status := ProcessorStatus{
+		WatchedDir:    ip.getImageDir(),
+		WatcherActive: ip.WatcherActive(),
+		QueueDepth:    int(atomic.LoadInt32(&ip.queued)),
+		LastCapture:   ip.lastCapture,
+		LastPublish:   ip.lastPublish,
+		Outbox:        ip.publisher.OutboxStatus(),
+	}
+	if !ip.lastProcessed.IsZero() {
+		processed := ip.lastProcessed
+		status.LastProcessed = &processed
+		status.StepSeconds = map[string]float64{}
+		for name, d := range ip.stepTimes {
+			status.StepSeconds[name] = d.Seconds()
+		}
+	}
+	return status
+}
+
+// WatcherActive reports whether the filesystem watcher has been started and
+// is watching a capture directory
+func (ip *ImageProcessor) WatcherActive() bool {
+	return ip.watcher != nil && len(ip.watcher.WatchList()) > 0
+}
+
+// Frequency returns the configured interval between captures
+func (ip *ImageProcessor) Frequency() time.Duration {
+	return ip.frequency
+}
+
+// ImageBaseDir returns the directory holding the dated capture directories
+func (ip *ImageProcessor) ImageBaseDir() string {
+	return ip.imagesBaseDir
+}
+
+// ImageDir returns the directory currently being watched for new captures
+func (ip *ImageProcessor) ImageDir() string {
+	return ip.getImageDir()
+}
+
 func (ip *ImageProcessor) getImageDir() string {
 	return fmt.Sprintf("%s/%s", ip.imagesBaseDir, ip.todayService.GetDate())
 }
 
 func (ip *ImageProcessor) enfuseImages(dir string) {
-	out, err := util.RunCommand(dir, enfuseCmd)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		ip.errChan <- err
+		logrus.Errorf("Error reading capture directory %s: %v", dir, err)
+		return
+	}
+	cmd := append([]string{}, enfuseCmd...)
+	for _, e := range entries {
+		if frameRegex.MatchString(e.Name()) {
+			cmd = append(cmd, e.Name())
+		}
+	}
+	switch len(cmd) - len(enfuseCmd) {
+	case 0:
+		err = fmt.Errorf("no frames found in %s", dir)
+		ip.errChan <- err
+		logrus.Errorf("Error fusing images: %v", err)
+		return
+	case 1:
+		// a single frame (e.g. from a camera without bracketing) needs no fusing
+		if err := copyFile(path.Join(dir, cmd[len(cmd)-1]), path.Join(dir, "prefinal.jpg"), 0644); err != nil {
+			ip.errChan <- err
+			logrus.Errorf("Error copying single frame in %s: %v", dir, err)
+		}
+		return
+	}
+	out, err := util.RunCommand("enfuse", dir, cmd)
 	if err != nil {
 		ip.errChan <- err
 		logrus.Errorf("Error calling enfuse on %s: %v", dir, err)
@@ -186,11 +442,25 @@ func (ip *ImageProcessor) enfuseImages(dir string) {
 }
 
 func (ip *ImageProcessor) overlayImage(dir string, tempUnit string) {
-	tempStr, err := ip.weatherService.GetCurrentTempStr()
+	tempStr := ""
+	weather, err := ip.weatherService.GetCurrentWeather()
 	if err != nil {
 		ip.errChan <- fmt.Errorf("can't retrieve temp: %w", err)
 		logrus.Errorf("can't get temp: %v", err)
-		tempStr = ""
+	} else {
+		tempStr = fmt.Sprintf("%2.1f", weather.Main.Temp)
+		metrics.Temperature.Set(float64(weather.Main.Temp))
+	}
+	// keep the observation with the capture for later pipeline steps
+	err = updateCaptureMeta(dir, func(meta *CaptureMeta) {
+		if weather != nil {
+			meta.Temp = &weather.Main.Temp
+			meta.TempUnit = tempUnit
+			meta.Weather = weather
+		}
+	})
+	if err != nil {
+		logrus.Errorf("unable to record capture metadata for %s: %v", dir, err)
 	}
 	tempStr = fmt.Sprintf("%s°%s", tempStr, tempUnit)
 	timeStr := util.DatetimeFromDir(dir)
@@ -200,7 +470,7 @@ func (ip *ImageProcessor) overlayImage(dir string, tempUnit string) {
 	copy(overlayCmdCopy, overlayCmd)
 	overlayCmdCopy[5] = replaceNNNN.ReplaceAllLiteralString(overlayCmdCopy[5], timeStr)
 	overlayCmdCopy[7] = replaceNNNN.ReplaceAllLiteralString(overlayCmdCopy[7], tempStr)
-	out, err := util.RunCommand(dir, overlayCmdCopy)
+	out, err := util.RunCommand("overlay", dir, overlayCmdCopy)
 	if err != nil {
 		ip.errChan <- err
 		logrus.Errorf("Error calling convert on %s: %v", dir, err)
@@ -209,13 +479,59 @@ func (ip *ImageProcessor) overlayImage(dir string, tempUnit string) {
 }
 
 func (ip *ImageProcessor) copyImagetoS3(dir string) {
-	expiresTime := time.Now().Add(ip.frequency).UTC()
-	awscpCmd[3] = path.Join(dir, "final.jpg")
-	out, err := util.RunCommand(ip.todayService.GetHomeDirectory(), append(awscpCmd, expiresTime.Format(http.TimeFormat)))
+	files, fullWidth, err := ip.derivatives.generate(dir)
 	if err != nil {
 		ip.errChan <- err
-		logrus.Errorf("Error calling aws cp on %s: %v", dir, err)
-		logrus.Errorf("Full output: %s", out)
+		logrus.Errorf("Error creating image derivatives for %s: %v", dir, err)
+		return
+	}
+	ip.todayService.SetImageWidth(fullWidth)
+
+	// every size shares the same cache headers so that they all expire when
+	// the next image is published; immutable keys are never overwritten so
+	// they can be cached for good
+	expiresTime := time.Now().Add(ip.frequency)
+	opts := PublishOptions{
+		ContentType:  "image/jpeg",
+		CacheControl: fmt.Sprintf("public, max-age=%d", int(ip.frequency.Seconds())),
+		Expires:      expiresTime,
+	}
+	if ip.derivatives.immutable {
+		opts = PublishOptions{ContentType: "image/jpeg", CacheControl: immutableCache}
+	}
+	result := &PublishResult{Time: time.Now()}
+	keys := map[string]string{}
+	for _, d := range ip.derivatives.sizes {
+		key, err := ip.derivatives.key(dir, d, files[d.Name])
+		if err != nil {
+			ip.errChan <- err
+			result.Error = err.Error()
+			continue
+		}
+		if err := ip.publisher.Publish(files[d.Name], key, opts); err != nil {
+			ip.errChan <- err
+			result.Error = err.Error()
+			continue
+		}
+		result.Keys = append(result.Keys, key)
+		keys[d.Name] = key
+	}
+	ip.statusLock.Lock()
+	ip.lastPublish = result
+	ip.statusLock.Unlock()
+	if result.Error != "" {
+		return
+	}
+
+	// the hooks only run once every size is uploaded, so the pages and
+	// feeds that point at the new keys never reference a missing image
+	published := PublishedImage{Dir: dir, Time: time.Now(), Keys: keys, Immutable: ip.derivatives.immutable}
+	if meta, err := loadCaptureMeta(dir); err == nil && !meta.Time.IsZero() {
+		published.Time = meta.Time
+	}
+	for _, hook := range ip.publishedFuncs {
+		logrus.Debugf("Notifying %s of published image %s", hook.name, dir)
+		hook.fn(published)
 	}
 }
 
@@ -231,7 +547,7 @@ func (ip *ImageProcessor) assessDarkPercent(dir string) {
 		assessCmdCopy = getDockerCmd(dir, ip.opencv2Image)
 	}
 
-	out, err := util.RunCommand(dir, assessCmdCopy)
+	out, err := util.RunCommand("analysis", dir, assessCmdCopy)
 	if err != nil {
 		ip.errChan <- err
 		logrus.Errorf("Error calling opencv2 container on %s: %v", dir, err)
@@ -251,6 +567,37 @@ func (ip *ImageProcessor) assessDarkPercent(dir string) {
 	ip.todayService.SetDarkPercent(colorJson.BlackPercent)
 }
 
+// listCaptures returns the capture directories under dayDir that have a
+// processed final.jpg, in capture time order
+func listCaptures(dayDir string) ([]string, error) {
+	entries, err := os.ReadDir(dayDir)
+	if err != nil {
+		return nil, err
+	}
+	var captures []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		capDir := path.Join(dayDir, e.Name())
+		if _, err := os.Stat(path.Join(capDir, "final.jpg")); err == nil {
+			captures = append(captures, capDir)
+		}
+	}
+	// os.ReadDir returns entries sorted by name and capture directories are
+	// named HHMM, so no further sorting is needed
+	return captures, nil
+}
+
+// captureTime returns the local time of a capture from its
+// <date>/<HHMM> directory path
+func captureTime(dir string) (time.Time, error) {
+	if len(path.Base(dir)) < 4 {
+		return time.Time{}, fmt.Errorf("capture directory %s is not named HHMM", dir)
+	}
+	return time.ParseInLocation("2006-01-02/1504", path.Join(path.Base(path.Dir(dir)), path.Base(dir)[:4]), time.Local)
+}
+
 func listen(w *fsnotify.Watcher, newDirs chan string) {
 	for {
 		e := <-w.Events
@@ -259,7 +606,7 @@ func listen(w *fsnotify.Watcher, newDirs chan string) {
 			fi, err := os.Stat(e.Name)
 			if err != nil {
 				logrus.Errorf("unable to stat %s: %v", e.Name, err)
-				return
+				continue
 			}
 			if fi.IsDir() {
 				newDirs <- e.Name
@@ -268,15 +615,18 @@ func listen(w *fsnotify.Watcher, newDirs chan string) {
 	}
 }
 
-func handleNewDirs(newDirs chan string, readyDir chan string) {
+func (ip *ImageProcessor) handleNewDirs(newDirs chan string) {
 	for {
 		dir := <-newDirs
+		metrics.CapturesDetected.Inc()
 		doneFile := fmt.Sprintf("%s/done.txt", dir)
 		err := waitForDone(doneFile, 15*time.Second)
 		if err == nil {
-			logrus.Infof("Ready for processing: %s", dir)
-			readyDir <- dir
+			if ip.Enqueue(dir) {
+				logrus.Infof("Ready for processing: %s", dir)
+			}
 		} else {
+			metrics.ReadinessTimeouts.Inc()
 			logrus.Errorf("timed out waiting for %s/done.txt", dir)
 		}
 	}
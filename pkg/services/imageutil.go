@@ -0,0 +1,136 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+func loadJPEG(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+func saveJPEG(file string, img image.Image, quality int) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: quality}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadPNG(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func savePNG(file string, img image.Image) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// resizeImage scales img to fit within width x height while keeping the
+// aspect ratio; a zero dimension is calculated from the other one
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	b := img.Bounds()
+	if width == 0 && height == 0 {
+		width, height = b.Dx(), b.Dy()
+	} else if width == 0 || (height != 0 && b.Dx()*height < b.Dy()*width) {
+		width = b.Dx() * height / b.Dy()
+	} else {
+		height = b.Dy() * width / b.Dx()
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// luminance returns the Rec. 601 luma (0-255) of a color
+func luminance(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
+
+// meanLuminance samples img on a coarse grid to estimate its mean luma
+func meanLuminance(img image.Image) float64 {
+	b := img.Bounds()
+	step := b.Dx() / 200
+	if step < 1 {
+		step = 1
+	}
+	var sum float64
+	var n int
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			sum += luminance(img.At(x, y))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// scaleBrightness returns a copy of img with each channel multiplied by gain
+func scaleBrightness(img image.Image, gain float64) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	if gain == 1.0 {
+		return dst
+	}
+	for i := 0; i < len(dst.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			v := float64(dst.Pix[i+c]) * gain
+			if v > 255 {
+				v = 255
+			}
+			dst.Pix[i+c] = uint8(v)
+		}
+	}
+	return dst
+}
+
+// drawLabel writes text onto img with its baseline starting at (x, y) using
+// a small fixed-width font
+func drawLabel(img draw.Image, x, y int, text string, c color.Color) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+// labelWidth returns the width in pixels of text drawn with drawLabel
+func labelWidth(text string) int {
+	return font.MeasureString(basicfont.Face7x13, text).Ceil()
+}
@@ -0,0 +1,342 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/metrics"
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ingestKeysDir     = ".ingest-keys"
+	idempotencyKeyTTL = 24 * time.Hour
+	maxManifestBytes  = 64 * 1024
+	// how far a manifest time may be in the future, or before today
+	maxManifestSkew = 5 * time.Minute
+)
+
+var jpegMagic = []byte{0xff, 0xd8, 0xff}
+
+// Ingest accepts captures uploaded over HTTP so that the camera does not
+// need to share a filesystem with the processor
+type Ingest struct {
+	enabled        bool
+	maxUploadBytes int64
+	maxFrames      int
+	keysDir        string
+	imageProcessor *ImageProcessor
+	errChan        chan error
+	// guards the idempotency keys, both those recorded on disk and those of
+	// the uploads in progress
+	lock    sync.Mutex
+	pending map[string]bool
+}
+
+// captureManifest is the optional "manifest" part of an upload
+type captureManifest struct {
+	Time    *time.Time `json:"time,omitempty"`
+	EVShift *float64   `json:"ev_shift,omitempty"`
+}
+
+type ingestResponse struct {
+	Capture   string `json:"capture"`
+	Frames    int    `json:"frames"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+func NewIngestService(config map[string]interface{}, errChan chan error, imageProcessor *ImageProcessor) (*Ingest, error) {
+	enabled, err := util.GetBoolFromConfig(config, "ingest.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Ingest{}, nil
+	}
+	maxMB, err := util.GetIntFromConfig(config, "ingest.max_upload_mb")
+	if err != nil || maxMB <= 0 {
+		maxMB = 100
+	}
+	maxFrames, err := util.GetIntFromConfig(config, "ingest.max_frames")
+	if err != nil || maxFrames <= 0 {
+		maxFrames = 9
+	}
+	if maxFrames > 99 {
+		return nil, fmt.Errorf("invalid 'ingest.max_frames' %d; must be at most 99", maxFrames)
+	}
+	keysDir := path.Join(imageProcessor.ImageBaseDir(), ingestKeysDir)
+	if err := os.MkdirAll(keysDir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create idempotency key directory: %w", err)
+	}
+	return &Ingest{
+		enabled:        true,
+		maxUploadBytes: maxMB * 1024 * 1024,
+		maxFrames:      int(maxFrames),
+		keysDir:        keysDir,
+		imageProcessor: imageProcessor,
+		errChan:        errChan,
+		pending:        map[string]bool{},
+	}, nil
+}
+
+// Register adds the POST /captures upload handler to the endpoint server;
+// uploads are only accepted from configured clients
+func (in *Ingest) Register(we *WebEndpoint) error {
+	if !in.enabled {
+		return nil
+	}
+	return we.HandlePrivate("/captures", in, in.maxUploadBytes)
+}
+
+// ServeHTTP accepts a multipart upload of one or more "frame" JPEG parts,
+// stored as 01.jpg, 02.jpg, ... in upload order, and an optional JSON
+// "manifest" part. A retried upload with the same Idempotency-Key header
+// returns the original capture rather than processing it again
+func (in *Ingest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		// keys are chosen by the clients, so each client has its own
+		key = ClientName(r) + "\n" + key
+		dir, frames, ok, reserved := in.reserveKey(key)
+		if ok {
+			in.respondDuplicate(w, dir, frames)
+			return
+		}
+		if !reserved {
+			in.fail(w, http.StatusConflict, fmt.Errorf("an upload with the same idempotency key is in progress"))
+			return
+		}
+		defer in.releaseKey(key)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, in.maxUploadBytes)
+	staging, err := in.imageProcessor.NewStagingDir()
+	if err != nil {
+		in.fail(w, http.StatusInternalServerError, fmt.Errorf("unable to create staging directory: %w", err))
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	manifest, frames, status, err := in.receive(r, staging)
+	if err != nil {
+		in.fail(w, status, err)
+		return
+	}
+	now := time.Now()
+	meta := CaptureMeta{Time: now, Source: "upload:" + ClientName(r), EVShift: manifest.EVShift}
+	if manifest.Time != nil {
+		meta.Time = manifest.Time.Local()
+		// the time decides the capture directory, so it must be today's
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		if meta.Time.Before(midnight.Add(-maxManifestSkew)) || meta.Time.After(now.Add(maxManifestSkew)) {
+			in.fail(w, http.StatusBadRequest, fmt.Errorf("manifest time %s is not today", manifest.Time.Format(time.RFC3339)))
+			return
+		}
+	}
+
+	dir, err := in.imageProcessor.CommitCapture(staging, meta)
+	if err != nil {
+		in.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	committed = true
+	rel := strings.TrimPrefix(dir, path.Clean(in.imageProcessor.ImageBaseDir())+"/")
+	if key != "" {
+		in.lock.Lock()
+		err := in.storeKey(key, rel, frames)
+		in.lock.Unlock()
+		if err != nil {
+			logrus.Errorf("unable to record idempotency key for %s: %v", rel, err)
+		}
+	}
+	metrics.CaptureUploads.WithLabelValues("accepted").Inc()
+	logrus.Infof("Received capture %s with %d frames from %s", rel, frames, ClientName(r))
+	writeJSON(w, http.StatusCreated, ingestResponse{Capture: rel, Frames: frames})
+}
+
+// reserveKey returns the capture recorded for an idempotency key, or
+// reserves the key for an upload if there is none; it reports false for
+// reserved if another upload with the key is still being received
+func (in *Ingest) reserveKey(key string) (dir string, frames int, ok bool, reserved bool) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if dir, frames, ok := in.lookupKey(key); ok {
+		return dir, frames, true, false
+	}
+	if in.pending[key] {
+		return "", 0, false, false
+	}
+	in.pending[key] = true
+	return "", 0, false, true
+}
+
+func (in *Ingest) releaseKey(key string) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	delete(in.pending, key)
+}
+
+// receive streams the parts of the upload into the staging directory and
+// returns the manifest and number of frames written, or the HTTP status and
+// error to report
+func (in *Ingest) receive(r *http.Request, staging string) (captureManifest, int, int, error) {
+	manifest := captureManifest{}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return manifest, 0, http.StatusBadRequest, fmt.Errorf("expected a multipart upload: %w", err)
+	}
+	frames := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, 0, uploadErrorStatus(err), fmt.Errorf("unable to read upload: %w", err)
+		}
+		switch part.FormName() {
+		case "frame":
+			if frames == in.maxFrames {
+				return manifest, 0, http.StatusBadRequest, fmt.Errorf("too many frames; at most %d are allowed", in.maxFrames)
+			}
+			frames++
+			if err := saveFrame(part, path.Join(staging, fmt.Sprintf("%02d.jpg", frames))); err != nil {
+				return manifest, 0, uploadErrorStatus(err), fmt.Errorf("frame %d: %w", frames, err)
+			}
+		case "manifest":
+			data, err := io.ReadAll(io.LimitReader(part, maxManifestBytes))
+			if err != nil {
+				return manifest, 0, uploadErrorStatus(err), fmt.Errorf("unable to read manifest: %w", err)
+			}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return manifest, 0, http.StatusBadRequest, fmt.Errorf("invalid manifest: %w", err)
+			}
+		default:
+			return manifest, 0, http.StatusBadRequest, fmt.Errorf("unexpected upload part %q", part.FormName())
+		}
+		part.Close()
+	}
+	if frames == 0 {
+		return manifest, 0, http.StatusBadRequest, fmt.Errorf("no frames in upload")
+	}
+	return manifest, frames, 0, nil
+}
+
+// saveFrame writes an uploaded frame to file after checking that it looks
+// like a JPEG
+func saveFrame(part io.Reader, file string) error {
+	magic := make([]byte, len(jpegMagic))
+	if _, err := io.ReadFull(part, magic); err != nil || !bytes.Equal(magic, jpegMagic) {
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return fmt.Errorf("not a JPEG image")
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.MultiReader(bytes.NewReader(magic), part)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func uploadErrorStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func (in *Ingest) fail(w http.ResponseWriter, status int, err error) {
+	metrics.CaptureUploads.WithLabelValues("rejected").Inc()
+	logrus.Warnf("Rejected capture upload: %v", err)
+	if status >= http.StatusInternalServerError {
+		in.errChan <- err
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (in *Ingest) respondDuplicate(w http.ResponseWriter, dir string, frames int) {
+	metrics.CaptureUploads.WithLabelValues("duplicate").Inc()
+	logrus.Infof("Ignoring repeated upload of capture %s", dir)
+	writeJSON(w, http.StatusOK, ingestResponse{Capture: dir, Frames: frames, Duplicate: true})
+}
+
+// idempotency keys are stored as files named by the hash of the client name
+// and key so that they survive restarts; each holds the capture it resulted
+// in. They must be accessed with the lock held
+
+type ingestKey struct {
+	Capture string `json:"capture"`
+	Frames  int    `json:"frames"`
+}
+
+func (in *Ingest) keyFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(in.keysDir, hex.EncodeToString(sum[:]))
+}
+
+func (in *Ingest) lookupKey(key string) (string, int, bool) {
+	file := in.keyFile(key)
+	info, err := os.Stat(file)
+	if err != nil || time.Since(info.ModTime()) > idempotencyKeyTTL {
+		return "", 0, false
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", 0, false
+	}
+	var k ingestKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return "", 0, false
+	}
+	return k.Capture, k.Frames, true
+}
+
+func (in *Ingest) storeKey(key, capture string, frames int) error {
+	in.expireKeys()
+	data, err := json.Marshal(ingestKey{Capture: capture, Frames: frames})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(in.keyFile(key), data, 0644)
+}
+
+func (in *Ingest) expireKeys() {
+	entries, err := os.ReadDir(in.keysDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err == nil && time.Since(info.ModTime()) > idempotencyKeyTTL {
+			os.Remove(path.Join(in.keysDir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIngest(t *testing.T, ip *ImageProcessor, maxMB, maxFrames int) *Ingest {
+	t.Helper()
+	in, err := NewIngestService(map[string]interface{}{
+		"ingest": map[string]interface{}{
+			"enabled":       true,
+			"max_upload_mb": int64(maxMB),
+			"max_frames":    int64(maxFrames),
+		},
+	}, make(chan error, 10), ip)
+	if err != nil {
+		t.Fatalf("NewIngestService: %v", err)
+	}
+	return in
+}
+
+// uploadPart is a part of a multipart capture upload
+type uploadPart struct {
+	name    string
+	content []byte
+}
+
+// uploadBody returns a multipart capture upload of parts and its content
+// type
+func uploadBody(t *testing.T, parts ...uploadPart) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		w, err := mw.CreateFormFile(p.name, p.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(p.content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+func manifestPart(t *testing.T, m map[string]interface{}) uploadPart {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uploadPart{"manifest", data}
+}
+
+// upload sends a capture upload from the "camera" client, with key as its
+// Idempotency-Key if set, through the endpoint server
+func upload(t *testing.T, we *WebEndpoint, key string, parts ...uploadPart) *httptest.ResponseRecorder {
+	t.Helper()
+	body, contentType := uploadBody(t, parts...)
+	r := httptest.NewRequest("POST", "/captures", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer camera-token")
+	r.Header.Set("Content-Type", contentType)
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	return serve(we, r)
+}
+
+func serve(we *WebEndpoint, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	logRequests(we.mux).ServeHTTP(w, r)
+	return w
+}
+
+// ingestEndpoint returns an endpoint server with in registered
+func ingestEndpoint(t *testing.T, in *Ingest) *WebEndpoint {
+	t.Helper()
+	we := &WebEndpoint{mux: http.NewServeMux(), auth: testAuth(t)}
+	if err := in.Register(we); err != nil {
+		t.Fatal(err)
+	}
+	return we
+}
+
+func checkUploadResponse(t *testing.T, w *httptest.ResponseRecorder, status int) ingestResponse {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	var resp ingestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body, err)
+	}
+	return resp
+}
+
+func TestIngestUpload(t *testing.T) {
+	ip := newTestProcessor(t)
+	we := ingestEndpoint(t, newTestIngest(t, ip, 1, 3))
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	w := upload(t, we, "",
+		uploadPart{"frame", testFrame(1)},
+		manifestPart(t, map[string]interface{}{"time": at.Format(time.RFC3339), "ev_shift": -1.5}),
+		uploadPart{"frame", testFrame(2)})
+	resp := checkUploadResponse(t, w, http.StatusCreated)
+	if resp.Frames != 2 || resp.Duplicate {
+		t.Errorf("response %+v", resp)
+	}
+
+	// the capture is committed to the watched directory, named by the
+	// manifest time
+	dir := nextCapture(t, ip, time.Second)
+	if want := path.Join(ip.imagesBaseDir, at.Format("2006-01-02"), at.Format("1504")); dir != want {
+		t.Errorf("committed %s, want %s", dir, want)
+	}
+	if want := path.Join(at.Format("2006-01-02"), at.Format("1504")); resp.Capture != want {
+		t.Errorf("response capture is %s, want %s", resp.Capture, want)
+	}
+	checkCapture(t, dir, [][]byte{testFrame(1), testFrame(2)}, "upload:camera")
+	data, err := os.ReadFile(path.Join(dir, captureMetaFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta CaptureMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Time.Equal(at) || meta.EVShift == nil || *meta.EVShift != -1.5 {
+		t.Errorf("capture metadata %+v", meta)
+	}
+	checkNoStaging(t, ip)
+}
+
+func TestIngestRejected(t *testing.T) {
+	ip := newTestProcessor(t)
+	we := ingestEndpoint(t, newTestIngest(t, ip, 1, 2))
+	frame := uploadPart{"frame", testFrame(1)}
+	tests := []struct {
+		name   string
+		parts  []uploadPart
+		status int
+	}{
+		{"no frames", nil, http.StatusBadRequest},
+		{"not a JPEG", []uploadPart{{"frame", []byte("GIF89a")}}, http.StatusBadRequest},
+		{"too many frames", []uploadPart{frame, frame, frame}, http.StatusBadRequest},
+		{"unexpected part", []uploadPart{frame, {"thumbnail", testFrame(2)}}, http.StatusBadRequest},
+		{"invalid manifest", []uploadPart{frame, {"manifest", []byte("{")}}, http.StatusBadRequest},
+		{"manifest time not a time", []uploadPart{frame, manifestPart(t, map[string]interface{}{"time": "noon"})}, http.StatusBadRequest},
+		{"manifest time yesterday", []uploadPart{frame, manifestPart(t, map[string]interface{}{
+			"time": time.Now().AddDate(0, 0, -1).Format(time.RFC3339)})}, http.StatusBadRequest},
+		{"manifest time in the future", []uploadPart{frame, manifestPart(t, map[string]interface{}{
+			"time": time.Now().Add(time.Hour).Format(time.RFC3339)})}, http.StatusBadRequest},
+		{"larger than max_upload_mb", []uploadPart{{"frame", append(testFrame(1), make([]byte, 1<<20)...)}},
+			http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if w := upload(t, we, "", tt.parts...); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	for _, tt := range []struct {
+		request *http.Request
+		status  int
+	}{
+		{httptest.NewRequest("GET", "/captures", nil), http.StatusMethodNotAllowed},
+		{httptest.NewRequest("POST", "/captures", strings.NewReader("frame")), http.StatusBadRequest},
+	} {
+		tt.request.Header.Set("Authorization", "Bearer camera-token")
+		if w := serve(we, tt.request); w.Code != tt.status {
+			t.Errorf("%s without a multipart body: status %d, want %d", tt.request.Method, w.Code, tt.status)
+		}
+	}
+	// uploads are only accepted from configured clients
+	body, contentType := uploadBody(t, frame)
+	r := httptest.NewRequest("POST", "/captures", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	if w := serve(we, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated upload: status %d", w.Code)
+	}
+
+	select {
+	case dir := <-ip.readyDirs:
+		t.Errorf("a rejected upload was committed as %s", dir)
+	default:
+	}
+	checkNoStaging(t, ip)
+	if fileExists(path.Join(ip.imagesBaseDir, time.Now().Format("2006-01-02"))) {
+		t.Errorf("rejected uploads created a capture directory")
+	}
+}
+
+func TestIngestIdempotency(t *testing.T) {
+	ip := newTestProcessor(t)
+	in := newTestIngest(t, ip, 1, 3)
+	we := ingestEndpoint(t, in)
+	first := checkUploadResponse(t, upload(t, we, "key-1", uploadPart{"frame", testFrame(1)}), http.StatusCreated)
+	nextCapture(t, ip, time.Second)
+
+	// a retry returns the original capture without committing another
+	retry := checkUploadResponse(t, upload(t, we, "key-1", uploadPart{"frame", testFrame(1)}), http.StatusOK)
+	if !retry.Duplicate || retry.Capture != first.Capture || retry.Frames != 1 {
+		t.Errorf("retry response %+v, want the duplicate of %+v", retry, first)
+	}
+	// as it does after a restart
+	we = ingestEndpoint(t, newTestIngest(t, ip, 1, 3))
+	retry = checkUploadResponse(t, upload(t, we, "key-1", uploadPart{"frame", testFrame(1)}), http.StatusOK)
+	if !retry.Duplicate || retry.Capture != first.Capture {
+		t.Errorf("retry after restart %+v, want the duplicate of %+v", retry, first)
+	}
+	select {
+	case dir := <-ip.readyDirs:
+		t.Errorf("a retried upload was committed as %s", dir)
+	default:
+	}
+
+	// keys are per client, so another client's upload with the same key is
+	// a new capture
+	body, contentType := uploadBody(t, uploadPart{"frame", testFrame(2)})
+	r := signedRequest("POST", "/captures", body, "ops", "ops-secret", time.Now())
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Idempotency-Key", "key-1")
+	other := checkUploadResponse(t, serve(we, r), http.StatusCreated)
+	if other.Duplicate || other.Capture == first.Capture {
+		t.Errorf("another client's upload with the same key got %+v", other)
+	}
+	checkCapture(t, nextCapture(t, ip, time.Second), [][]byte{testFrame(2)}, "upload:ops")
+
+	// an upload while another with the key is in progress is a conflict
+	if _, _, _, reserved := in.reserveKey("camera\nkey-2"); !reserved {
+		t.Fatal("key-2 couldn't be reserved")
+	}
+	if w := upload(t, ingestEndpoint(t, in), "key-2", uploadPart{"frame", testFrame(3)}); w.Code != http.StatusConflict {
+		t.Errorf("upload with a key in progress: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	in.releaseKey("camera\nkey-2")
+	checkUploadResponse(t, upload(t, ingestEndpoint(t, in), "key-2", uploadPart{"frame", testFrame(3)}), http.StatusCreated)
+
+	// a rejected upload doesn't use up its key
+	if w := upload(t, ingestEndpoint(t, in), "key-3", uploadPart{"frame", []byte("GIF89a")}); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid upload: status %d", w.Code)
+	}
+	resp := checkUploadResponse(t, upload(t, ingestEndpoint(t, in), "key-3", uploadPart{"frame", testFrame(4)}), http.StatusCreated)
+	if resp.Duplicate {
+		t.Errorf("upload after a rejected one with the same key was a duplicate")
+	}
+}
+
+func TestIngestEnabled(t *testing.T) {
+	for name, ingest := range map[string]interface{}{
+		"missing section": nil,
+		"disabled":        map[string]interface{}{"enabled": false},
+	} {
+		config := map[string]interface{}{}
+		if ingest != nil {
+			config["ingest"] = ingest
+		}
+		in, err := NewIngestService(config, nil, nil)
+		if err != nil || in.enabled {
+			t.Errorf("%s: enabled %v, %v", name, in != nil && in.enabled, err)
+		}
+	}
+	if _, err := NewIngestService(map[string]interface{}{
+		"ingest": map[string]interface{}{"enabled": "yes"},
+	}, nil, nil); err == nil {
+		t.Error("an invalid ingest.enabled was accepted")
+	}
+
+	// uploads can't be enabled without clients to accept them from
+	in := newTestIngest(t, newTestProcessor(t), 1, 1)
+	we := &WebEndpoint{mux: http.NewServeMux(), auth: &endpointAuth{clients: map[string]EndpointClient{}}}
+	if err := in.Register(we); err == nil {
+		t.Error("ingest was registered without clients")
+	}
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+const (
+	keogramStateFile   = "keogram.json"
+	keogramPartialFile = "keogram-partial.png"
+	skyStripFile       = "skystrip-partial.png"
+	keogramAxisHeight  = 20
+)
+
+var (
+	sunriseColor = color.RGBA{R: 255, G: 200, B: 40, A: 255}
+	sunsetColor  = color.RGBA{R: 255, G: 90, B: 40, A: 255}
+)
+
+// Keogram incrementally builds a keogram (the center column of each frame
+// stacked left to right) and a strip of average sky colors from each
+// processed image, and finalizes both into one annotated image at the end
+// of the day
+type Keogram struct {
+	enabled     bool
+	columnWidth int
+	height      int
+	stripHeight int
+	skyFraction float64
+	today       *Today
+	publisher   *Publisher
+	errChan     chan error
+	lock        sync.Mutex
+}
+
+type keogramState struct {
+	Frames  []int64 `json:"frames"`
+	Sunrise int64   `json:"sunrise"`
+	Sunset  int64   `json:"sunset"`
+}
+
+func NewKeogramService(config map[string]interface{}, errChan chan error, todayService *Today, publisher *Publisher) (*Keogram, error) {
+	enabled, err := util.GetBoolFromConfig(config, "keogram.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Keogram{}, nil
+	}
+	colWidth, err := util.GetIntFromConfig(config, "keogram.column_width")
+	if err != nil || colWidth <= 0 {
+		colWidth = 2
+	}
+	height, err := util.GetIntFromConfig(config, "keogram.height")
+	if err != nil || height <= 0 {
+		height = 480
+	}
+	stripHeight, err := util.GetIntFromConfig(config, "keogram.strip_height")
+	if err != nil || stripHeight < 0 {
+		stripHeight = 40
+	}
+	skyPercent, err := util.GetIntFromConfig(config, "keogram.sky_percent")
+	if err != nil || skyPercent <= 0 || skyPercent > 100 {
+		skyPercent = 33
+	}
+	return &Keogram{
+		enabled:     true,
+		columnWidth: int(colWidth),
+		height:      int(height),
+		stripHeight: int(stripHeight),
+		skyFraction: float64(skyPercent) / 100,
+		today:       todayService,
+		publisher:   publisher,
+		errChan:     errChan,
+	}, nil
+}
+
+// AddFrame appends the center column and sky color of a processed capture
+// to the partial keogram and sky strip for its day
+func (k *Keogram) AddFrame(dir string) error {
+	if !k.enabled {
+		return nil
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	dayDir := path.Dir(dir)
+	capTime, err := captureTime(dir)
+	if err != nil {
+		return fmt.Errorf("unable to determine capture time for %s: %w", dir, err)
+	}
+	img, err := loadJPEG(path.Join(dir, "final.jpg"))
+	if err != nil {
+		return fmt.Errorf("unable to load image for keogram: %w", err)
+	}
+	state, err := loadKeogramState(dayDir)
+	if err != nil {
+		return err
+	}
+
+	// the partial images only keep the columns recorded in the state, so
+	// a column written without its state update is overwritten
+	columns := len(state.Frames)
+	keo, err := k.extend(path.Join(dayDir, keogramPartialFile), k.height, columns)
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	x0 := keo.Bounds().Dx() - k.columnWidth
+	center := b.Min.X + b.Dx()/2
+	for y := 0; y < k.height; y++ {
+		c := img.At(center, b.Min.Y+y*b.Dy()/k.height)
+		for x := 0; x < k.columnWidth; x++ {
+			keo.Set(x0+x, y, c)
+		}
+	}
+	files := map[string]image.Image{keogramPartialFile: keo}
+
+	if k.stripHeight > 0 {
+		strip, err := k.extend(path.Join(dayDir, skyStripFile), k.stripHeight, columns)
+		if err != nil {
+			return err
+		}
+		draw.Draw(strip, image.Rect(x0, 0, x0+k.columnWidth, k.stripHeight),
+			image.NewUniform(averageColor(img, image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+int(float64(b.Dy())*k.skyFraction)))),
+			image.Point{}, draw.Src)
+		files[skyStripFile] = strip
+	}
+
+	state.Frames = append(state.Frames, capTime.Unix())
+	state.Sunrise = k.today.GetSunrise()
+	state.Sunset = k.today.GetSunset()
+	return saveKeogram(dayDir, files, state)
+}
+
+// saveKeogram writes the partial images and the state to temporary files
+// and only renames them into place once all of them are written; the state
+// is renamed last as it decides how many columns of the images are used
+func saveKeogram(dayDir string, files map[string]image.Image, state *keogramState) error {
+	var tmps []string
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for name, img := range files {
+		tmp := path.Join(dayDir, name+".tmp")
+		tmps = append(tmps, tmp)
+		if err := savePNG(tmp, img); err != nil {
+			return fmt.Errorf("unable to save %s: %w", name, err)
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	stateTmp := path.Join(dayDir, keogramStateFile+".tmp")
+	tmps = append(tmps, stateTmp)
+	if err := os.WriteFile(stateTmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to save keogram state: %w", err)
+	}
+	for name := range files {
+		if err := os.Rename(path.Join(dayDir, name+".tmp"), path.Join(dayDir, name)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(stateTmp, path.Join(dayDir, keogramStateFile))
+}
+
+// Finalize annotates the day's keogram and sky strip with hour ticks and
+// sunrise/sunset markers and publishes the result
+func (k *Keogram) Finalize(date, dayDir string) error {
+	if !k.enabled {
+		return nil
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	state, err := loadKeogramState(dayDir)
+	if err != nil {
+		return err
+	}
+	if len(state.Frames) == 0 {
+		logrus.Infof("No frames recorded for the keogram of %s", date)
+		return nil
+	}
+	keo, err := loadPNG(path.Join(dayDir, keogramPartialFile))
+	if err != nil {
+		return fmt.Errorf("unable to load partial keogram: %w", err)
+	}
+	width := keo.Bounds().Dx()
+	if w := len(state.Frames) * k.columnWidth; w < width {
+		width = w
+	}
+	stripTop := k.height
+	if k.stripHeight > 0 {
+		stripTop += 2
+	}
+	axisTop := stripTop + k.stripHeight
+	out := image.NewRGBA(image.Rect(0, 0, width, axisTop+keogramAxisHeight))
+	draw.Draw(out, out.Bounds(), image.Black, image.Point{}, draw.Src)
+	draw.Draw(out, image.Rect(0, 0, width, k.height), keo, image.Point{}, draw.Src)
+	if k.stripHeight > 0 {
+		if strip, err := loadPNG(path.Join(dayDir, skyStripFile)); err == nil {
+			draw.Draw(out, image.Rect(0, stripTop, width, axisTop), strip, image.Point{}, draw.Src)
+		}
+	}
+
+	// hour ticks along the bottom axis
+	first := time.Unix(state.Frames[0], 0)
+	last := time.Unix(state.Frames[len(state.Frames)-1], 0)
+	lastLabel := -100
+	for h := first.Truncate(time.Hour).Add(time.Hour); !h.After(last); h = h.Add(time.Hour) {
+		x := k.timeToX(state.Frames, h.Unix())
+		draw.Draw(out, image.Rect(x, axisTop, x+1, axisTop+5), image.White, image.Point{}, draw.Src)
+		label := h.Format("15")
+		if x-lastLabel > labelWidth(label)+6 {
+			drawLabel(out, x-labelWidth(label)/2, axisTop+keogramAxisHeight-3, label, color.White)
+			lastLabel = x
+		}
+	}
+	// dashed sunrise/sunset markers over the keogram and sky strip
+	for _, m := range []struct {
+		t int64
+		c color.Color
+	}{{state.Sunrise, sunriseColor}, {state.Sunset, sunsetColor}} {
+		if m.t < state.Frames[0] || m.t > state.Frames[len(state.Frames)-1] {
+			continue
+		}
+		x := k.timeToX(state.Frames, m.t)
+		for y := 0; y < axisTop; y += 8 {
+			draw.Draw(out, image.Rect(x, y, x+1, y+4), image.NewUniform(m.c), image.Point{}, draw.Src)
+		}
+	}
+
+	final := path.Join(dayDir, "keogram.jpg")
+	if err := saveJPEG(final, out, 90); err != nil {
+		return fmt.Errorf("unable to save keogram: %w", err)
+	}
+	if err := k.publisher.Publish(final, fmt.Sprintf("keogram/%s.jpg", date), PublishOptions{
+		ContentType:  "image/jpeg",
+		CacheControl: "public, max-age=31536000",
+	}); err != nil {
+		return err
+	}
+	// the undated copy always shows the most recently completed day next to
+	// the index page
+	return k.publisher.Publish(final, "keogram.jpg", PublishOptions{
+		ContentType: "image/jpeg",
+		Expires:     time.Now().Add(24 * time.Hour),
+	})
+}
+
+// extend loads the first columns of the partial image at file (if any) and
+// returns a copy with room for one more column
+func (k *Keogram) extend(file string, height, columns int) (*image.RGBA, error) {
+	prev, err := loadPNG(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to load %s: %w", file, err)
+	}
+	kept := 0
+	if prev != nil {
+		kept = prev.Bounds().Dx() / k.columnWidth
+	}
+	if kept > columns {
+		kept = columns
+	}
+	img := image.NewRGBA(image.Rect(0, 0, (kept+1)*k.columnWidth, height))
+	if prev != nil {
+		draw.Draw(img, image.Rect(0, 0, kept*k.columnWidth, height), prev, prev.Bounds().Min, draw.Src)
+	}
+	return img, nil
+}
+
+// timeToX maps a unix time to the x offset of the keogram by interpolating
+// between the capture times of neighbouring columns
+func (k *Keogram) timeToX(frames []int64, t int64) int {
+	for i := 0; i < len(frames)-1; i++ {
+		if t >= frames[i] && t < frames[i+1] {
+			frac := float64(t-frames[i]) / float64(frames[i+1]-frames[i])
+			return int((float64(i)+frac)*float64(k.columnWidth)) + k.columnWidth/2
+		}
+	}
+	return (len(frames)-1)*k.columnWidth + k.columnWidth/2
+}
+
+func averageColor(img image.Image, r image.Rectangle) color.Color {
+	step := r.Dx() / 100
+	if step < 1 {
+		step = 1
+	}
+	var sr, sg, sb, n uint64
+	for y := r.Min.Y; y < r.Max.Y; y += step {
+		for x := r.Min.X; x < r.Max.X; x += step {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			sr += uint64(cr >> 8)
+			sg += uint64(cg >> 8)
+			sb += uint64(cb >> 8)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.Black
+	}
+	return color.RGBA{R: uint8(sr / n), G: uint8(sg / n), B: uint8(sb / n), A: 255}
+}
+
+func loadKeogramState(dayDir string) (*keogramState, error) {
+	state := &keogramState{}
+	data, err := os.ReadFile(path.Join(dayDir, keogramStateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("unable to read keogram state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to parse keogram state: %w", err)
+	}
+	return state, nil
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	liveClientBuffer = 8
+	// how long a client turned away for being over max_clients waits
+	// before reconnecting
+	liveRejectRetry = 30 * time.Second
+)
+
+var errTooManyLiveClients = fmt.Errorf("too many live event clients")
+
+// LiveEvents pushes each newly published image to connected browsers as a
+// Server-Sent Event so that pages can swap in the new image immediately
+type LiveEvents struct {
+	enabled bool
+	public  bool
+	// the origins allowed to read the stream from a page, or "*" for any
+	allowOrigins []string
+	heartbeat    time.Duration
+	history      int
+	maxClients   int
+	publisher    *Publisher
+
+	lock    sync.Mutex
+	events  []liveEvent
+	clients map[chan liveEvent]struct{}
+}
+
+type liveEvent struct {
+	id   int64
+	data []byte
+}
+
+// LiveImage is the data of each "image" event
+type LiveImage struct {
+	Time time.Time `json:"time"`
+	// Image is the URL of the full size image and Images the URL of each
+	// published size; URLs change with each image so they are never cached
+	Image    string            `json:"image"`
+	Images   map[string]string `json:"images"`
+	Temp     *float32          `json:"temp,omitempty"`
+	TempUnit string            `json:"temp_unit,omitempty"`
+	Weather  string            `json:"weather,omitempty"`
+}
+
+func NewLiveEvents(config map[string]interface{}, publisher *Publisher) (*LiveEvents, error) {
+	enabled, err := util.GetBoolFromConfig(config, "live.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &LiveEvents{}, nil
+	}
+	public, err := util.GetBoolFromConfig(config, "live.public")
+	if err != nil {
+		if !util.IsNoConfigError(err) {
+			return nil, err
+		}
+		public = true
+	}
+	allowOrigins, err := getAllowOrigins(config, publisher)
+	if err != nil {
+		return nil, err
+	}
+	heartbeat, err := util.GetIntFromConfig(config, "live.heartbeat")
+	if err != nil || heartbeat <= 0 {
+		heartbeat = 30
+	}
+	history, err := util.GetIntFromConfig(config, "live.history")
+	if err != nil || history <= 0 {
+		history = 20
+	}
+	maxClients, err := util.GetIntFromConfig(config, "live.max_clients")
+	if err != nil || maxClients <= 0 {
+		maxClients = 100
+	}
+	return &LiveEvents{
+		enabled:      true,
+		public:       public,
+		allowOrigins: allowOrigins,
+		heartbeat:    time.Duration(heartbeat) * time.Second,
+		history:      int(history),
+		maxClients:   int(maxClients),
+		publisher:    publisher,
+		clients:      map[chan liveEvent]struct{}{},
+	}, nil
+}
+
+// getAllowOrigins returns the origins of *allow_origin*, a string or a list
+// of strings; by default only the site itself may read the stream
+func getAllowOrigins(config map[string]interface{}, publisher *Publisher) ([]string, error) {
+	if origin, err := util.GetStringFromConfig(config, "live.allow_origin"); err == nil {
+		return []string{origin}, nil
+	}
+	origins, err := util.GetStringSliceFromConfig(config, "live.allow_origin")
+	if err == nil {
+		return origins, nil
+	}
+	if !util.IsNoConfigError(err) {
+		return nil, fmt.Errorf("config item live.allow_origin must be a string or an array of strings")
+	}
+	u, err := url.Parse(publisher.URL(""))
+	if err != nil || u.Host == "" {
+		return nil, nil
+	}
+	return []string{u.Scheme + "://" + u.Host}, nil
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" if the origin isn't allowed
+func (le *LiveEvents) allowedOrigin(origin string) string {
+	for _, o := range le.allowOrigins {
+		if o == "*" {
+			return o
+		}
+		if origin != "" && strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Register adds the /events stream to the endpoint server; it is served
+// without authentication when the stream is public so that any browser can
+// subscribe
+func (le *LiveEvents) Register(we *WebEndpoint) {
+	if !le.enabled {
+		return
+	}
+	if le.public {
+		we.HandlePublic("/events", le)
+		return
+	}
+	we.Handle("/events", le)
+}
+
+// Published is the ImageProcessor publish hook; it sends an event for the
+// image to every connected client
+func (le *LiveEvents) Published(img PublishedImage) {
+	if !le.enabled {
+		return
+	}
+	data := LiveImage{Time: img.Time, Images: map[string]string{}}
+	for name := range img.Keys {
+		data.Images[name], _ = img.URL(le.publisher, name)
+	}
+	data.Image = data.Images["latest.jpg"]
+	if meta, err := loadCaptureMeta(img.Dir); err == nil {
+		data.Temp = meta.Temp
+		data.TempUnit = meta.TempUnit
+		if meta.Weather != nil && len(meta.Weather.WeatherDesc) > 0 {
+			data.Weather = meta.Weather.WeatherDesc[0].Description
+		}
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		logrus.Errorf("can't marshal live image event: %v", err)
+		return
+	}
+
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	// event IDs are capture times so that they keep increasing across
+	// restarts of the daemon
+	ev := liveEvent{id: img.Time.Unix(), data: b}
+	if n := len(le.events); n > 0 && ev.id <= le.events[n-1].id {
+		ev.id = le.events[n-1].id + 1
+	}
+	le.events = append(le.events, ev)
+	if len(le.events) > le.history {
+		le.events = le.events[len(le.events)-le.history:]
+	}
+	for c := range le.clients {
+		select {
+		case c <- ev:
+		default:
+			// a client that can't keep up misses the event; it still gets
+			// the next one
+			logrus.Warnf("Dropping live event %d for a slow client", ev.id)
+		}
+	}
+}
+
+func (le *LiveEvents) subscribe(lastID int64) (chan liveEvent, []liveEvent, error) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if len(le.clients) >= le.maxClients {
+		return nil, nil, errTooManyLiveClients
+	}
+	c := make(chan liveEvent, liveClientBuffer)
+	le.clients[c] = struct{}{}
+	if lastID < 0 {
+		if n := len(le.events); n > 0 {
+			return c, []liveEvent{le.events[n-1]}, nil
+		}
+		return c, nil, nil
+	}
+	var missed []liveEvent
+	for _, ev := range le.events {
+		if ev.id > lastID {
+			missed = append(missed, ev)
+		}
+	}
+	return c, missed, nil
+}
+
+func (le *LiveEvents) unsubscribe(c chan liveEvent) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	delete(le.clients, c)
+}
+
+// ServeHTTP streams events to a client. A reconnecting client sends the ID
+// of the last event it saw in Last-Event-ID and is sent the events it
+// missed; a new client is sent the most recent event so the page is
+// current
+func (le *LiveEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastID := int64(-1)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if v, err := strconv.ParseInt(id, 10, 64); err == nil {
+			lastID = v
+		}
+	}
+	h := w.Header()
+	h.Set("Vary", "Origin")
+	if origin := le.allowedOrigin(r.Header.Get("Origin")); origin != "" {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	c, missed, err := le.subscribe(lastID)
+	if err != nil {
+		logrus.Warnf("Rejected live event client %s: %v", r.RemoteAddr, err)
+		// EventSource gives up for good on an error status (or a 204), so
+		// the client is sent an empty stream that only sets a long retry
+		// interval; the browser reconnects once the stream ends
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", liveRejectRetry.Milliseconds())
+		return
+	}
+	defer le.unsubscribe(c)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	for _, ev := range missed {
+		writeEvent(w, ev)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(le.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev := <-c:
+			writeEvent(w, ev)
+		case <-heartbeat.C:
+			// comments keep proxies from closing an idle connection
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev liveEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: image\ndata: %s\n\n", ev.id, ev.data)
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLiveAllowedOrigin(t *testing.T) {
+	tests := []struct {
+		allow  []string
+		origin string
+		want   string
+	}{
+		{[]string{"https://kwcam.live"}, "https://kwcam.live", "https://kwcam.live"},
+		{[]string{"https://kwcam.live/"}, "https://KWCAM.live", "https://KWCAM.live"},
+		{[]string{"https://kwcam.live"}, "https://evil.example", ""},
+		{[]string{"https://kwcam.live"}, "", ""},
+		{[]string{"https://a.example", "https://b.example"}, "https://b.example", "https://b.example"},
+		{[]string{"*"}, "https://evil.example", "*"},
+		{nil, "https://kwcam.live", ""},
+	}
+	for _, tt := range tests {
+		le := &LiveEvents{allowOrigins: tt.allow}
+		if got := le.allowedOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowedOrigin(%q) with %v = %q, want %q", tt.origin, tt.allow, got, tt.want)
+		}
+	}
+}
+
+func TestLiveMaxClients(t *testing.T) {
+	le, err := NewLiveEvents(map[string]interface{}{
+		"live": map[string]interface{}{
+			"enabled":      true,
+			"allow_origin": []interface{}{"https://kwcam.live"},
+			"max_clients":  int64(2),
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewLiveEvents: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := le.subscribe(-1); err != nil {
+			t.Fatalf("client %d: %v", i+1, err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Origin", "https://kwcam.live")
+	le.ServeHTTP(rec, req)
+	// an error status would stop the browser from reconnecting, so the
+	// client is only told to retry later
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("client over the limit got %d %q, want an event stream", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if got, want := rec.Body.String(), fmt.Sprintf("retry: %d\n\n", liveRejectRetry.Milliseconds()); got != want {
+		t.Errorf("client over the limit was sent %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://kwcam.live" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestLiveConfigInvalid(t *testing.T) {
+	for name, live := range map[string]map[string]interface{}{
+		"enabled not a bool": {"enabled": "yes"},
+		"public not a bool":  {"enabled": true, "public": "no"},
+	} {
+		if _, err := NewLiveEvents(map[string]interface{}{"live": live}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	le, err := NewLiveEvents(map[string]interface{}{
+		"live": map[string]interface{}{"enabled": true, "allow_origin": "*"},
+	}, nil)
+	if err != nil || !le.public {
+		t.Errorf("without live.public: public %v, %v; want public", le != nil && le.public, err)
+	}
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	offlineStateFile    = "onimage-offline.json"
+	maintenanceSkipFile = "onimage-maintenance.json"
+
+	// reasons the webcam was taken offline; only maintenance and watchdog
+	// offline periods end automatically
+	OfflineManual      = "manual"
+	OfflineMaintenance = "maintenance"
+	OfflineWatchdog    = "watchdog"
+)
+
+// OfflineState describes why and since when the webcam has been offline;
+// it is persisted in the home directory so that it survives restarts
+type OfflineState struct {
+	Since   time.Time  `json:"since"`
+	Reason  string     `json:"reason"`
+	Message string     `json:"message,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// OfflinePageData is passed to the offline page template
+type OfflinePageData struct {
+	Today   string
+	Since   time.Time
+	Message string
+	// Until is the expected return time formatted for display, or empty if
+	// unknown; UntilTime is the same time for custom formatting
+	Until     string
+	UntilTime *time.Time
+}
+
+// MaintenanceWindow is a scheduled period during which the webcam is
+// offline
+type MaintenanceWindow struct {
+	Start   time.Time
+	End     time.Time
+	Message string
+}
+
+func getMaintenanceWindows(config map[string]interface{}) ([]MaintenanceWindow, error) {
+	tables, err := util.GetTableSliceFromConfig(config, "website.maintenance")
+	if err != nil {
+		switch err.(type) {
+		case *util.NoConfigSectionError, *util.NoConfigEntryError:
+			return nil, nil
+		}
+		return nil, err
+	}
+	var windows []MaintenanceWindow
+	for i, table := range tables {
+		start, err := parseConfigTime(table["start"])
+		if err != nil {
+			return nil, fmt.Errorf("window %d start: %w", i+1, err)
+		}
+		end, err := parseConfigTime(table["end"])
+		if err != nil {
+			return nil, fmt.Errorf("window %d end: %w", i+1, err)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("window %d ends before it starts", i+1)
+		}
+		message, _ := table["message"].(string)
+		windows = append(windows, MaintenanceWindow{Start: start, End: end, Message: message})
+	}
+	return windows, nil
+}
+
+// parseConfigTime accepts a TOML datetime or a string in RFC 3339 or
+// "2006-01-02 15:04" (local time) format
+func parseConfigTime(v interface{}) (time.Time, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, nil
+	case string:
+		if t, err := time.Parse(time.RFC3339, val); err == nil {
+			return t, nil
+		}
+		return time.ParseInLocation("2006-01-02 15:04", val, time.Local)
+	}
+	return time.Time{}, fmt.Errorf("expected a datetime, got %v", v)
+}
+
+func loadOfflineState(file string) (*OfflineState, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &OfflineState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+	return state, nil
+}
+
+func (t *Today) IsOffline() bool {
+	t.offlineLock.Lock()
+	defer t.offlineLock.Unlock()
+	return t.offline != nil
+}
+
+// OfflineStatus returns the current offline state, or nil when online
+func (t *Today) OfflineStatus() *OfflineState {
+	t.offlineLock.Lock()
+	defer t.offlineLock.Unlock()
+	if t.offline == nil {
+		return nil
+	}
+	state := *t.offline
+	return &state
+}
+
+// SetOffline publishes the offline page, rendered with an optional message
+// and expected return time, in place of today's page until SetOnline is
+// called
+func (t *Today) SetOffline(reason, message string, until *time.Time) error {
+	_, err := t.setOffline(reason, message, until, false)
+	return err
+}
+
+// setOffline takes the webcam offline as SetOffline does; with ifOnline set
+// an existing offline state is left alone, checked under the same lock as
+// it is set so that an automatic offline period never replaces another.
+// It reports false if the state was left alone
+func (t *Today) setOffline(reason, message string, until *time.Time, ifOnline bool) (bool, error) {
+	t.offlineLock.Lock()
+	if ifOnline && t.offline != nil {
+		t.offlineLock.Unlock()
+		return false, nil
+	}
+	state := &OfflineState{Since: time.Now(), Reason: reason, Message: message, Until: until}
+	if t.offline != nil {
+		state.Since = t.offline.Since
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(t.offlineStateFile, data, 0644)
+	}
+	if err != nil {
+		t.offlineLock.Unlock()
+		return true, fmt.Errorf("unable to persist offline state: %w", err)
+	}
+	t.offline = state
+	t.offlineLock.Unlock()
+	logrus.Infof("Setting webcam offline (%s): %s", reason, message)
+
+	return true, t.publishIndex(true)
+}
+
+// OfflinePageData returns the data the offline page is rendered with; while
+// online it describes the webcam going offline now without a message
+func (t *Today) OfflinePageData() OfflinePageData {
+	t.offlineLock.Lock()
+	defer t.offlineLock.Unlock()
+	return t.offlinePageData()
+}
+
+// offlinePageData must be called with the offline lock held
+func (t *Today) offlinePageData() OfflinePageData {
+	state := t.offline
+	if state == nil {
+		state = &OfflineState{Since: time.Now()}
+	}
+	data := OfflinePageData{
+		Today:     t.GetDate(),
+		Since:     state.Since,
+		Message:   state.Message,
+		UntilTime: state.Until,
+	}
+	if state.Until != nil {
+		data.Until = state.Until.In(t.templates.location).Format("Mon Jan 2 15:04 MST")
+	}
+	return data
+}
+
+// SetOnline leaves offline mode and publishes today's page. During a
+// maintenance window the webcam stays online until the window ends
+func (t *Today) SetOnline() error {
+	return t.setOnline(true)
+}
+
+// setOnline leaves offline mode, skipping the active maintenance window if
+// skipWindow is set
+func (t *Today) setOnline(skipWindow bool) error {
+	t.offlineLock.Lock()
+	if err := os.Remove(t.offlineStateFile); err != nil && !os.IsNotExist(err) {
+		t.offlineLock.Unlock()
+		return fmt.Errorf("unable to remove offline state: %w", err)
+	}
+	if t.offline != nil {
+		logrus.Infof("Setting webcam online after being offline since %v", t.offline.Since)
+	}
+	t.offline = nil
+	if w := t.activeMaintenance(time.Now()); skipWindow && w != nil {
+		logrus.Infof("Skipping the maintenance window until %v", w.End)
+		t.skipMaintenance = w.End
+		if err := saveMaintenanceSkip(t.maintenanceSkipFile, w.End); err != nil {
+			logrus.Errorf("unable to persist maintenance window skip: %v", err)
+		}
+	}
+	t.offlineLock.Unlock()
+	return t.publishIndex(false)
+}
+
+// activeMaintenance returns the maintenance window at now, if any
+func (t *Today) activeMaintenance(now time.Time) *MaintenanceWindow {
+	for i, w := range t.maintenance {
+		if !now.Before(w.Start) && now.Before(w.End) {
+			return &t.maintenance[i]
+		}
+	}
+	return nil
+}
+
+func loadMaintenanceSkip(file string) (time.Time, error) {
+	var skip struct {
+		Until time.Time `json:"until"`
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if err := json.Unmarshal(data, &skip); err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+	return skip.Until, nil
+}
+
+func saveMaintenanceSkip(file string, until time.Time) error {
+	data, err := json.Marshal(map[string]time.Time{"until": until})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// WatchMaintenance starts a goroutine that takes the webcam offline during
+// the configured maintenance windows
+func (t *Today) WatchMaintenance() {
+	if len(t.maintenance) == 0 {
+		return
+	}
+	go func() {
+		t.checkMaintenance(time.Now())
+		tick := time.NewTicker(time.Minute)
+		for now := range tick.C {
+			t.checkMaintenance(now)
+		}
+	}()
+}
+
+func (t *Today) checkMaintenance(now time.Time) {
+	t.offlineLock.Lock()
+	active := t.activeMaintenance(now)
+	if active != nil && !active.End.After(t.skipMaintenance) {
+		// the webcam was brought back online manually during this window
+		active = nil
+	}
+	t.offlineLock.Unlock()
+	state := t.OfflineStatus()
+	var err error
+	switch {
+	case active != nil && state == nil:
+		// the webcam may have been taken offline since the state was read
+		end := active.End
+		_, err = t.setOffline(OfflineMaintenance, active.Message, &end, true)
+	case active == nil && state != nil && state.Reason == OfflineMaintenance:
+		err = t.setOnline(false)
+	}
+	if err != nil {
+		// publishing errors have already been reported on the error channel
+		logrus.Errorf("unable to apply maintenance window: %v", err)
+	}
+}
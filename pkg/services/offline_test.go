@@ -0,0 +1,166 @@
+package services
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOfflineState(t *testing.T) {
+	log, _ := fakeAWS(t)
+	today := newTestToday(t, newTestPublisher(t))
+	until := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	if err := today.SetOffline(OfflineManual, "cleaning", &until); err != nil {
+		t.Fatal(err)
+	}
+	if page := bucketObject(t, log, "index.html"); page != "offline cleaning" {
+		t.Errorf("published %q while offline", page)
+	}
+	state := today.OfflineStatus()
+	if state == nil || state.Reason != OfflineManual || state.Message != "cleaning" || !state.Until.Equal(until) {
+		t.Fatalf("offline state %+v", state)
+	}
+
+	// the state survives a restart
+	saved, err := loadOfflineState(today.offlineStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || saved.Reason != state.Reason || saved.Message != state.Message ||
+		!saved.Since.Equal(state.Since) || !saved.Until.Equal(until) {
+		t.Errorf("saved state %+v, want %+v", saved, state)
+	}
+
+	// today's page isn't published over the offline page
+	if err := today.SetTodayPage(); err != nil {
+		t.Fatal(err)
+	}
+	if page := bucketObject(t, log, "index.html"); page != "offline cleaning" {
+		t.Errorf("published %q while offline", page)
+	}
+
+	// a new message keeps the time the webcam went offline
+	if err := today.SetOffline(OfflineManual, "still cleaning", nil); err != nil {
+		t.Fatal(err)
+	}
+	if again := today.OfflineStatus(); !again.Since.Equal(state.Since) || again.Until != nil {
+		t.Errorf("offline state %+v after a new message, want since %v", again, state.Since)
+	}
+	if page := bucketObject(t, log, "index.html"); page != "offline still cleaning" {
+		t.Errorf("published %q after a new message", page)
+	}
+
+	if err := today.SetOnline(); err != nil {
+		t.Fatal(err)
+	}
+	if today.IsOffline() {
+		t.Error("still offline after SetOnline")
+	}
+	if page := bucketObject(t, log, "index.html"); page != "index 2023-06-30" {
+		t.Errorf("published %q once online", page)
+	}
+	if saved, err := loadOfflineState(today.offlineStateFile); saved != nil || err != nil {
+		t.Errorf("saved state %+v, %v once online", saved, err)
+	}
+
+	if err := os.WriteFile(today.offlineStateFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOfflineState(today.offlineStateFile); err == nil {
+		t.Error("a corrupt offline state was loaded")
+	}
+}
+
+func TestGetMaintenanceWindows(t *testing.T) {
+	start := time.Date(2023, 6, 30, 10, 0, 0, 0, time.UTC)
+	windows, err := getMaintenanceWindows(map[string]interface{}{
+		"website": map[string]interface{}{
+			"maintenance": []interface{}{
+				map[string]interface{}{"start": start, "end": start.Add(time.Hour), "message": "cleaning"},
+				map[string]interface{}{"start": "2023-07-01 09:30", "end": "2023-07-01T11:00:00Z"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 {
+		t.Fatalf("%d windows, want 2", len(windows))
+	}
+	if w := windows[0]; !w.Start.Equal(start) || !w.End.Equal(start.Add(time.Hour)) || w.Message != "cleaning" {
+		t.Errorf("first window %+v", w)
+	}
+	if want := time.Date(2023, 7, 1, 9, 30, 0, 0, time.Local); !windows[1].Start.Equal(want) {
+		t.Errorf("local time start is %v, want %v", windows[1].Start, want)
+	}
+
+	if windows, err := getMaintenanceWindows(map[string]interface{}{}); windows != nil || err != nil {
+		t.Errorf("without maintenance windows: %v, %v", windows, err)
+	}
+	for name, window := range map[string]map[string]interface{}{
+		"ends before it starts": {"start": start, "end": start},
+		"no end":                {"start": start},
+		"invalid start":         {"start": "tomorrow", "end": start},
+		"start not a time":      {"start": int64(10), "end": start},
+	} {
+		_, err := getMaintenanceWindows(map[string]interface{}{
+			"website": map[string]interface{}{"maintenance": []interface{}{window}},
+		})
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	log, _ := fakeAWS(t)
+	today := newTestToday(t, newTestPublisher(t))
+	now := time.Now()
+	window := MaintenanceWindow{Start: now.Add(-time.Hour), End: now.Add(time.Hour), Message: "maintenance"}
+	today.maintenance = []MaintenanceWindow{window}
+
+	today.checkMaintenance(now.Add(-2 * time.Hour))
+	if today.IsOffline() {
+		t.Fatal("offline before the window")
+	}
+	today.checkMaintenance(now)
+	state := today.OfflineStatus()
+	if state == nil || state.Reason != OfflineMaintenance || !state.Until.Equal(window.End) {
+		t.Fatalf("offline state %+v during the window", state)
+	}
+	if page := bucketObject(t, log, "index.html"); page != "offline maintenance" {
+		t.Errorf("published %q during the window", page)
+	}
+	today.checkMaintenance(window.End)
+	if today.IsOffline() {
+		t.Error("still offline after the window")
+	}
+	if page := bucketObject(t, log, "index.html"); page != "index 2023-06-30" {
+		t.Errorf("published %q after the window", page)
+	}
+
+	// returning online during the window skips the rest of it, across
+	// restarts too
+	today.checkMaintenance(now)
+	if err := today.SetOnline(); err != nil {
+		t.Fatal(err)
+	}
+	today.checkMaintenance(now.Add(time.Minute))
+	if today.IsOffline() {
+		t.Error("offline again during a skipped window")
+	}
+	if skip, err := loadMaintenanceSkip(today.maintenanceSkipFile); err != nil || !skip.Equal(window.End) {
+		t.Errorf("saved skip %v, %v; want %v", skip, err, window.End)
+	}
+
+	// a manual offline period isn't ended by a window
+	today.skipMaintenance = time.Time{}
+	if err := today.SetOffline(OfflineManual, "broken", nil); err != nil {
+		t.Fatal(err)
+	}
+	today.checkMaintenance(now)
+	today.checkMaintenance(window.End)
+	if state := today.OfflineStatus(); state == nil || state.Reason != OfflineManual {
+		t.Errorf("offline state %+v, want the manual one kept", state)
+	}
+}
@@ -0,0 +1,424 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/metrics"
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxDir   = "onimage-outbox"
+	outboxIndex = "outbox.json"
+
+	// reasons a queued upload is dropped without being published
+	outboxDropAttempts = "attempts"
+	outboxDropAge      = "age"
+	outboxDropMissing  = "missing"
+)
+
+// outbox holds the uploads that failed, on disk so that they survive a
+// restart, and retries them with exponential backoff. There is at most one
+// entry per key: a newer upload of a key (e.g. latest.jpg) replaces the
+// queued one, while uploads to distinct keys (e.g. archive images) are all
+// kept until they succeed or are dropped after too many attempts or too
+// long in the outbox
+type outbox struct {
+	dir            string
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxAttempts    int
+	maxAge         time.Duration
+	wake           chan struct{}
+
+	// uploads of the same key are serialized by a lock per key so that a
+	// retry never overwrites a newer upload of its key; a lock is dropped
+	// from the map once nothing holds or waits for it
+	keyLocksLock sync.Mutex
+	keyLocks     map[string]*outboxKeyLock
+
+	lock    sync.Mutex
+	entries map[string]*OutboxEntry
+}
+
+type outboxKeyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// errOutboxFileMissing is reported for an entry whose queued copy of the
+// content is gone, which no retry can fix
+var errOutboxFileMissing = errors.New("the queued file is missing")
+
+// OutboxEntry is an upload waiting to be retried; File is the outbox's own
+// copy of the content, as the original is often a temporary file
+type OutboxEntry struct {
+	Key         string         `json:"key"`
+	File        string         `json:"file"`
+	Options     PublishOptions `json:"options"`
+	Queued      time.Time      `json:"queued"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"next_attempt"`
+	LastError   string         `json:"last_error"`
+}
+
+// OutboxStatus summarizes the uploads waiting to be retried
+type OutboxStatus struct {
+	Entries     int        `json:"entries"`
+	Oldest      *time.Time `json:"oldest,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// newOutbox loads the outbox in homeDir; it returns nil when [outbox] sets
+// enabled = false, in which case failed uploads are only reported
+func newOutbox(config map[string]interface{}, homeDir string) (*outbox, error) {
+	enabled, err := util.GetBoolFromConfig(config, "outbox.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if err == nil && !enabled {
+		return nil, nil
+	}
+	initial, err := util.GetIntFromConfig(config, "outbox.initial_backoff")
+	if err != nil || initial <= 0 {
+		initial = 30
+	}
+	maxBackoff, err := util.GetIntFromConfig(config, "outbox.max_backoff")
+	if err != nil || maxBackoff < initial {
+		maxBackoff = 1800
+	}
+	// 0 disables either limit
+	maxAttempts, err := util.GetIntFromConfig(config, "outbox.max_attempts")
+	if err != nil || maxAttempts < 0 {
+		maxAttempts = 100
+	}
+	maxAge, err := util.GetIntFromConfig(config, "outbox.max_age")
+	if err != nil || maxAge < 0 {
+		maxAge = 259200
+	}
+	ob := &outbox{
+		dir:            filepath.Join(homeDir, outboxDir),
+		initialBackoff: time.Duration(initial) * time.Second,
+		maxBackoff:     time.Duration(maxBackoff) * time.Second,
+		maxAttempts:    int(maxAttempts),
+		maxAge:         time.Duration(maxAge) * time.Second,
+		wake:           make(chan struct{}, 1),
+		keyLocks:       map[string]*outboxKeyLock{},
+		entries:        map[string]*OutboxEntry{},
+	}
+	if err := os.MkdirAll(ob.dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create outbox directory: %w", err)
+	}
+	data, err := os.ReadFile(filepath.Join(ob.dir, outboxIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read outbox: %w", err)
+	}
+	if err == nil {
+		var entries []*OutboxEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("unable to parse outbox: %w", err)
+		}
+		for _, e := range entries {
+			if _, err := os.Stat(e.File); err != nil {
+				logrus.Errorf("Dropping queued upload of %s: %v", e.Key, errOutboxFileMissing)
+				metrics.OutboxDropped.WithLabelValues(outboxDropMissing).Inc()
+				continue
+			}
+			ob.entries[e.Key] = e
+		}
+	}
+	if len(ob.entries) > 0 {
+		logrus.Infof("Outbox has %d uploads to retry", len(ob.entries))
+	}
+	metrics.OutboxEntries.Set(float64(len(ob.entries)))
+	return ob, nil
+}
+
+// lockKey takes the lock serializing uploads of key; it must be released
+// with unlockKey
+func (ob *outbox) lockKey(key string) {
+	ob.keyLocksLock.Lock()
+	l, ok := ob.keyLocks[key]
+	if !ok {
+		l = &outboxKeyLock{}
+		ob.keyLocks[key] = l
+	}
+	l.refs++
+	ob.keyLocksLock.Unlock()
+	l.Lock()
+}
+
+func (ob *outbox) unlockKey(key string) {
+	ob.keyLocksLock.Lock()
+	l := ob.keyLocks[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(ob.keyLocks, key)
+	}
+	ob.keyLocksLock.Unlock()
+	l.Unlock()
+}
+
+// add queues an upload of localFile to key that failed with uploadErr,
+// replacing any queued upload of the same key; the key lock must be held
+func (ob *outbox) add(localFile, key string, opts PublishOptions, uploadErr error) error {
+	sum := sha256.Sum256([]byte(key))
+	file := filepath.Join(ob.dir, hex.EncodeToString(sum[:12]))
+	if err := copyFile(localFile, file, 0644); err != nil {
+		return fmt.Errorf("unable to queue %s for retry: %w", key, err)
+	}
+	now := time.Now()
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	entry := &OutboxEntry{
+		Key:         key,
+		File:        file,
+		Options:     opts,
+		Queued:      now,
+		Attempts:    1,
+		NextAttempt: now.Add(ob.initialBackoff),
+		LastError:   uploadErr.Error(),
+	}
+	if old, ok := ob.entries[key]; ok {
+		// the retry schedule carries over so that a key that keeps being
+		// published during an outage doesn't reset its backoff
+		entry.Attempts = old.Attempts + 1
+		entry.NextAttempt = now.Add(ob.backoff(entry.Attempts))
+	}
+	ob.entries[key] = entry
+	ob.notify()
+	return ob.save()
+}
+
+// remove drops a queued upload of key once key has been published; the key
+// lock must be held
+func (ob *outbox) remove(key string) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	entry, ok := ob.entries[key]
+	if !ok {
+		return
+	}
+	delete(ob.entries, key)
+	os.Remove(entry.File)
+	if err := ob.save(); err != nil {
+		logrus.Errorf("%v", err)
+	}
+}
+
+// dropReason returns why an entry should be dropped rather than retried
+// again at now, or an empty string if it should be retried
+func (ob *outbox) dropReason(e *OutboxEntry, now time.Time) string {
+	switch {
+	case ob.maxAttempts > 0 && e.Attempts >= ob.maxAttempts:
+		return outboxDropAttempts
+	case ob.maxAge > 0 && now.Sub(e.Queued) >= ob.maxAge:
+		return outboxDropAge
+	}
+	return ""
+}
+
+// drop removes an entry that won't be retried again; it must be called
+// with the lock held
+func (ob *outbox) drop(e *OutboxEntry, reason string) {
+	delete(ob.entries, e.Key)
+	os.Remove(e.File)
+	metrics.OutboxDropped.WithLabelValues(reason).Inc()
+}
+
+// backoff doubles the retry interval with every attempt up to the maximum
+func (ob *outbox) backoff(attempts int) time.Duration {
+	d := ob.initialBackoff
+	for i := 1; i < attempts && d < ob.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > ob.maxBackoff {
+		d = ob.maxBackoff
+	}
+	return d
+}
+
+// save writes the index of queued uploads; it must be called with the lock
+// held
+func (ob *outbox) save() error {
+	metrics.OutboxEntries.Set(float64(len(ob.entries)))
+	entries := make([]*OutboxEntry, 0, len(ob.entries))
+	for _, e := range ob.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Queued.Before(entries[j].Queued) })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// replace the index atomically so a crash can't leave it truncated
+	index := filepath.Join(ob.dir, outboxIndex)
+	if err := os.WriteFile(index+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("unable to write outbox: %w", err)
+	}
+	if err := os.Rename(index+".tmp", index); err != nil {
+		return fmt.Errorf("unable to write outbox: %w", err)
+	}
+	return nil
+}
+
+func (ob *outbox) notify() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns the entries ready to be retried, oldest first so that an
+// image is uploaded before a page or feed that points at it
+func (ob *outbox) due(now time.Time) []*OutboxEntry {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	var due []*OutboxEntry
+	for _, e := range ob.entries {
+		if !e.NextAttempt.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Queued.Before(due[j].Queued) })
+	return due
+}
+
+// untilNext returns how long until the next entry is due
+func (ob *outbox) untilNext() time.Duration {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	next := time.Hour
+	for _, e := range ob.entries {
+		if d := time.Until(e.NextAttempt); d < next {
+			next = d
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+func (ob *outbox) status() *OutboxStatus {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	status := &OutboxStatus{Entries: len(ob.entries)}
+	for _, e := range ob.entries {
+		if status.Oldest == nil || e.Queued.Before(*status.Oldest) {
+			queued := e.Queued
+			status.Oldest = &queued
+			status.LastError = e.LastError
+		}
+		if status.NextAttempt == nil || e.NextAttempt.Before(*status.NextAttempt) {
+			next := e.NextAttempt
+			status.NextAttempt = &next
+		}
+	}
+	return status
+}
+
+// StartOutbox starts retrying the uploads in the outbox
+func (p *Publisher) StartOutbox() {
+	if p.outbox == nil {
+		return
+	}
+	go p.retryOutbox()
+}
+
+func (p *Publisher) retryOutbox() {
+	ob := p.outbox
+	timer := time.NewTimer(ob.untilNext())
+	for {
+		select {
+		case <-timer.C:
+		case <-ob.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		for _, e := range ob.due(time.Now()) {
+			p.retry(e)
+		}
+		timer.Reset(ob.untilNext())
+	}
+}
+
+// retry uploads a queued entry again, unless a newer upload of its key has
+// replaced or published it in the meantime. An entry is dropped, and the
+// upload reported as failed for good, once it reaches the maximum attempts
+// or age or if its queued file is gone
+func (p *Publisher) retry(e *OutboxEntry) {
+	ob := p.outbox
+	ob.lockKey(e.Key)
+	defer ob.unlockKey(e.Key)
+
+	ob.lock.Lock()
+	current := ob.entries[e.Key] == e
+	ob.lock.Unlock()
+	if !current {
+		return
+	}
+	var err error
+	if _, serr := os.Stat(e.File); serr != nil {
+		err = errOutboxFileMissing
+	} else {
+		err = p.upload(e.File, e.Key, e.Options)
+		metrics.OutboxRetries.WithLabelValues(metrics.Result(err)).Inc()
+	}
+
+	ob.lock.Lock()
+	reason := ""
+	var dropErr error
+	switch {
+	case err == nil:
+		logrus.Infof("Published %s from the outbox after %d attempts", e.Key, e.Attempts+1)
+		delete(ob.entries, e.Key)
+		os.Remove(e.File)
+	case errors.Is(err, errOutboxFileMissing):
+		reason = outboxDropMissing
+	default:
+		e.Attempts++
+		e.LastError = err.Error()
+		if reason = ob.dropReason(e, time.Now()); reason == "" {
+			e.NextAttempt = time.Now().Add(ob.backoff(e.Attempts))
+			logrus.Warnf("Retry of %s failed; next attempt at %s", e.Key, e.NextAttempt.Format(time.RFC3339))
+		}
+	}
+	if reason != "" {
+		ob.drop(e, reason)
+		dropErr = fmt.Errorf("dropped the queued upload of %s after %d attempts since %s (%s): %w",
+			e.Key, e.Attempts, e.Queued.Format(time.RFC3339), reason, err)
+		logrus.Errorf("%v", dropErr)
+	}
+	if err := ob.save(); err != nil {
+		logrus.Errorf("%v", err)
+	}
+	ob.lock.Unlock()
+	if dropErr != nil {
+		p.errChan <- dropErr
+	}
+}
+
+// OutboxStatus returns a summary of the uploads waiting to be retried, or
+// nil when the outbox is disabled
+func (p *Publisher) OutboxStatus() *OutboxStatus {
+	if p.outbox == nil {
+		return nil
+	}
+	return p.outbox.status()
+}
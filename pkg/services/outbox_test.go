@@ -0,0 +1,285 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestOutbox(t *testing.T, homeDir string, outbox map[string]interface{}) *outbox {
+	t.Helper()
+	ob, err := newOutbox(map[string]interface{}{"outbox": outbox}, homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ob
+}
+
+func TestOutboxCoalesce(t *testing.T) {
+	home := t.TempDir()
+	ob := newTestOutbox(t, home, map[string]interface{}{"initial_backoff": int64(30)})
+	uploadErr := errors.New("network down")
+	opts := PublishOptions{ContentType: "image/jpeg"}
+
+	start := time.Now()
+	if err := ob.add(writeTestFile(t, "first"), "latest.jpg", opts, uploadErr); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.add(writeTestFile(t, "second"), "latest.jpg", opts, uploadErr); err != nil {
+		t.Fatal(err)
+	}
+	if len(ob.entries) != 1 {
+		t.Fatalf("%d entries after two uploads of one key, want 1", len(ob.entries))
+	}
+	e := ob.entries["latest.jpg"]
+	if data, err := os.ReadFile(e.File); err != nil || string(data) != "second" {
+		t.Errorf("queued content is %q, %v; want the newer upload", data, err)
+	}
+	// the backoff carries over from the replaced entry
+	if e.Attempts != 2 {
+		t.Errorf("replaced entry has %d attempts, want 2", e.Attempts)
+	}
+	if d := e.NextAttempt.Sub(start); d < 60*time.Second || d > 61*time.Second {
+		t.Errorf("replaced entry is due in %v, want 60s", d)
+	}
+
+	// distinct keys are all kept
+	for _, key := range []string{"archive/2023-06-01/1230.jpg", "archive/2023-06-01/1240.jpg"} {
+		if err := ob.add(writeTestFile(t, key), key, opts, uploadErr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ob.entries) != 3 {
+		t.Fatalf("%d entries, want 3", len(ob.entries))
+	}
+	due := ob.due(time.Now().Add(time.Hour))
+	if len(due) != 3 || due[0].Key != "latest.jpg" {
+		t.Errorf("due entries aren't oldest first: %v", due)
+	}
+
+	// the outbox survives a restart
+	reloaded := newTestOutbox(t, home, nil)
+	if len(reloaded.entries) != 3 || reloaded.entries["latest.jpg"].Attempts != 2 {
+		t.Errorf("reloaded entries %v", reloaded.entries)
+	}
+
+	ob.remove("latest.jpg")
+	if _, ok := ob.entries["latest.jpg"]; ok {
+		t.Errorf("removed entry is still queued")
+	}
+	if _, err := os.Stat(e.File); !os.IsNotExist(err) {
+		t.Errorf("removed entry's file is still there: %v", err)
+	}
+	if reloaded := newTestOutbox(t, home, nil); len(reloaded.entries) != 2 {
+		t.Errorf("%d entries after removal and restart, want 2", len(reloaded.entries))
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	ob := &outbox{initialBackoff: 30 * time.Second, maxBackoff: 1800 * time.Second}
+	for attempts, want := range map[int]time.Duration{
+		1:   30 * time.Second,
+		2:   60 * time.Second,
+		3:   120 * time.Second,
+		6:   960 * time.Second,
+		7:   1800 * time.Second,
+		100: 1800 * time.Second,
+	} {
+		if got := ob.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestOutboxEnabled(t *testing.T) {
+	// the outbox is on unless disabled
+	if ob, err := newOutbox(map[string]interface{}{}, t.TempDir()); ob == nil || err != nil {
+		t.Errorf("without an [outbox] section: %v, %v; want an outbox", ob, err)
+	}
+	if ob := newTestOutbox(t, t.TempDir(), map[string]interface{}{"enabled": false}); ob != nil {
+		t.Errorf("outbox %v with enabled = false", ob)
+	}
+	if _, err := newOutbox(map[string]interface{}{
+		"outbox": map[string]interface{}{"enabled": "no"},
+	}, t.TempDir()); err == nil {
+		t.Error("an invalid outbox.enabled was accepted")
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	log, fail := fakeAWS(t)
+	p := newTestPublisher(t)
+	p.outbox = newTestOutbox(t, p.homeDir, map[string]interface{}{"initial_backoff": int64(30)})
+
+	if err := os.WriteFile(fail, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(writeTestFile(t, "image"), "latest.jpg", PublishOptions{}); err == nil {
+		t.Fatal("a failed upload was reported as published")
+	}
+	e := p.outbox.entries["latest.jpg"]
+	if e == nil {
+		t.Fatal("the failed upload wasn't queued")
+	}
+
+	start := time.Now()
+	p.retry(e)
+	if e.Attempts != 2 || e.LastError == "" {
+		t.Errorf("failed retry left %d attempts and error %q", e.Attempts, e.LastError)
+	}
+	if d := e.NextAttempt.Sub(start); d < 60*time.Second || d > 61*time.Second {
+		t.Errorf("failed retry is due again in %v, want 60s", d)
+	}
+
+	os.Remove(fail)
+	p.retry(e)
+	if len(p.outbox.entries) != 0 {
+		t.Errorf("published entry is still queued")
+	}
+	if _, err := os.Stat(e.File); !os.IsNotExist(err) {
+		t.Errorf("published entry's file is still there: %v", err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(calls) != 3 || !strings.Contains(calls[2], e.File+" s3://bucket/latest.jpg") {
+		t.Errorf("unexpected aws calls:\n%s", data)
+	}
+	select {
+	case err := <-p.errChan:
+		t.Errorf("unexpected error: %v", err)
+	default:
+	}
+
+	// a stale entry replaced by a newer publish isn't retried
+	os.WriteFile(fail, nil, 0644)
+	p.Publish(writeTestFile(t, "old"), "today.json", PublishOptions{})
+	stale := p.outbox.entries["today.json"]
+	os.Remove(fail)
+	if err := p.Publish(writeTestFile(t, "new"), "today.json", PublishOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(log)
+	p.retry(stale)
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Errorf("a replaced entry was uploaded again")
+	}
+}
+
+func TestOutboxDrop(t *testing.T) {
+	log, fail := fakeAWS(t)
+	if err := os.WriteFile(fail, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		// applied to the entry before it is retried
+		setup func(e *OutboxEntry)
+		drop  bool
+	}{
+		{"under the limits", nil, func(e *OutboxEntry) {}, false},
+		{"too many attempts", map[string]interface{}{"max_attempts": int64(3)},
+			func(e *OutboxEntry) { e.Attempts = 2 }, true},
+		{"too old", map[string]interface{}{"max_age": int64(3600)},
+			func(e *OutboxEntry) { e.Queued = time.Now().Add(-2 * time.Hour) }, true},
+		{"limits disabled", map[string]interface{}{"max_attempts": int64(0), "max_age": int64(0)},
+			func(e *OutboxEntry) { e.Attempts = 1000; e.Queued = time.Now().AddDate(-1, 0, 0) }, false},
+		{"file missing", nil, func(e *OutboxEntry) { os.Remove(e.File) }, true},
+	}
+	for _, tt := range tests {
+		p := newTestPublisher(t)
+		p.outbox = newTestOutbox(t, p.homeDir, tt.config)
+		p.Publish(writeTestFile(t, "image"), "latest.jpg", PublishOptions{})
+		e := p.outbox.entries["latest.jpg"]
+		if e == nil {
+			t.Fatalf("%s: the failed upload wasn't queued", tt.name)
+		}
+		tt.setup(e)
+		p.retry(e)
+		_, queued := p.outbox.entries["latest.jpg"]
+		if queued == tt.drop {
+			t.Errorf("%s: entry queued is %v, want %v", tt.name, queued, !tt.drop)
+		}
+		select {
+		case err := <-p.errChan:
+			if !tt.drop {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+		default:
+			if tt.drop {
+				t.Errorf("%s: the dropped upload wasn't reported", tt.name)
+			}
+		}
+		if tt.drop {
+			if _, err := os.Stat(e.File); !os.IsNotExist(err) {
+				t.Errorf("%s: dropped entry's file is still there: %v", tt.name, err)
+			}
+			if reloaded := newTestOutbox(t, p.homeDir, tt.config); len(reloaded.entries) != 0 {
+				t.Errorf("%s: dropped entry is reloaded", tt.name)
+			}
+		}
+	}
+
+	// an entry whose file is gone isn't retried at all
+	data, _ := os.ReadFile(log)
+	if n := strings.Count(string(data), "\n"); n != 2*len(tests)-1 {
+		t.Errorf("%d aws calls, want %d:\n%s", n, 2*len(tests)-1, data)
+	}
+
+	// nor loaded after a restart
+	home := t.TempDir()
+	ob := newTestOutbox(t, home, nil)
+	if err := ob.add(writeTestFile(t, "image"), "latest.jpg", PublishOptions{}, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(ob.entries["latest.jpg"].File)
+	if reloaded := newTestOutbox(t, home, nil); len(reloaded.entries) != 0 {
+		t.Errorf("an entry without its file was loaded")
+	}
+}
+
+func TestOutboxKeyLocks(t *testing.T) {
+	ob := newTestOutbox(t, t.TempDir(), nil)
+	ob.lockKey("latest.jpg")
+	// other keys aren't blocked
+	ob.lockKey("today.json")
+	ob.unlockKey("today.json")
+
+	locked := make(chan struct{})
+	go func() {
+		ob.lockKey("latest.jpg")
+		close(locked)
+		ob.unlockKey("latest.jpg")
+	}()
+	select {
+	case <-locked:
+		t.Fatal("a second upload of the key wasn't blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ob.unlockKey("latest.jpg")
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a second upload of the key wasn't unblocked")
+	}
+
+	// locks are dropped once released so that unique keys don't pile up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ob.keyLocksLock.Lock()
+		n := len(ob.keyLocks)
+		ob.keyLocksLock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d key locks left after all were released", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
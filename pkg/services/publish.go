@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Publisher uploads generated content to the website's S3 bucket using the
+// aws client; all objects are made publicly readable. Failed uploads are
+// kept in an outbox and retried until they succeed
+type Publisher struct {
+	bucket  string
+	baseURL string
+	homeDir string
+	outbox  *outbox
+	errChan chan error
+}
+
+// PublishOptions holds the object metadata set on an uploaded file
+type PublishOptions struct {
+	ContentType  string
+	CacheControl string
+	Expires      time.Time
+	// ContentEncoding is set when the file is stored compressed, e.g. "gzip"
+	ContentEncoding string
+}
+
+var (
+	awscpCmd = []string{"aws", "s3", "cp", "SOMEFILE", "BUCKETLOCATION", "--acl", "public-read",
+		"--metadata-directive", "REPLACE"}
+	awsrmCmd = []string{"aws", "s3", "rm", "BUCKETLOCATION", "--recursive"}
+)
+
+func NewPublisher(config map[string]interface{}, errChan chan error) (*Publisher, error) {
+	s3bucketName, err := util.GetStringFromConfig(config, "website.bucket")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve entry 'website.bucket' from config: %w", err)
+	}
+	homeDir, err := util.GetStringFromConfig(config, "home_dir")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve entry 'home_dir' from config: %w", err)
+	}
+	// the public URL of the site defaults to the bucket's own endpoint
+	baseURL, err := util.GetStringFromConfig(config, "website.base_url")
+	if err != nil || baseURL == "" {
+		baseURL = fmt.Sprintf("https://%s.s3.amazonaws.com/", s3bucketName)
+	}
+	outbox, err := newOutbox(config, homeDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{
+		bucket:  s3bucketName,
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		homeDir: homeDir,
+		outbox:  outbox,
+		errChan: errChan,
+	}, nil
+}
+
+// Publish copies localFile to key in the bucket. If the upload fails it is
+// queued in the outbox to be retried, replacing any queued upload of the
+// same key, and the error is still returned
+func (p *Publisher) Publish(localFile, key string, opts PublishOptions) error {
+	if p.outbox == nil {
+		return p.upload(localFile, key, opts)
+	}
+	p.outbox.lockKey(key)
+	defer p.outbox.unlockKey(key)
+	err := p.upload(localFile, key, opts)
+	if err == nil {
+		// an older failed upload of the key must not be retried over this one
+		p.outbox.remove(key)
+		return nil
+	}
+	if qerr := p.outbox.add(localFile, key, opts, err); qerr != nil {
+		logrus.Errorf("%v", qerr)
+		return err
+	}
+	return fmt.Errorf("%w; queued for retry", err)
+}
+
+func (p *Publisher) upload(localFile, key string, opts PublishOptions) error {
+	cmd := make([]string, len(awscpCmd))
+	copy(cmd, awscpCmd)
+	cmd[3] = localFile
+	cmd[4] = fmt.Sprintf("s3://%s/%s", p.bucket, strings.TrimPrefix(key, "/"))
+	if opts.ContentType != "" {
+		cmd = append(cmd, "--content-type", opts.ContentType)
+	}
+	if opts.CacheControl != "" {
+		cmd = append(cmd, "--cache-control", opts.CacheControl)
+	}
+	if opts.ContentEncoding != "" {
+		cmd = append(cmd, "--content-encoding", opts.ContentEncoding)
+	}
+	if !opts.Expires.IsZero() {
+		cmd = append(cmd, "--expires", opts.Expires.UTC().Format(http.TimeFormat))
+	}
+	out, err := util.RunCommand("upload", p.homeDir, cmd)
+	if err != nil {
+		logrus.Errorf("Error calling 'aws cp' from %s to S3: %v", localFile, err)
+		logrus.Errorf(">      Command: %s", strings.Join(cmd, " "))
+		logrus.Errorf(">  Full output: %s", out)
+		return fmt.Errorf("unable to publish %s to %s: %w", localFile, key, err)
+	}
+	return nil
+}
+
+// PublishTemplate renders a page template with data and publishes the
+// result to key
+func (p *Publisher) PublishTemplate(templates *Templates, page string, data interface{}, key string, opts PublishOptions) error {
+	tmpFile, err := os.CreateTemp("/tmp", "page")
+	if err != nil {
+		return errors.Wrapf(err, "unable to create temp file for %s generation", key)
+	}
+	defer os.Remove(tmpFile.Name())
+	writer := bufio.NewWriter(tmpFile)
+	if err := templates.Execute(writer, page, data); err != nil {
+		tmpFile.Close()
+		return errors.Wrapf(err, "unable to execute template for %s", key)
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "unable to flush bytes to temp file")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "unable to close temp file")
+	}
+	return p.Publish(tmpFile.Name(), key, opts)
+}
+
+// RemovePrefix deletes every object under prefix from the bucket; unlike
+// uploads, a failed removal isn't queued for retry
+func (p *Publisher) RemovePrefix(prefix string) error {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix == "" || !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("invalid prefix %q; must name a directory", prefix)
+	}
+	cmd := make([]string, len(awsrmCmd))
+	copy(cmd, awsrmCmd)
+	cmd[3] = fmt.Sprintf("s3://%s/%s", p.bucket, prefix)
+	out, err := util.RunCommand("remove", p.homeDir, cmd)
+	if err != nil {
+		logrus.Errorf("Error calling 'aws rm' for %s: %v", prefix, err)
+		logrus.Errorf(">  Full output: %s", out)
+		return fmt.Errorf("unable to remove %s from the bucket: %w", prefix, err)
+	}
+	return nil
+}
+
+// URL returns the public URL of a published key
+func (p *Publisher) URL(key string) string {
+	return p.baseURL + strings.TrimPrefix(key, "/")
+}
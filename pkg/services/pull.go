@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pullSnapshot = "snapshot"
+	pullMJPEG    = "mjpeg"
+
+	maxPullFrameBytes = 32 * 1024 * 1024
+)
+
+// PullSource captures images from a camera that serves a JPEG snapshot URL
+// or an MJPEG stream, at the photo frequency and within the same capture
+// window reported by /phototimez
+type PullSource struct {
+	enabled        bool
+	url            string
+	mode           string
+	frames         int
+	username       string
+	password       string
+	client         *http.Client
+	todayService   *Today
+	imageProcessor *ImageProcessor
+	errChan        chan error
+}
+
+func NewPullSource(config map[string]interface{}, errChan chan error, todayService *Today, imageProcessor *ImageProcessor) (*PullSource, error) {
+	enabled, err := util.GetBoolFromConfig(config, "pull.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &PullSource{}, nil
+	}
+	rawURL, err := util.GetStringFromConfig(config, "pull.url")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve 'pull.url' from config: %w", err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid 'pull.url' %q", rawURL)
+	}
+	mode, err := util.GetStringFromConfig(config, "pull.mode")
+	if err != nil || mode == "" {
+		mode = pullSnapshot
+	}
+	if mode != pullSnapshot && mode != pullMJPEG {
+		return nil, fmt.Errorf("invalid 'pull.mode' %q; must be %q or %q", mode, pullSnapshot, pullMJPEG)
+	}
+	frames, err := util.GetIntFromConfig(config, "pull.frames")
+	if err != nil || frames <= 0 {
+		frames = 1
+	}
+	if frames > 99 {
+		return nil, fmt.Errorf("invalid 'pull.frames' %d; must be at most 99", frames)
+	}
+	timeout, err := util.GetIntFromConfig(config, "pull.timeout")
+	if err != nil || timeout <= 0 {
+		timeout = 15
+	}
+	username, _ := util.GetStringFromConfig(config, "pull.username")
+	password, _ := util.GetStringFromConfig(config, "pull.password")
+	return &PullSource{
+		enabled:        true,
+		url:            rawURL,
+		mode:           mode,
+		frames:         int(frames),
+		username:       username,
+		password:       password,
+		client:         &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		todayService:   todayService,
+		imageProcessor: imageProcessor,
+		errChan:        errChan,
+	}, nil
+}
+
+// Start captures from the camera at each multiple of the photo frequency
+func (p *PullSource) Start() {
+	if !p.enabled {
+		return
+	}
+	go p.run()
+}
+
+func (p *PullSource) run() {
+	logrus.Infof("Pulling %s frames from %s every %v", p.mode, p.url, p.imageProcessor.Frequency())
+	captureOnSchedule("pulling capture from camera", p.imageProcessor.Frequency(), p.todayService, p.Capture, p.errChan)
+}
+
+// Capture fetches the configured number of frames from the camera and
+// commits them as a capture; it returns the capture directory
+func (p *PullSource) Capture() (string, error) {
+	started := time.Now()
+	staging, err := p.imageProcessor.NewStagingDir()
+	if err != nil {
+		return "", err
+	}
+	if p.mode == pullMJPEG {
+		err = p.grabStream(staging)
+	} else {
+		err = p.grabSnapshots(staging)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	u, _ := url.Parse(p.url)
+	// the camera takes the frames with its own exposure, without a shift
+	dir, err := p.imageProcessor.CommitCapture(staging, CaptureMeta{Time: started, Source: "pull:" + u.Host, EVShift: new(float64)})
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (p *PullSource) get() (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.username != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("camera returned %s for %s", resp.Status, p.url)
+	}
+	return resp, nil
+}
+
+func (p *PullSource) grabSnapshots(staging string) error {
+	for i := 1; i <= p.frames; i++ {
+		resp, err := p.get()
+		if err != nil {
+			return err
+		}
+		err = writeFrame(resp.Body, path.Join(staging, fmt.Sprintf("%02d.jpg", i)))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot %d from %s: %w", i, p.url, err)
+		}
+	}
+	return nil
+}
+
+// grabStream reads consecutive frames from a multipart/x-mixed-replace
+// MJPEG stream
+func (p *PullSource) grabStream(staging string) error {
+	resp, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("%s is not an MJPEG stream (content type %q)", p.url, resp.Header.Get("Content-Type"))
+	}
+	// some cameras include the leading dashes in the boundary parameter
+	mr := multipart.NewReader(resp.Body, strings.TrimPrefix(params["boundary"], "--"))
+	for i := 1; i <= p.frames; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			return fmt.Errorf("unable to read frame %d from %s: %w", i, p.url, err)
+		}
+		err = writeFrame(part, path.Join(staging, fmt.Sprintf("%02d.jpg", i)))
+		part.Close()
+		if err != nil {
+			return fmt.Errorf("frame %d from %s: %w", i, p.url, err)
+		}
+	}
+	return nil
+}
+
+// writeFrame saves a JPEG read from r to file
+func writeFrame(r io.Reader, file string) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxPullFrameBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxPullFrameBytes {
+		return fmt.Errorf("image is larger than %d bytes", maxPullFrameBytes)
+	}
+	if !bytes.HasPrefix(data, jpegMagic) {
+		return fmt.Errorf("not a JPEG image")
+	}
+	return os.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPullSource(t *testing.T, ip *ImageProcessor, rawURL, mode string, frames int) *PullSource {
+	t.Helper()
+	p, err := NewPullSource(map[string]interface{}{
+		"pull": map[string]interface{}{
+			"enabled":  true,
+			"url":      rawURL,
+			"mode":     mode,
+			"frames":   int64(frames),
+			"username": "admin",
+			"password": "secret",
+		},
+	}, make(chan error, 10), nil, ip)
+	if err != nil {
+		t.Fatalf("NewPullSource: %v", err)
+	}
+	return p
+}
+
+func TestPullSnapshot(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(testFrame(int(n)))
+	}))
+	defer srv.Close()
+
+	ip := newTestProcessor(t)
+	dir, err := newTestPullSource(t, ip, srv.URL+"/snapshot.jpg", pullSnapshot, 3).Capture()
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("%d snapshots requested, want 3", n)
+	}
+	u, _ := url.Parse(srv.URL)
+	checkCapture(t, dir, [][]byte{testFrame(1), testFrame(2), testFrame(3)}, "pull:"+u.Host)
+	if queued := nextCapture(t, ip, time.Second); queued != dir {
+		t.Errorf("queued %s, want %s", queued, dir)
+	}
+	if got, want := path.Dir(dir), path.Join(ip.imagesBaseDir, time.Now().Format("2006-01-02")); got != want {
+		t.Errorf("capture in %s, want %s", got, want)
+	}
+	checkNoStaging(t, ip)
+}
+
+func TestPullMJPEG(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := multipart.NewWriter(w)
+		// cameras commonly repeat the leading dashes in the parameter
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=--"+mw.Boundary())
+		for i := 1; i <= 10; i++ {
+			part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+			if err != nil {
+				return
+			}
+			part.Write(testFrame(i))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	ip := newTestProcessor(t)
+	dir, err := newTestPullSource(t, ip, srv.URL, pullMJPEG, 4).Capture()
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	u, _ := url.Parse(srv.URL)
+	checkCapture(t, dir, [][]byte{testFrame(1), testFrame(2), testFrame(3), testFrame(4)}, "pull:"+u.Host)
+	checkNoStaging(t, ip)
+}
+
+func TestPullErrors(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not an image")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/short-stream", func(w http.ResponseWriter, r *http.Request) {
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+		part.Write(testFrame(1))
+		mw.Close()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer close(release)
+
+	tests := []struct {
+		name string
+		path string
+		mode string
+	}{
+		{"not found", "/missing", pullSnapshot},
+		{"not a jpeg", "/text", pullSnapshot},
+		{"snapshot timeout", "/slow", pullSnapshot},
+		{"not a stream", "/text", pullMJPEG},
+		{"stream timeout", "/slow", pullMJPEG},
+		{"stream ends early", "/short-stream", pullMJPEG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := newTestProcessor(t)
+			p := newTestPullSource(t, ip, srv.URL+tt.path, tt.mode, 2)
+			p.client.Timeout = 200 * time.Millisecond
+			if dir, err := p.Capture(); err == nil {
+				t.Fatalf("captured %s, expected an error", dir)
+			}
+			select {
+			case dir := <-ip.readyDirs:
+				t.Errorf("capture %s queued after an error", dir)
+			default:
+			}
+			checkNoStaging(t, ip)
+		})
+	}
+}
+
+func TestPullEnabledInvalid(t *testing.T) {
+	if _, err := NewPullSource(map[string]interface{}{
+		"pull": map[string]interface{}{"enabled": "yes"},
+	}, nil, nil, nil); err == nil {
+		t.Errorf("an invalid 'pull.enabled' was accepted")
+	}
+	p, err := NewPullSource(map[string]interface{}{}, nil, nil, nil)
+	if err != nil || p.enabled {
+		t.Errorf("without a [pull] section: %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,526 @@
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactTar      = "tar"
+	compactDownsize = "downsize"
+	expireDelete    = "delete"
+	expireArchive   = "archive"
+
+	downsizedMarker = ".downsized"
+)
+
+var (
+	dayDirRegex   = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	dayTarRegex   = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\.tar\.gz$`)
+	rawFrameRegex = regexp.MustCompile(`^(\d{2}|prefinal)\.jpg$`)
+
+	downsizeCmd = []string{"mogrify", "-resize", "50%", "-quality", "85", "final.jpg"}
+)
+
+// Retention periodically applies the age-based tiers of the retention policy
+// to the dated capture directories under the images directory
+type Retention struct {
+	enabled         bool
+	imagesBaseDir   string
+	archiveDir      string
+	interval        time.Duration
+	pruneFramesDays int
+	compactDays     int
+	compactMode     string
+	expireDays      int
+	expireMode      string
+	minFreeBytes    uint64
+	diskFree        func(string) (uint64, error)
+	// with immutable image keys, the images published for a day are
+	// removed from the bucket when the day expires
+	removeImages bool
+	todayService *Today
+	publisher    *Publisher
+	errChan      chan error
+}
+
+// RetentionReport summarizes the work done during a single retention pass
+type RetentionReport struct {
+	FramesRemoved int
+	BytesFreed    int64
+	DaysCompacted []string
+	DaysExpired   []string
+}
+
+type dayEntry struct {
+	date string
+	path string
+	tar  bool
+}
+
+func NewRetentionService(config map[string]interface{}, errChan chan error, todayService *Today, publisher *Publisher) (*Retention, error) {
+	// the retention section is optional; without it capture directories
+	// are kept forever as they always have been
+	enabled, err := util.GetBoolFromConfig(config, "retention.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Retention{}, nil
+	}
+	baseDir, err := util.GetStringFromConfig(config, "images.directory")
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve entry 'images.directory' from config: %w", err)
+	}
+	interval, err := getRetentionInt(config, "interval", 60)
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		return nil, fmt.Errorf("invalid 'retention.interval' 0; must be at least 1 minute")
+	}
+	pruneDays, err := getRetentionInt(config, "prune_frames_days", 0)
+	if err != nil {
+		return nil, err
+	}
+	compactDays, err := getRetentionInt(config, "compact_days", 0)
+	if err != nil {
+		return nil, err
+	}
+	expireDays, err := getRetentionInt(config, "expire_days", 0)
+	if err != nil {
+		return nil, err
+	}
+	minFreeMB, err := getRetentionInt(config, "min_free_mb", 0)
+	if err != nil {
+		return nil, err
+	}
+	// each enabled tier must apply no earlier than the one before it
+	tiers := []struct {
+		name string
+		days int64
+	}{{"prune_frames_days", pruneDays}, {"compact_days", compactDays}, {"expire_days", expireDays}}
+	for i, prev := 1, tiers[0]; i < len(tiers); i++ {
+		if tiers[i].days == 0 {
+			continue
+		}
+		if prev.days > tiers[i].days {
+			return nil, fmt.Errorf("'retention.%s' (%d) must not be after 'retention.%s' (%d)", prev.name, prev.days, tiers[i].name, tiers[i].days)
+		}
+		prev = tiers[i]
+	}
+
+	compactMode, err := util.GetStringFromConfig(config, "retention.compact_mode")
+	if err != nil {
+		if !util.IsNoConfigError(err) {
+			return nil, err
+		}
+		compactMode = compactTar
+	}
+	if compactMode != compactTar && compactMode != compactDownsize {
+		return nil, fmt.Errorf("invalid 'retention.compact_mode' %q; must be %q or %q", compactMode, compactTar, compactDownsize)
+	}
+	expireMode, err := util.GetStringFromConfig(config, "retention.expire_mode")
+	if err != nil {
+		if !util.IsNoConfigError(err) {
+			return nil, err
+		}
+		expireMode = expireDelete
+	}
+	archiveDir := ""
+	switch expireMode {
+	case expireDelete:
+	case expireArchive:
+		archiveDir, err = util.GetStringFromConfig(config, "retention.archive_dir")
+		if err != nil {
+			return nil, fmt.Errorf("can't retrieve entry 'retention.archive_dir' from config: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid 'retention.expire_mode' %q; must be %q or %q", expireMode, expireDelete, expireArchive)
+	}
+
+	derivatives, err := getDerivativeConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'derivatives' config: %w", err)
+	}
+
+	return &Retention{
+		enabled:         true,
+		imagesBaseDir:   baseDir,
+		archiveDir:      archiveDir,
+		interval:        time.Duration(interval) * time.Minute,
+		pruneFramesDays: int(pruneDays),
+		compactDays:     int(compactDays),
+		compactMode:     compactMode,
+		expireDays:      int(expireDays),
+		expireMode:      expireMode,
+		minFreeBytes:    uint64(minFreeMB) * 1024 * 1024,
+		diskFree:        util.DiskFree,
+		removeImages:    derivatives.immutable,
+		todayService:    todayService,
+		publisher:       publisher,
+		errChan:         errChan,
+	}, nil
+}
+
+// getRetentionInt returns a non-negative integer from the [retention]
+// section, or def if the entry is missing
+func getRetentionInt(config map[string]interface{}, name string, def int64) (int64, error) {
+	v, err := util.GetIntFromConfig(config, "retention."+name)
+	if err != nil {
+		if util.IsNoConfigError(err) {
+			return def, nil
+		}
+		return 0, err
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("invalid 'retention.%s' %d; must not be negative", name, v)
+	}
+	return v, nil
+}
+
+// Start runs a retention pass immediately and then on the configured interval
+func (r *Retention) Start() {
+	if !r.enabled {
+		return
+	}
+	go r.run()
+}
+
+func (r *Retention) run() {
+	tick := time.NewTicker(r.interval)
+	for {
+		report, err := r.RunOnce()
+		if err != nil {
+			r.errChan <- err
+			logrus.Errorf("retention pass failed: %v", err)
+		}
+		if report != nil {
+			logrus.Infof("Retention: removed %d raw frames, compacted days %v, expired days %v; %d MB freed",
+				report.FramesRemoved, report.DaysCompacted, report.DaysExpired, report.BytesFreed/(1024*1024))
+		}
+		<-tick.C
+	}
+}
+
+// RunOnce applies each configured tier to all days older than today and then
+// expires the oldest remaining days if free space is under the threshold
+func (r *Retention) RunOnce() (*RetentionReport, error) {
+	report := &RetentionReport{}
+	days, err := r.listDays()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list capture days in %s: %w", r.imagesBaseDir, err)
+	}
+	now, err := time.ParseInLocation("2006-01-02", r.todayService.GetDate(), time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse today's date: %w", err)
+	}
+
+	var remaining []dayEntry
+	for _, day := range days {
+		d, err := time.ParseInLocation("2006-01-02", day.date, time.Local)
+		if err != nil {
+			continue
+		}
+		age := int(now.Sub(d).Hours() / 24)
+		if age <= 0 {
+			// never touch the day currently being captured
+			continue
+		}
+		if r.expireDays > 0 && age >= r.expireDays {
+			if err := r.expireDay(day, report); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if r.compactDays > 0 && age >= r.compactDays && !day.tar {
+			if err := r.compactDay(&day, report); err != nil {
+				return report, err
+			}
+		} else if r.pruneFramesDays > 0 && age >= r.pruneFramesDays && !day.tar {
+			if err := r.pruneFrames(day, report); err != nil {
+				return report, err
+			}
+		}
+		remaining = append(remaining, day)
+	}
+
+	if r.minFreeBytes == 0 {
+		return report, nil
+	}
+	if r.expireMode == expireArchive {
+		// moving days to an archive on the same filesystem frees nothing,
+		// so it would only empty the images directory
+		same, err := util.SameFilesystem(r.imagesBaseDir, r.archiveDir)
+		if err != nil {
+			return report, fmt.Errorf("unable to compare filesystems of %s and %s: %w", r.imagesBaseDir, r.archiveDir, err)
+		}
+		if same {
+			logrus.Warnf("Skipping 'retention.min_free_mb'; archive_dir %s is on the same filesystem as the images", r.archiveDir)
+			return report, nil
+		}
+	}
+	// remaining is sorted oldest first; expire whole days until we are back
+	// above the minimum free space threshold
+	for _, day := range remaining {
+		free, err := r.diskFree(r.imagesBaseDir)
+		if err != nil {
+			return report, fmt.Errorf("unable to determine free space for %s: %w", r.imagesBaseDir, err)
+		}
+		if free >= r.minFreeBytes {
+			break
+		}
+		logrus.Warnf("Free space (%d MB) under retention threshold; expiring %s early", free/(1024*1024), day.date)
+		if err := r.expireDay(day, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func (r *Retention) listDays() ([]dayEntry, error) {
+	entries, err := os.ReadDir(r.imagesBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var days []dayEntry
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() && dayDirRegex.MatchString(name) {
+			days = append(days, dayEntry{date: name, path: filepath.Join(r.imagesBaseDir, name)})
+		} else if m := dayTarRegex.FindStringSubmatch(name); m != nil {
+			days = append(days, dayEntry{date: m[1], path: filepath.Join(r.imagesBaseDir, name), tar: true})
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].date < days[j].date })
+	return days, nil
+}
+
+// pruneFrames removes the raw bracket frames from each capture directory
+// of a day, keeping only the processed final.jpg
+func (r *Retention) pruneFrames(day dayEntry, report *RetentionReport) error {
+	captures, err := os.ReadDir(day.path)
+	if err != nil {
+		return fmt.Errorf("unable to read day directory %s: %w", day.path, err)
+	}
+	for _, c := range captures {
+		if !c.IsDir() {
+			continue
+		}
+		capDir := filepath.Join(day.path, c.Name())
+		if _, err := os.Stat(filepath.Join(capDir, "final.jpg")); err != nil {
+			// never processed; keep the frames in case they are wanted later
+			continue
+		}
+		files, err := os.ReadDir(capDir)
+		if err != nil {
+			return fmt.Errorf("unable to read capture directory %s: %w", capDir, err)
+		}
+		for _, f := range files {
+			if !rawFrameRegex.MatchString(f.Name()) {
+				continue
+			}
+			if info, err := f.Info(); err == nil {
+				report.BytesFreed += info.Size()
+			}
+			if err := os.Remove(filepath.Join(capDir, f.Name())); err != nil {
+				return fmt.Errorf("unable to remove frame %s: %w", f.Name(), err)
+			}
+			report.FramesRemoved++
+		}
+	}
+	return nil
+}
+
+func (r *Retention) compactDay(day *dayEntry, report *RetentionReport) error {
+	// compacting implies the raw frames are no longer needed either
+	if err := r.pruneFrames(*day, report); err != nil {
+		return err
+	}
+	switch r.compactMode {
+	case compactDownsize:
+		if _, err := os.Stat(filepath.Join(day.path, downsizedMarker)); err == nil {
+			return nil
+		}
+		before, _ := dirSize(day.path)
+		captures, err := os.ReadDir(day.path)
+		if err != nil {
+			return fmt.Errorf("unable to read day directory %s: %w", day.path, err)
+		}
+		for _, c := range captures {
+			capDir := filepath.Join(day.path, c.Name())
+			if _, err := os.Stat(filepath.Join(capDir, "final.jpg")); err != nil {
+				continue
+			}
+			if out, err := util.RunCommand("downsize", capDir, downsizeCmd); err != nil {
+				logrus.Errorf("Full output: %s", out)
+				return fmt.Errorf("unable to downsize %s/final.jpg: %w", capDir, err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(day.path, downsizedMarker), nil, 0644); err != nil {
+			return fmt.Errorf("unable to mark %s as downsized: %w", day.path, err)
+		}
+		after, _ := dirSize(day.path)
+		report.BytesFreed += before - after
+	case compactTar:
+		before, _ := dirSize(day.path)
+		tarPath := day.path + ".tar.gz"
+		if err := tarDirectory(day.path, tarPath); err != nil {
+			os.Remove(tarPath)
+			return fmt.Errorf("unable to create archive %s: %w", tarPath, err)
+		}
+		if err := os.RemoveAll(day.path); err != nil {
+			return fmt.Errorf("unable to remove compacted day %s: %w", day.path, err)
+		}
+		if info, err := os.Stat(tarPath); err == nil && info.Size() < before {
+			report.BytesFreed += before - info.Size()
+		}
+		day.path = tarPath
+		day.tar = true
+	}
+	report.DaysCompacted = append(report.DaysCompacted, day.date)
+	return nil
+}
+
+func (r *Retention) expireDay(day dayEntry, report *RetentionReport) error {
+	if r.removeImages {
+		// removed first so that a failure leaves the day to be expired
+		// again on the next pass
+		if err := r.publisher.RemovePrefix(fmt.Sprintf("images/%s/", day.date)); err != nil {
+			return err
+		}
+	}
+	size, _ := dirSize(day.path)
+	switch r.expireMode {
+	case expireArchive:
+		dest := filepath.Join(r.archiveDir, filepath.Base(day.path))
+		if err := movePath(day.path, dest); err != nil {
+			return fmt.Errorf("unable to move %s to archive: %w", day.path, err)
+		}
+	default:
+		if err := os.RemoveAll(day.path); err != nil {
+			return fmt.Errorf("unable to remove expired day %s: %w", day.path, err)
+		}
+	}
+	report.BytesFreed += size
+	report.DaysExpired = append(report.DaysExpired, day.date)
+	return nil
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// tarDirectory writes a gzip compressed tarball of dir to dest with entries
+// relative to the parent of dir
+func tarDirectory(dir, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	parent := filepath.Dir(dir)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// movePath renames src to dest, falling back to a copy and remove when the
+// archive location is on a different filesystem
+func movePath(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, strings.TrimPrefix(path, src))
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		return copyFile(path, target, info.Mode())
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// makeRetentionDays creates a capture directory with raw frames and a final
+// image, and one that was never processed, for each date under baseDir
+func makeRetentionDays(t *testing.T, baseDir string, dates ...string) {
+	t.Helper()
+	for _, date := range dates {
+		for capture, files := range map[string][]string{
+			"1200": {"00.jpg", "01.jpg", "prefinal.jpg", "final.jpg", "meta.json"},
+			"1210": {"00.jpg", "01.jpg"},
+		} {
+			dir := path.Join(baseDir, date, capture)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if err := os.WriteFile(path.Join(dir, f), []byte(f), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func newTestRetention(t *testing.T, baseDir string, retention map[string]interface{}) *Retention {
+	t.Helper()
+	retention["enabled"] = true
+	r, err := NewRetentionService(map[string]interface{}{
+		"images":    map[string]interface{}{"directory": baseDir},
+		"retention": retention,
+	}, make(chan error, 10), &Today{dateStr: "2023-06-30"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRetentionTiers(t *testing.T) {
+	base := t.TempDir()
+	makeRetentionDays(t, base, "2023-06-30", "2023-06-29", "2023-06-28", "2023-06-25", "2023-06-20")
+	// a day compacted by an earlier pass
+	if err := os.WriteFile(path.Join(base, "2023-06-22.tar.gz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRetention(t, base, map[string]interface{}{
+		"prune_frames_days": int64(2),
+		"compact_days":      int64(5),
+		"expire_days":       int64(10),
+	})
+	report, err := r.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// today and yesterday are untouched
+	for _, date := range []string{"2023-06-30", "2023-06-29"} {
+		if !fileExists(path.Join(base, date, "1200", "00.jpg")) {
+			t.Errorf("%s: raw frames were removed", date)
+		}
+	}
+	// after prune_frames_days only the final image of processed captures
+	// is kept
+	pruned := path.Join(base, "2023-06-28")
+	for file, want := range map[string]bool{
+		"1200/00.jpg":       false,
+		"1200/prefinal.jpg": false,
+		"1200/final.jpg":    true,
+		"1200/meta.json":    true,
+		"1210/00.jpg":       true,
+	} {
+		if got := fileExists(path.Join(pruned, file)); got != want {
+			t.Errorf("2023-06-28/%s exists is %v, want %v", file, got, want)
+		}
+	}
+	// after compact_days the day is tarred
+	if fileExists(path.Join(base, "2023-06-25")) || !fileExists(path.Join(base, "2023-06-25.tar.gz")) {
+		t.Errorf("2023-06-25 wasn't compacted")
+	}
+	if !fileExists(path.Join(base, "2023-06-22.tar.gz")) {
+		t.Errorf("an already compacted day was removed")
+	}
+	// after expire_days the day is deleted
+	if fileExists(path.Join(base, "2023-06-20")) {
+		t.Errorf("2023-06-20 wasn't expired")
+	}
+
+	if report.FramesRemoved != 6 {
+		t.Errorf("%d frames removed, want 6", report.FramesRemoved)
+	}
+	if !reflect.DeepEqual(report.DaysCompacted, []string{"2023-06-25"}) {
+		t.Errorf("compacted %v", report.DaysCompacted)
+	}
+	if !reflect.DeepEqual(report.DaysExpired, []string{"2023-06-20"}) {
+		t.Errorf("expired %v", report.DaysExpired)
+	}
+
+	// a second pass has nothing left to do
+	report, err = r.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FramesRemoved != 0 || len(report.DaysCompacted) != 0 || len(report.DaysExpired) != 0 {
+		t.Errorf("second pass did %+v", report)
+	}
+}
+
+func TestRetentionMinFree(t *testing.T) {
+	base := t.TempDir()
+	makeRetentionDays(t, base, "2023-06-27", "2023-06-28", "2023-06-29", "2023-06-30")
+	r := newTestRetention(t, base, map[string]interface{}{"min_free_mb": int64(1)})
+	// the disk is full until only two days are left
+	r.diskFree = func(string) (uint64, error) {
+		days, err := r.listDays()
+		if err != nil || len(days) > 2 {
+			return 0, err
+		}
+		return r.minFreeBytes, nil
+	}
+	report, err := r.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2023-06-27", "2023-06-28"}; !reflect.DeepEqual(report.DaysExpired, want) {
+		t.Errorf("expired %v, want the oldest days %v", report.DaysExpired, want)
+	}
+	if !fileExists(path.Join(base, "2023-06-29")) || !fileExists(path.Join(base, "2023-06-30")) {
+		t.Errorf("newer days were expired")
+	}
+
+	// today is never expired, however little space is left
+	r.diskFree = func(string) (uint64, error) { return 0, nil }
+	if _, err := r.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(path.Join(base, "2023-06-30")) {
+		t.Errorf("today was expired")
+	}
+
+	// moving days to an archive on the same filesystem frees nothing, so
+	// nothing is expired early
+	base = t.TempDir()
+	makeRetentionDays(t, base, "2023-06-28", "2023-06-29")
+	r = newTestRetention(t, base, map[string]interface{}{
+		"min_free_mb": int64(1),
+		"expire_mode": expireArchive,
+		"archive_dir": t.TempDir(),
+	})
+	r.diskFree = func(string) (uint64, error) { return 0, nil }
+	report, err = r.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.DaysExpired) != 0 {
+		t.Errorf("expired %v into an archive on the same filesystem", report.DaysExpired)
+	}
+}
+
+func TestRetentionConfigInvalid(t *testing.T) {
+	for name, retention := range map[string]map[string]interface{}{
+		"enabled not a bool":        {"enabled": "yes"},
+		"zero interval":             {"interval": int64(0)},
+		"negative interval":         {"interval": int64(-5)},
+		"interval not an int":       {"interval": "60"},
+		"negative prune":            {"prune_frames_days": int64(-1)},
+		"compact not an int":        {"compact_days": 1.5},
+		"expire not an int":         {"expire_days": "90"},
+		"negative min free":         {"min_free_mb": int64(-1)},
+		"prune after compact":       {"prune_frames_days": int64(14), "compact_days": int64(7)},
+		"compact after expire":      {"compact_days": int64(30), "expire_days": int64(10)},
+		"prune after expire":        {"prune_frames_days": int64(30), "expire_days": int64(10)},
+		"unknown compact mode":      {"compact_mode": "zip"},
+		"compact mode not a string": {"compact_mode": int64(1)},
+	} {
+		if _, ok := retention["enabled"]; !ok {
+			retention["enabled"] = true
+		}
+		_, err := NewRetentionService(map[string]interface{}{
+			"images":    map[string]interface{}{"directory": t.TempDir()},
+			"retention": retention,
+		}, nil, nil, nil)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// disabled tiers in between don't need to be in order
+	newTestRetention(t, t.TempDir(), map[string]interface{}{
+		"prune_frames_days": int64(2),
+		"compact_days":      int64(0),
+		"expire_days":       int64(90),
+	})
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultCaptureCmd = "libcamera-still --nopreview --immediate --ev {{.Bracket}} -o {{.Output}}"
+
+// Scheduler takes photos itself by running a local camera command at the
+// photo frequency within the capture window, replacing an external cron job
+// that polls /phototimez
+type Scheduler struct {
+	enabled    bool
+	captureCmd []*template.Template
+	brackets   []string
+	// whether the command applies the recommended EV shift
+	usesEVShift    bool
+	todayService   *Today
+	imageProcessor *ImageProcessor
+	errChan        chan error
+}
+
+// captureCmdData is available to each argument of the capture command
+type captureCmdData struct {
+	// Dir is the directory the capture's frames are written to
+	Dir string
+	// Output is the file the current frame should be written to
+	Output string
+	// Frame is the 1-based index of the current frame
+	Frame int
+	// Bracket is the current entry from the configured brackets
+	Bracket string
+	// EVShift is the recommended EV shift
+	EVShift float64
+}
+
+func NewScheduler(config map[string]interface{}, errChan chan error, todayService *Today, imageProcessor *ImageProcessor) (*Scheduler, error) {
+	enabled, err := util.GetBoolFromConfig(config, "scheduler.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Scheduler{}, nil
+	}
+	captureCmd, err := util.GetStringFromConfig(config, "scheduler.capture_command")
+	if err != nil || captureCmd == "" {
+		captureCmd = defaultCaptureCmd
+	}
+	brackets, err := util.GetStringSliceFromConfig(config, "scheduler.brackets")
+	if err != nil {
+		if _, ok := err.(*util.NoConfigEntryError); !ok {
+			return nil, err
+		}
+		brackets = []string{"-2", "-1", "0", "1", "2"}
+	}
+	if len(brackets) == 0 {
+		// a single run of the command, which may write any number of frames
+		brackets = []string{""}
+	}
+	if len(brackets) > 99 {
+		return nil, fmt.Errorf("invalid 'scheduler.brackets'; at most 99 are allowed")
+	}
+
+	// as with the timelapse encoder, each argument is its own template
+	var cmdTmpl []*template.Template
+	for i, arg := range strings.Fields(captureCmd) {
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'scheduler.capture_command' argument %q: %w", arg, err)
+		}
+		cmdTmpl = append(cmdTmpl, t)
+	}
+	return &Scheduler{
+		enabled:        true,
+		captureCmd:     cmdTmpl,
+		brackets:       brackets,
+		usesEVShift:    strings.Contains(captureCmd, ".EVShift"),
+		todayService:   todayService,
+		imageProcessor: imageProcessor,
+		errChan:        errChan,
+	}, nil
+}
+
+// Start runs the capture command at each multiple of the photo frequency
+func (s *Scheduler) Start() {
+	if !s.enabled {
+		return
+	}
+	logrus.Infof("Scheduling captures every %v", s.imageProcessor.Frequency())
+	go captureOnSchedule("running capture command", s.imageProcessor.Frequency(), s.todayService, s.Capture, s.errChan)
+}
+
+// Capture runs the capture command once for each bracket and commits the
+// frames written as a capture; it returns the capture directory
+func (s *Scheduler) Capture() (string, error) {
+	started := time.Now()
+	staging, err := s.imageProcessor.NewStagingDir()
+	if err != nil {
+		return "", err
+	}
+	evShift := 0.0
+	if s.usesEVShift {
+		evShift = s.todayService.EVShift()
+	}
+	if err := s.runCommand(staging, evShift); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	dir, err := s.imageProcessor.CommitCapture(staging, CaptureMeta{Time: started, Source: "scheduler", EVShift: &evShift})
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (s *Scheduler) runCommand(dir string, evShift float64) error {
+	for i, bracket := range s.brackets {
+		data := captureCmdData{
+			Dir:     dir,
+			Output:  path.Join(dir, fmt.Sprintf("%02d.jpg", i+1)),
+			Frame:   i + 1,
+			Bracket: bracket,
+			EVShift: evShift,
+		}
+		cmd := make([]string, 0, len(s.captureCmd))
+		for _, t := range s.captureCmd {
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				return err
+			}
+			cmd = append(cmd, buf.String())
+		}
+		out, err := util.RunCommand("capture", dir, cmd)
+		if err != nil {
+			logrus.Errorf("Full output: %s", out)
+			return fmt.Errorf("capture command for frame %d failed: %w", i+1, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if frameRegex.MatchString(e.Name()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("capture command wrote no frames (NN.jpg) to %s", dir)
+}
+
+// captureOnSchedule calls capture at each multiple of freq (e.g. on the
+// hour and every 5 minutes after) while in today's capture window
+func captureOnSchedule(desc string, freq time.Duration, today *Today, capture func() (string, error), errChan chan error) {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(freq).Add(freq).Sub(now))
+		if !today.InCaptureWindow(time.Now()) {
+			continue
+		}
+		if _, err := capture(); err != nil {
+			logrus.Errorf("Error %s: %v", desc, err)
+			errChan <- err
+		}
+	}
+}
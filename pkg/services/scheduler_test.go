@@ -0,0 +1,160 @@
+package services
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCamera writes a capture command script that logs its arguments to
+// the returned file and, if writeFrame is set, writes a JPEG to its second
+// argument
+func fakeCamera(t *testing.T, writeFrame bool) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	log := path.Join(dir, "args.log")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n"
+	if writeFrame {
+		script += "printf '\\377\\330\\377' > \"$2\"\n"
+	}
+	cmd := path.Join(dir, "camera.sh")
+	if err := os.WriteFile(cmd, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, log
+}
+
+func newTestScheduler(t *testing.T, ip *ImageProcessor, command string, brackets []interface{}) *Scheduler {
+	t.Helper()
+	scheduler := map[string]interface{}{
+		"enabled":         true,
+		"capture_command": command,
+	}
+	if brackets != nil {
+		scheduler["brackets"] = brackets
+	}
+	s, err := NewScheduler(map[string]interface{}{"scheduler": scheduler}, make(chan error, 10), nil, ip)
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+	return s
+}
+
+func TestSchedulerCapture(t *testing.T) {
+	cmd, log := fakeCamera(t, true)
+	ip := newTestProcessor(t)
+	s := newTestScheduler(t, ip, cmd+" {{.Bracket}} {{.Output}} {{.Frame}}", []interface{}{"-1", "0", "+1"})
+	dir, err := s.Capture()
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	jpeg := []byte{0xff, 0xd8, 0xff}
+	checkCapture(t, dir, [][]byte{jpeg, jpeg, jpeg}, "scheduler")
+	checkNoStaging(t, ip)
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("command ran %d times, want 3", len(lines))
+	}
+	staging := path.Join(ip.imagesBaseDir, stagingDir)
+	for i, want := range []struct{ bracket, output, frame string }{
+		{"-1", "01.jpg", "1"},
+		{"0", "02.jpg", "2"},
+		{"+1", "03.jpg", "3"},
+	} {
+		args := strings.Fields(lines[i])
+		if len(args) != 3 {
+			t.Fatalf("run %d: args %q", i+1, lines[i])
+		}
+		if args[0] != want.bracket || args[2] != want.frame {
+			t.Errorf("run %d: args %q, want bracket %s and frame %s", i+1, lines[i], want.bracket, want.frame)
+		}
+		// frames are written to the staging directory before the capture
+		// is committed
+		if path.Base(args[1]) != want.output || !strings.HasPrefix(args[1], staging+"/") {
+			t.Errorf("run %d: output %s, want %s in %s", i+1, args[1], want.output, staging)
+		}
+	}
+}
+
+func TestSchedulerSingleRun(t *testing.T) {
+	cmd, log := fakeCamera(t, true)
+	ip := newTestProcessor(t)
+	// without brackets the command runs once with an empty bracket
+	s := newTestScheduler(t, ip, cmd+" x{{.Bracket}} {{.Dir}}/01.jpg", []interface{}{})
+	if _, err := s.Capture(); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Fields(string(data)); len(args) != 2 || args[0] != "x" {
+		t.Errorf("args %q, want a single run with an empty bracket", data)
+	}
+}
+
+func TestSchedulerNoFrames(t *testing.T) {
+	cmd, _ := fakeCamera(t, false)
+	ip := newTestProcessor(t)
+	s := newTestScheduler(t, ip, cmd+" {{.Bracket}} {{.Output}}", []interface{}{"0"})
+	if dir, err := s.Capture(); err == nil || !strings.Contains(err.Error(), "no frames") {
+		t.Fatalf("Capture returned %q, %v; want a missing frames error", dir, err)
+	}
+	checkNoStaging(t, ip)
+}
+
+func TestSchedulerCommandFails(t *testing.T) {
+	ip := newTestProcessor(t)
+	s := newTestScheduler(t, ip, "/bin/false {{.Output}}", nil)
+	if dir, err := s.Capture(); err == nil {
+		t.Fatalf("captured %s, expected an error", dir)
+	}
+	checkNoStaging(t, ip)
+}
+
+func TestCaptureOnSchedule(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		today   *Today
+		capture bool
+	}{
+		{"in window", &Today{sunrise: now.Add(-time.Hour).Unix(), sunset: now.Add(time.Hour).Unix(), darkPercent: 100}, true},
+		{"after sunset", &Today{sunrise: now.Add(-12 * time.Hour).Unix(), sunset: now.Add(-2 * time.Hour).Unix(), darkPercent: 100}, false},
+		{"before sunrise", &Today{sunrise: now.Add(2 * time.Hour).Unix(), sunset: now.Add(12 * time.Hour).Unix(), darkPercent: 100}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			capture := func() (string, error) {
+				atomic.AddInt32(&calls, 1)
+				return "", nil
+			}
+			go captureOnSchedule("testing", 10*time.Millisecond, tt.today, capture, make(chan error, 10))
+			time.Sleep(100 * time.Millisecond)
+			if n := atomic.LoadInt32(&calls); (n > 0) != tt.capture {
+				t.Errorf("capture called %d times, want calls: %v", n, tt.capture)
+			}
+		})
+	}
+}
+
+func TestSchedulerEnabledInvalid(t *testing.T) {
+	if _, err := NewScheduler(map[string]interface{}{
+		"scheduler": map[string]interface{}{"enabled": "yes"},
+	}, nil, nil, nil); err == nil {
+		t.Errorf("an invalid 'scheduler.enabled' was accepted")
+	}
+	s, err := NewScheduler(map[string]interface{}{}, nil, nil, nil)
+	if err != nil || s.enabled {
+		t.Errorf("without a [scheduler] section: %+v, %v", s, err)
+	}
+}
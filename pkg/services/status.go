@@ -0,0 +1,62 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// ErrorLog keeps the most recent errors reported on the error channel so
+// they can be inspected through the status endpoint
+type ErrorLog struct {
+	lock    sync.Mutex
+	size    int
+	entries []ErrorEntry
+}
+
+type ErrorEntry struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// PublishResult records the outcome of publishing a processed image
+type PublishResult struct {
+	Time  time.Time `json:"time"`
+	Keys  []string  `json:"keys"`
+	Error string    `json:"error,omitempty"`
+}
+
+// ProcessorStatus is a snapshot of the image processing pipeline
+type ProcessorStatus struct {
+	WatchedDir    string             `json:"watched_dir"`
+	WatcherActive bool               `json:"watcher_active"`
+	QueueDepth    int                `json:"queue_depth"`
+	LastCapture   string             `json:"last_capture,omitempty"`
+	LastProcessed *time.Time         `json:"last_processed,omitempty"`
+	StepSeconds   map[string]float64 `json:"step_seconds,omitempty"`
+	LastPublish   *PublishResult     `json:"last_publish,omitempty"`
+	Outbox        *OutboxStatus      `json:"outbox,omitempty"`
+}
+
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{size: size}
+}
+
+func (e *ErrorLog) Record(err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.entries = append(e.entries, ErrorEntry{Time: time.Now(), Error: err.Error()})
+	if len(e.entries) > e.size {
+		e.entries = e.entries[len(e.entries)-e.size:]
+	}
+}
+
+// Recent returns the logged errors, newest first
+func (e *ErrorLog) Recent() []ErrorEntry {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	recent := make([]ErrorEntry, 0, len(e.entries))
+	for i := len(e.entries) - 1; i >= 0; i-- {
+		recent = append(recent, e.entries[i])
+	}
+	return recent
+}
@@ -0,0 +1,362 @@
+package services
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// names of the website's page templates
+const (
+	PageIndex        = "index"
+	PageOffline      = "offline"
+	PageArchiveDay   = "archive-day"
+	PageArchiveMonth = "archive-month"
+
+	partialsDir    = "partials"
+	reloadDebounce = time.Second
+)
+
+// Templates holds the website's page templates. Each page is parsed along
+// with the shared partials (every *.tmpl file in the "partials" directory
+// under 'website.template_dir') and checked by rendering it with sample
+// data, so that template errors are found at startup. Once watched, the
+// templates are parsed again whenever one of their files changes; a change
+// that fails to parse or render is reported and the previous templates are
+// kept
+type Templates struct {
+	dir      string
+	location *time.Location
+	errChan  chan error
+
+	lock        sync.RWMutex
+	pages       map[string]*pageTemplate
+	reloadFuncs []reloadEntry
+}
+
+type pageTemplate struct {
+	file string
+	tmpl *template.Template
+}
+
+type reloadEntry struct {
+	name string
+	fn   func() error
+}
+
+// NewTemplates parses and checks the configured page templates; the archive
+// templates are only loaded when [archive] is enabled
+func NewTemplates(config map[string]interface{}, errChan chan error) (*Templates, error) {
+	location, err := websiteLocation(config)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := util.GetStringFromConfig(config, "website.template_dir")
+	if err != nil {
+		dir = ""
+	}
+	ts := &Templates{dir: dir, location: location, errChan: errChan, pages: map[string]*pageTemplate{}}
+
+	files := map[string]string{}
+	for page, key := range map[string]string{PageIndex: "website.page_template", PageOffline: "website.offline_page"} {
+		file, err := util.GetStringFromConfig(config, key)
+		if err != nil {
+			return nil, fmt.Errorf("can't retrieve entry '%s' from config: %w", key, err)
+		}
+		files[page] = file
+	}
+	if enabled, err := util.GetBoolFromConfig(config, "archive.enabled"); err == nil && enabled {
+		for page, key := range map[string]string{PageArchiveDay: "archive.day_template", PageArchiveMonth: "archive.month_template"} {
+			file, err := util.GetStringFromConfig(config, key)
+			if err != nil {
+				return nil, fmt.Errorf("can't retrieve entry '%s' from config: %w", key, err)
+			}
+			files[page] = file
+		}
+	}
+	for page, file := range files {
+		// relative template paths are found in the template directory
+		if !filepath.IsAbs(file) && dir != "" {
+			file = filepath.Join(dir, file)
+		}
+		ts.pages[page] = &pageTemplate{file: file}
+	}
+	pages, err := ts.parse()
+	if err != nil {
+		return nil, err
+	}
+	ts.pages = pages
+	return ts, nil
+}
+
+// parse parses and checks every page, returning the new set of pages
+func (ts *Templates) parse() (map[string]*pageTemplate, error) {
+	var partials []string
+	if ts.dir != "" {
+		var err error
+		partials, err = filepath.Glob(filepath.Join(ts.dir, partialsDir, "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	pages := map[string]*pageTemplate{}
+	for page, pt := range ts.pages {
+		// partials are parsed first so that a page can override the
+		// {{block}} defaults of a shared layout
+		tmpl := template.New(filepath.Base(pt.file)).Funcs(templateFuncs(ts.location))
+		if len(partials) > 0 {
+			if _, err := tmpl.ParseFiles(partials...); err != nil {
+				return nil, fmt.Errorf("unable to parse partials for the %s page: %w", page, err)
+			}
+		}
+		if _, err := tmpl.ParseFiles(pt.file); err != nil {
+			return nil, fmt.Errorf("unable to parse the %s page template: %w", page, err)
+		}
+		if err := tmpl.Execute(io.Discard, samplePageData(page, ts.location)); err != nil {
+			return nil, fmt.Errorf("the %s page template %s fails to render: %w", page, pt.file, err)
+		}
+		pages[page] = &pageTemplate{file: pt.file, tmpl: tmpl}
+	}
+	return pages, nil
+}
+
+// Pages returns the names of the configured pages
+func (ts *Templates) Pages() []string {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	var names []string
+	for page := range ts.pages {
+		names = append(names, page)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Execute renders a page with data to w
+func (ts *Templates) Execute(w io.Writer, page string, data interface{}) error {
+	ts.lock.RLock()
+	pt, ok := ts.pages[page]
+	ts.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no %s page template is configured", page)
+	}
+	return pt.tmpl.Execute(w, data)
+}
+
+// OnReload registers a function to run after the templates are reloaded,
+// e.g. to publish the page again
+func (ts *Templates) OnReload(name string, fn func() error) {
+	ts.reloadFuncs = append(ts.reloadFuncs, reloadEntry{name: name, fn: fn})
+}
+
+// Watch starts reloading the templates when their files change
+func (ts *Templates) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create template watcher: %w", err)
+	}
+	// as with certificates, directories are watched so that files replaced
+	// by rename (as many editors save them) are still noticed
+	dirs := map[string]bool{}
+	if ts.dir != "" {
+		dirs[ts.dir] = true
+		dirs[filepath.Join(ts.dir, partialsDir)] = true
+	}
+	ts.lock.RLock()
+	for _, pt := range ts.pages {
+		dirs[filepath.Dir(pt.file)] = true
+	}
+	ts.lock.RUnlock()
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			logrus.Warnf("unable to watch template directory %s: %v", dir, err)
+		}
+	}
+	go ts.watch(watcher)
+	return nil
+}
+
+func (ts *Templates) watch(watcher *fsnotify.Watcher) {
+	// editors often write a file in several steps, so reload once changes
+	// have settled
+	reload := time.NewTimer(reloadDebounce)
+	reload.Stop()
+	for {
+		select {
+		case e := <-watcher.Events:
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 || !ts.isTemplateFile(e.Name) {
+				continue
+			}
+			reload.Reset(reloadDebounce)
+		case <-reload.C:
+			ts.reload()
+		case err := <-watcher.Errors:
+			logrus.Errorf("template watcher error: %v", err)
+		}
+	}
+}
+
+func (ts *Templates) isTemplateFile(name string) bool {
+	name = filepath.Clean(name)
+	if filepath.Ext(name) == ".tmpl" && ts.dir != "" && filepath.Dir(name) == filepath.Join(ts.dir, partialsDir) {
+		return true
+	}
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	for _, pt := range ts.pages {
+		if name == filepath.Clean(pt.file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *Templates) reload() {
+	ts.lock.RLock()
+	pages, err := ts.parse()
+	ts.lock.RUnlock()
+	if err != nil {
+		logrus.Errorf("Templates not reloaded: %v", err)
+		ts.errChan <- fmt.Errorf("templates not reloaded: %w", err)
+		return
+	}
+	ts.lock.Lock()
+	ts.pages = pages
+	ts.lock.Unlock()
+	logrus.Info("Reloaded website templates")
+	for _, r := range ts.reloadFuncs {
+		if err := r.fn(); err != nil {
+			logrus.Errorf("unable to update %s after template reload: %v", r.name, err)
+		}
+	}
+}
+
+// websiteLocation returns the time zone that pages are rendered in, from
+// 'website.timezone' (an IANA name such as "America/Toronto"), defaulting
+// to the system time zone
+func websiteLocation(config map[string]interface{}) (*time.Location, error) {
+	tz, err := util.GetStringFromConfig(config, "website.timezone")
+	if err != nil || tz == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'website.timezone': %w", err)
+	}
+	return loc, nil
+}
+
+// templateFuncs are available to all of the website's page templates;
+// times are formatted in loc and zero times (events that don't happen)
+// format as empty strings
+func templateFuncs(loc *time.Location) template.FuncMap {
+	formatTime := func(layout string, t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.In(loc).Format(layout)
+	}
+	return template.FuncMap{
+		"localtime":  func(t time.Time) time.Time { return t.In(loc) },
+		"formatTime": formatTime,
+		"clock":      func(t time.Time) string { return formatTime("15:04", t) },
+		"duration":   func(d time.Duration) string { return formatDuration(d, false) },
+		"change":     func(d time.Duration) string { return formatDuration(d, true) },
+		"percent":    func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+	}
+}
+
+// formatDuration formats d as "10h 32m", or with signed as a change such as
+// "+2m 14s"
+func formatDuration(d time.Duration, signed bool) string {
+	sign := ""
+	if signed {
+		sign = "+"
+	}
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	if signed && d < time.Hour {
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%s%dm %02ds", sign, int(d.Minutes()), int(d.Seconds())%60)
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%s%dh %02dm", sign, int(d.Hours()), int(d.Minutes())%60)
+}
+
+// SampleData returns made up data for a page, used to check the templates
+// and to preview them
+func (ts *Templates) SampleData(page string) interface{} {
+	return samplePageData(page, ts.location)
+}
+
+func samplePageData(page string, loc *time.Location) interface{} {
+	now := time.Now().In(loc)
+	today := now.Format("2006-01-02")
+	temp := float32(18.5)
+	weather := &Weather{
+		Coord:       CoordSection{Lat: 43.45, Lon: -80.49},
+		Main:        MainSection{Temp: temp, FeelsLike: 17.9, Humidity: 62, Pressure: 1014, TempMax: 21.0, TempMin: 12.5},
+		WeatherDesc: []WeatherDesc{{Description: "scattered clouds", Icon: "03d", ID: 802, Main: "Clouds"}},
+		Wind:        WindSection{Deg: 240, Speed: 4.1},
+	}
+	almanac := newAlmanac(now, loc, weather.Coord.Lat, weather.Coord.Lon)
+	weather.Sys = SysSection{Sunrise: almanac.Sunrise.Unix(), Sunset: almanac.Sunset.Unix()}
+	base := "https://example.com/archive/" + today + "/"
+
+	switch page {
+	case PageOffline:
+		until := now.Add(2 * time.Hour)
+		return OfflinePageData{
+			Today:     today,
+			Since:     now.Add(-time.Hour),
+			Message:   "The camera is being cleaned",
+			Until:     until.Format("Mon Jan 2 15:04 MST"),
+			UntilTime: &until,
+		}
+	case PageArchiveDay:
+		var captures []ArchiveCapture
+		for i, name := range []string{"0900", "1200", "1500"} {
+			t := almanac.Date.Add(time.Duration(9+3*i) * time.Hour)
+			captures = append(captures, ArchiveCapture{
+				Name: name, Time: t, Image: base + name + ".jpg", Thumb: base + name + "-thumb.jpg",
+				Temp: &temp, TempUnit: "C", Weather: "scattered clouds",
+			})
+		}
+		return ArchiveDayPage{
+			Date: today, Time: almanac.Date, Captures: captures, Highlight: &captures[1],
+			MonthURL: "https://example.com/archive/" + today[:7] + "/index.html",
+			Prev:     almanac.Date.AddDate(0, 0, -1).Format("2006-01-02"), PrevURL: "https://example.com/archive/prev/index.html",
+		}
+	case PageArchiveMonth:
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		page := ArchiveMonthPage{Month: month.Format("2006-01"), Time: month, Weekdays: weekdayNames()}
+		page.Weeks = calendarWeeks(month, func(cd *ArchiveCalendarDay) {
+			if cd.Day <= now.Day() {
+				cd.Captures = 100
+				cd.URL = "https://example.com/archive/" + cd.Date + "/index.html"
+				cd.Thumb = "https://example.com/archive/" + cd.Date + "/1200-thumb.jpg"
+				page.Days++
+			}
+		})
+		return page
+	}
+	return PageData{
+		Today:   today,
+		Sunrise: almanac.Sunrise.Format("15:04"),
+		Sunset:  almanac.Sunset.Format("15:04"),
+		Images:  []Derivative{{Name: "latest-640.jpg", Width: 640}, {Name: "latest.jpg"}},
+		Srcset:  "latest-640.jpg 640w, latest.jpg 4056w",
+		Weather: weather,
+		Almanac: almanac,
+	}
+}
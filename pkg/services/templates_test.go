@@ -0,0 +1,168 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTemplates writes files, named relative to dir, into dir
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func templatesConfig(dir string, archive bool) map[string]interface{} {
+	return map[string]interface{}{
+		"website": map[string]interface{}{
+			"template_dir":  dir,
+			"page_template": "index.html",
+			"offline_page":  "offline.html",
+		},
+		"archive": map[string]interface{}{
+			"enabled":        archive,
+			"day_template":   "day.html",
+			"month_template": "month.html",
+		},
+	}
+}
+
+func render(t *testing.T, ts *Templates, page string, data interface{}) string {
+	t.Helper()
+	var b strings.Builder
+	if err := ts.Execute(&b, page, data); err != nil {
+		t.Fatalf("rendering the %s page: %v", page, err)
+	}
+	return b.String()
+}
+
+func TestTemplatesPartials(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{
+		"partials/layout.tmpl": `{{define "layout"}}<title>{{block "title" .}}Webcam{{end}}</title>{{end}}`,
+		"index.html":           `{{define "title"}}Webcam {{.Today}}{{end}}{{template "layout" .}}`,
+		"offline.html":         `{{template "layout" .}} {{.Message}}`,
+	})
+	ts, err := NewTemplates(templatesConfig(dir, false), make(chan error, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a page overrides the layout's block defaults only for itself
+	if page := render(t, ts, PageIndex, PageData{Today: "2023-06-30"}); page != "<title>Webcam 2023-06-30</title>" {
+		t.Errorf("index page %q", page)
+	}
+	if page := render(t, ts, PageOffline, OfflinePageData{Message: "cleaning"}); page != "<title>Webcam</title> cleaning" {
+		t.Errorf("offline page %q", page)
+	}
+	// the archive pages are only loaded with [archive] enabled
+	if pages := ts.Pages(); strings.Join(pages, ",") != "index,offline" {
+		t.Errorf("pages %v without an archive", pages)
+	}
+	if err := ts.Execute(&strings.Builder{}, PageArchiveDay, nil); err == nil {
+		t.Error("rendered an archive page without an archive")
+	}
+
+	writeTemplates(t, dir, map[string]string{
+		"day.html":   `{{template "layout" .}} {{len .Captures}} captures`,
+		"month.html": `{{.Month}}: {{.Days}} days`,
+	})
+	ts, err = NewTemplates(templatesConfig(dir, true), make(chan error, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := ts.Pages(); strings.Join(pages, ",") != "archive-day,archive-month,index,offline" {
+		t.Errorf("pages %v with an archive", pages)
+	}
+	if page := render(t, ts, PageArchiveDay, ArchiveDayPage{}); page != "<title>Webcam</title> 0 captures" {
+		t.Errorf("archive day page %q", page)
+	}
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"page parse error", map[string]string{"index.html": `{{if .Today}}`}, "unable to parse the index page"},
+		{"partial parse error", map[string]string{"partials/layout.tmpl": `{{end}}`}, "unable to parse partials"},
+		// errors that only show when rendering are found with the sample data
+		{"unknown field", map[string]string{"index.html": `{{.Forecast}}`}, "fails to render"},
+		{"wrong page data", map[string]string{"offline.html": `{{.Sunrise}}`}, "the offline page template"},
+		{"missing template", map[string]string{"index.html": `{{template "header" .}}`}, "fails to render"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{"index.html": `{{.Today}}`, "offline.html": `{{.Message}}`})
+		writeTemplates(t, dir, tt.files)
+		_, err := NewTemplates(templatesConfig(dir, false), make(chan error, 10))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{"index.html": `{{.Today}}`})
+	if _, err := NewTemplates(templatesConfig(dir, false), nil); err == nil {
+		t.Error("a missing offline page template was accepted")
+	}
+	config := templatesConfig(dir, false)
+	delete(config["website"].(map[string]interface{}), "offline_page")
+	if _, err := NewTemplates(config, nil); err == nil || !strings.Contains(err.Error(), "offline_page") {
+		t.Errorf("without website.offline_page: %v", err)
+	}
+}
+
+func TestTemplatesReload(t *testing.T) {
+	ts := newTestTemplates(t, `index {{.Today}}`, `offline {{.Message}}`)
+	reloads := 0
+	ts.OnReload("today's page", func() error {
+		reloads++
+		return nil
+	})
+	index := filepath.Join(ts.dir, "index.html")
+	if !ts.isTemplateFile(index) || !ts.isTemplateFile(filepath.Join(ts.dir, partialsDir, "layout.tmpl")) {
+		t.Error("a page or partial isn't watched")
+	}
+	if ts.isTemplateFile(filepath.Join(ts.dir, "index.html~")) || ts.isTemplateFile(filepath.Join(ts.dir, "notes.tmpl")) {
+		t.Error("a file that isn't a template is watched")
+	}
+
+	writeTemplates(t, ts.dir, map[string]string{"index.html": `today {{.Today}}`})
+	ts.reload()
+	if page := render(t, ts, PageIndex, PageData{Today: "2023-06-30"}); page != "today 2023-06-30" {
+		t.Errorf("index page %q after a reload", page)
+	}
+	if reloads != 1 {
+		t.Errorf("reload functions ran %d times, want once", reloads)
+	}
+
+	// a broken change is reported and the previous templates are kept
+	for _, broken := range []string{`today {{.Today`, `today {{.Forecast}}`} {
+		writeTemplates(t, ts.dir, map[string]string{"index.html": broken})
+		ts.reload()
+		select {
+		case err := <-ts.errChan:
+			if !strings.Contains(err.Error(), "templates not reloaded") {
+				t.Errorf("%q: reported %v", broken, err)
+			}
+		default:
+			t.Errorf("%q: the failed reload wasn't reported", broken)
+		}
+		if page := render(t, ts, PageIndex, PageData{Today: "2023-06-30"}); page != "today 2023-06-30" {
+			t.Errorf("%q: index page %q, want the previous template", broken, page)
+		}
+	}
+	if reloads != 1 {
+		t.Errorf("reload functions ran %d times after failed reloads, want once", reloads)
+	}
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+const (
+	fallbackGIF = "gif"
+	fallbackAVI = "avi"
+
+	// animated GIFs are held in memory until encoded, so keep them small
+	gifMaxWidth = 640
+
+	defaultEncoderCmd = "ffmpeg -y -loglevel error -framerate {{.Framerate}} -i {{.Input}} -c:v libx264 -pix_fmt yuv420p {{.Output}}"
+)
+
+// Timelapse assembles the processed images of a day into a video once the
+// day has rolled over and publishes it under a dated key
+type Timelapse struct {
+	enabled    bool
+	encoderCmd []*template.Template
+	format     string
+	fallback   string
+	framerate  int
+	width      int
+	height     int
+	deflicker  int
+	publisher  *Publisher
+	errChan    chan error
+}
+
+type encoderCmdData struct {
+	Input     string
+	Output    string
+	Framerate int
+	Width     int
+	Height    int
+}
+
+var contentTypes = map[string]string{
+	"mp4":  "video/mp4",
+	"webm": "video/webm",
+	"gif":  "image/gif",
+	"avi":  "video/x-msvideo",
+}
+
+func NewTimelapseService(config map[string]interface{}, errChan chan error, publisher *Publisher) (*Timelapse, error) {
+	enabled, err := util.GetBoolFromConfig(config, "timelapse.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Timelapse{}, nil
+	}
+	encoderCmd, err := util.GetStringFromConfig(config, "timelapse.encoder_command")
+	if err != nil {
+		encoderCmd = defaultEncoderCmd
+	}
+	format, err := util.GetStringFromConfig(config, "timelapse.format")
+	if err != nil {
+		format = "mp4"
+	}
+	fallback, err := util.GetStringFromConfig(config, "timelapse.fallback")
+	if err != nil {
+		fallback = fallbackGIF
+	}
+	if fallback != fallbackGIF && fallback != fallbackAVI {
+		return nil, fmt.Errorf("invalid 'timelapse.fallback' %q; must be %q or %q", fallback, fallbackGIF, fallbackAVI)
+	}
+	framerate, err := util.GetIntFromConfig(config, "timelapse.framerate")
+	if err != nil || framerate <= 0 {
+		framerate = 24
+	}
+	width, _ := util.GetIntFromConfig(config, "timelapse.width")
+	height, _ := util.GetIntFromConfig(config, "timelapse.height")
+	deflicker, _ := util.GetIntFromConfig(config, "timelapse.deflicker")
+
+	// each argument is its own template so that substituted paths are never
+	// split on whitespace
+	var cmdTmpl []*template.Template
+	for i, arg := range strings.Fields(encoderCmd) {
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timelapse.encoder_command' argument %q: %w", arg, err)
+		}
+		cmdTmpl = append(cmdTmpl, t)
+	}
+
+	return &Timelapse{
+		enabled:    true,
+		encoderCmd: cmdTmpl,
+		format:     format,
+		fallback:   fallback,
+		framerate:  int(framerate),
+		width:      int(width),
+		height:     int(height),
+		deflicker:  int(deflicker),
+		publisher:  publisher,
+		errChan:    errChan,
+	}, nil
+}
+
+// Generate builds and publishes the timelapse for the captures in dayDir
+func (tl *Timelapse) Generate(date, dayDir string) error {
+	if !tl.enabled {
+		return nil
+	}
+	captures, err := listCaptures(dayDir)
+	if err != nil {
+		return fmt.Errorf("unable to list captures in %s: %w", dayDir, err)
+	}
+	if len(captures) < 2 {
+		logrus.Infof("Not enough captures (%d) for a timelapse of %s", len(captures), date)
+		return nil
+	}
+
+	framesDir, err := os.MkdirTemp(dayDir, ".timelapse")
+	if err != nil {
+		return fmt.Errorf("unable to create frames directory: %w", err)
+	}
+	defer os.RemoveAll(framesDir)
+
+	frames, err := tl.prepareFrames(captures, framesDir)
+	if err != nil {
+		return err
+	}
+	if len(frames) < 2 {
+		// the other captures couldn't be decoded
+		logrus.Infof("Not enough usable frames (%d) for a timelapse of %s", len(frames), date)
+		return nil
+	}
+
+	format := tl.format
+	output := path.Join(dayDir, "timelapse."+format)
+	if err := tl.encode(framesDir, output); err != nil {
+		logrus.Warnf("Timelapse encoder failed for %s (%v); using %s fallback", date, err, tl.fallback)
+		format = tl.fallback
+		output = path.Join(dayDir, "timelapse."+format)
+		if format == fallbackAVI {
+			err = tl.writeAVI(frames, output)
+		} else {
+			err = tl.writeGIF(frames, output)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to write %s timelapse: %w", format, err)
+		}
+	}
+	logrus.Infof("Timelapse for %s created from %d frames: %s", date, len(frames), output)
+
+	return tl.publisher.Publish(output, timelapseKey(date, format), PublishOptions{
+		ContentType:  contentTypes[format],
+		CacheControl: "public, max-age=31536000",
+	})
+}
+
+// Key returns the bucket key of the timelapse generated in dayDir for
+// date, or an empty string if there is none
+func (tl *Timelapse) Key(date, dayDir string) string {
+	if !tl.enabled {
+		return ""
+	}
+	for _, format := range []string{tl.format, tl.fallback} {
+		if _, err := os.Stat(path.Join(dayDir, "timelapse."+format)); err == nil {
+			return timelapseKey(date, format)
+		}
+	}
+	return ""
+}
+
+func timelapseKey(date, format string) string {
+	return fmt.Sprintf("timelapse/%s.%s", date, format)
+}
+
+// prepareFrames writes resized, numbered frames to framesDir and evens out
+// brightness changes between neighbouring frames when deflicker is enabled
+func (tl *Timelapse) prepareFrames(captures []string, framesDir string) ([]string, error) {
+	var (
+		frames []string
+		lum    []float64
+	)
+	for _, capDir := range captures {
+		img, err := loadJPEG(path.Join(capDir, "final.jpg"))
+		if err != nil {
+			logrus.Warnf("Skipping %s in timelapse: %v", capDir, err)
+			continue
+		}
+		resized := resizeImage(img, tl.width, tl.height)
+		// most video encoders require even dimensions
+		b := resized.Bounds()
+		even := resized.SubImage(image.Rect(0, 0, b.Dx()&^1, b.Dy()&^1))
+		frame := path.Join(framesDir, fmt.Sprintf("frame_%05d.jpg", len(frames)))
+		if err := saveJPEG(frame, even, 90); err != nil {
+			return nil, fmt.Errorf("unable to write timelapse frame %s: %w", frame, err)
+		}
+		frames = append(frames, frame)
+		lum = append(lum, meanLuminance(even))
+	}
+	if tl.deflicker < 2 {
+		return frames, nil
+	}
+	half := tl.deflicker / 2
+	for i, frame := range frames {
+		lo, hi := i-half, i+half
+		if lo < 0 {
+			lo = 0
+		}
+		if hi >= len(lum) {
+			hi = len(lum) - 1
+		}
+		var sum float64
+		for j := lo; j <= hi; j++ {
+			sum += lum[j]
+		}
+		target := sum / float64(hi-lo+1)
+		if lum[i] < 1 {
+			continue
+		}
+		gain := target / lum[i]
+		if gain > 0.99 && gain < 1.01 {
+			continue
+		}
+		if gain < 0.5 {
+			gain = 0.5
+		} else if gain > 2.0 {
+			gain = 2.0
+		}
+		img, err := loadJPEG(frame)
+		if err != nil {
+			return nil, fmt.Errorf("unable to reload timelapse frame %s: %w", frame, err)
+		}
+		if err := saveJPEG(frame, scaleBrightness(img, gain), 90); err != nil {
+			return nil, fmt.Errorf("unable to write timelapse frame %s: %w", frame, err)
+		}
+	}
+	return frames, nil
+}
+
+func (tl *Timelapse) encode(framesDir, output string) error {
+	if len(tl.encoderCmd) == 0 {
+		return fmt.Errorf("no encoder command configured")
+	}
+	data := encoderCmdData{
+		Input:     path.Join(framesDir, "frame_%05d.jpg"),
+		Output:    output,
+		Framerate: tl.framerate,
+		Width:     tl.width,
+		Height:    tl.height,
+	}
+	cmd := make([]string, 0, len(tl.encoderCmd))
+	for _, t := range tl.encoderCmd {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return err
+		}
+		cmd = append(cmd, buf.String())
+	}
+	out, err := util.RunCommand("timelapse", framesDir, cmd)
+	if err != nil {
+		logrus.Errorf("Full output: %s", out)
+		return err
+	}
+	return nil
+}
+
+func (tl *Timelapse) writeGIF(frames []string, output string) error {
+	anim := &gif.GIF{}
+	delay := 100 / tl.framerate
+	if delay < 2 {
+		// most browsers treat delays under 2 (hundredths) as 10
+		delay = 2
+	}
+	for _, frame := range frames {
+		img, err := loadJPEG(frame)
+		if err != nil {
+			return err
+		}
+		if img.Bounds().Dx() > gifMaxWidth {
+			img = resizeImage(img, gifMaxWidth, 0)
+		}
+		b := img.Bounds()
+		p := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette.Plan9)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), img, b.Min)
+		anim.Image = append(anim.Image, p)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, anim); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (tl *Timelapse) writeAVI(frames []string, output string) error {
+	first, err := loadJPEG(frames[0])
+	if err != nil {
+		return err
+	}
+	b := first.Bounds()
+	w, err := newAVIWriter(output, b.Dx(), b.Dy(), tl.framerate, 85)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		img, err := loadJPEG(frame)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.AddFrame(img); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
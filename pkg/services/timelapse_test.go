@@ -0,0 +1,57 @@
+package services
+
+import (
+	"image"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTimelapseTooFewFrames(t *testing.T) {
+	tl, err := NewTimelapseService(map[string]interface{}{
+		"timelapse": map[string]interface{}{
+			"enabled":         true,
+			"encoder_command": "false",
+			"fallback":        fallbackAVI,
+		},
+	}, make(chan error, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// none or only one of the captures has a usable image
+	for usable := 0; usable < 2; usable++ {
+		dayDir := t.TempDir()
+		for i, capture := range []string{"1200", "1210", "1220"} {
+			if err := os.Mkdir(path.Join(dayDir, capture), 0755); err != nil {
+				t.Fatal(err)
+			}
+			final := path.Join(dayDir, capture, "final.jpg")
+			if i < usable {
+				err = saveJPEG(final, image.NewRGBA(image.Rect(0, 0, 32, 24)), 85)
+			} else {
+				err = os.WriteFile(final, []byte("not a jpeg"), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tl.Generate("2023-06-01", dayDir); err != nil {
+			t.Fatalf("%d usable: %v", usable, err)
+		}
+		if key := tl.Key("2023-06-01", dayDir); key != "" {
+			t.Errorf("%d usable: a timelapse was written: %s", usable, key)
+		}
+	}
+}
+
+func TestTimelapseEnabledInvalid(t *testing.T) {
+	if _, err := NewTimelapseService(map[string]interface{}{
+		"timelapse": map[string]interface{}{"enabled": "yes"},
+	}, nil, nil); err == nil {
+		t.Errorf("an invalid 'timelapse.enabled' was accepted")
+	}
+	tl, err := NewTimelapseService(map[string]interface{}{}, nil, nil)
+	if err != nil || tl.enabled {
+		t.Errorf("without a [timelapse] section: %+v, %v", tl, err)
+	}
+}
@@ -1,80 +1,124 @@
 package services
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
-	"html/template"
-	"net/http"
+	"math"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/estesp/onimage/pkg/metrics"
 	"github.com/estesp/onimage/pkg/util"
 
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const latestKeysFile = "onimage-latest.json"
+
 type Today struct {
-	dateStr             string
-	homeDir             string
-	sunrise             int64
-	sunset              int64
-	weatherService      *WeatherData
-	darkPercent         float32
-	s3bucket            string
-	pageTemplate        *template.Template
-	pageTemplateName    string
-	offlinePageTemplate string
-	offline             bool
-	errChan             chan error
+	dateStr          string
+	homeDir          string
+	sunrise          int64
+	sunset           int64
+	weatherService   *WeatherData
+	darkPercent      float32
+	exposureLock     sync.Mutex
+	exposure         *ExposureStats
+	evShift          float64
+	publisher        *Publisher
+	derivatives      []Derivative
+	imageLock        sync.RWMutex
+	imageWidth       int
+	templates        *Templates
+	offlineStateFile string
+	maintenance      []MaintenanceWindow
+	offlineLock      sync.Mutex
+	offline          *OfflineState
+	// a manual return online during a maintenance window skips the rest of
+	// that window; this is the end of the window
+	skipMaintenance     time.Time
+	maintenanceSkipFile string
+	// serializes publishing index.html
+	pageLock sync.Mutex
+	// with immutable image keys the page links to the keys of the latest
+	// image and is published again for each image
+	immutableImages bool
+	latestKeysFile  string
+	latestKeys      map[string]string
+	errChan         chan error
 }
 
 type PageData struct {
 	Today   string
 	Sunrise string
 	Sunset  string
+	// Images lists each published size of the latest image, smallest first,
+	// with the key to link to as the Name, and Srcset joins them into a
+	// value for an <img> srcset attribute
+	Images []Derivative
+	Srcset string
+	// Weather is the observation when the page was generated, if any, and
+	// Almanac has today's sun and moon times and the sun times of the next
+	// week; it is nil until the webcam's coordinates are known from a
+	// weather observation
+	Weather *Weather
+	Almanac *Almanac
 }
 
-var (
-	awscpIndexCmd = []string{"aws", "s3", "cp", "SOMEFILE", "BUCKETLOCATION", "--acl", "public-read",
-		"--content-type", "text/html", "--metadata-directive", "REPLACE", "--expires"}
-)
-
-func NewTodayService(wdService *WeatherData, config map[string]interface{}, errChan chan error) (*Today, error) {
+func NewTodayService(wdService *WeatherData, publisher *Publisher, templates *Templates, config map[string]interface{}, errChan chan error) (*Today, error) {
 
 	dateStr := util.GetDateString()
 
-	pageTmpl, err := util.GetStringFromConfig(config, "website.page_template")
+	homeDir, err := util.GetStringFromConfig(config, "home_dir")
 	if err != nil {
-		return nil, fmt.Errorf("can't retrieve entry 'website.page_template' from config: %w", err)
+		return nil, fmt.Errorf("can't retrieve entry 'home_dir' from config: %w", err)
 	}
-	offlinePageTmpl, err := util.GetStringFromConfig(config, "website.offline_page")
+	derivatives, err := getDerivativeConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("can't retrieve entry 'website.offline_page' from config: %w", err)
+		return nil, fmt.Errorf("invalid 'derivatives' config: %w", err)
 	}
-	s3bucketName, err := util.GetStringFromConfig(config, "website.bucket")
+	maintenance, err := getMaintenanceWindows(config)
 	if err != nil {
-		return nil, fmt.Errorf("can't retrieve entry 'website.bucket' from config: %w", err)
+		return nil, fmt.Errorf("invalid 'website.maintenance' config: %w", err)
 	}
-	homeDir, err := util.GetStringFromConfig(config, "home_dir")
-	if err != nil {
-		return nil, fmt.Errorf("can't retrieve entry 'home_dir' from config: %w", err)
+	// the full image width is otherwise only known once the first image is
+	// processed, and the srcset needs it
+	imageWidth := 0
+	if baseDir, err := util.GetStringFromConfig(config, "images.directory"); err == nil {
+		imageWidth = latestImageWidth(baseDir)
 	}
 	today := &Today{
+		imageWidth:          imageWidth,
 		homeDir:             homeDir,
 		dateStr:             dateStr,
 		weatherService:      wdService,
 		darkPercent:         100.0,
-		s3bucket:            s3bucketName,
-		pageTemplateName:    filepath.Base(pageTmpl),
-		pageTemplate:        template.Must(template.ParseFiles(pageTmpl)),
-		offlinePageTemplate: offlinePageTmpl,
+		publisher:           publisher,
+		derivatives:         derivatives.sizes,
+		templates:           templates,
+		offlineStateFile:    filepath.Join(homeDir, offlineStateFile),
+		maintenanceSkipFile: filepath.Join(homeDir, maintenanceSkipFile),
+		maintenance:         maintenance,
+		immutableImages:     derivatives.immutable,
+		latestKeysFile:      filepath.Join(homeDir, latestKeysFile),
 		errChan:             errChan,
 	}
-
-	awscpIndexCmd[4] = fmt.Sprintf("s3://%s/index.html", s3bucketName)
+	if today.immutableImages {
+		if today.latestKeys, err = loadLatestKeys(today.latestKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	if today.offline, err = loadOfflineState(today.offlineStateFile); err != nil {
+		return nil, err
+	}
+	if today.offline != nil {
+		logrus.Infof("Webcam is offline since %v: %s", today.offline.Since, today.offline.Message)
+	}
+	if today.skipMaintenance, err = loadMaintenanceSkip(today.maintenanceSkipFile); err != nil {
+		return nil, err
+	}
 
 	weather, err := wdService.GetCurrentWeather()
 	if err != nil {
@@ -103,22 +147,141 @@ func (t *Today) GetDarkPercent() float32 {
 	return t.darkPercent
 }
 
+// InCaptureWindow reports whether photos should be taken at now: from 30
+// minutes before sunrise to 30 minutes after sunset, extended for as long
+// as the most recent image still shows some light
+func (t *Today) InCaptureWindow(now time.Time) bool {
+	in, extended := t.captureWindow(now)
+	if extended {
+		logrus.Infof("Extending photo hours; still some light (%f) at %v", t.GetDarkPercent(), now)
+	}
+	return in
+}
+
+func (t *Today) captureWindow(now time.Time) (bool, bool) {
+	sunrisePre := t.GetSunrise() - 1800
+	sunsetPost := t.GetSunset() + 1800
+	if now.Unix() >= sunrisePre && now.Unix() <= sunsetPost {
+		return true, false
+	}
+	// since sometimes the light lingers longer than 30 min after sunset
+	// use the color profile of the last photo to extend photo hours as
+	// necessary
+	if now.Unix() > sunsetPost && t.GetDarkPercent() < 95.0 {
+		return true, true
+	}
+	return false, false
+}
+
+// SetExposure records the exposure of the latest capture, taken with the EV
+// shift used, and recommends the shift that corrects its measured error.
+// The shift is derived from the capture alone rather than accumulated, so a
+// camera that doesn't apply the recommendation doesn't drive it to the limit
+func (t *Today) SetExposure(stats ExposureStats, used float64) {
+	t.exposureLock.Lock()
+	defer t.exposureLock.Unlock()
+	t.exposure = &stats
+	t.evShift = math.Max(-maxEVShift, math.Min(maxEVShift, used+exposureCorrection(stats)))
+	logrus.Infof("Latest exposure: %s at EV shift %+.1f; recommended EV shift %+.1f", stats, used, t.evShift)
+}
+
+// EVShift returns the currently recommended EV shift
+func (t *Today) EVShift() float64 {
+	t.exposureLock.Lock()
+	defer t.exposureLock.Unlock()
+	return t.evShift
+}
+
+// RecommendExposure returns the suggested capture parameters at now
+func (t *Today) RecommendExposure(now time.Time) ExposureRecommendation {
+	t.exposureLock.Lock()
+	evShift, exposure := t.evShift, t.exposure
+	t.exposureLock.Unlock()
+	return recommendExposure(now, t.GetSunrise(), t.GetSunset(), t.GetDarkPercent(), evShift, exposure)
+}
+
 func (t *Today) SetDarkPercent(percent float32) {
 	t.darkPercent = percent
+	metrics.DarkPercent.Set(float64(percent))
+}
+
+// SetImageWidth records the width of the full size image so that it can be
+// included in the srcset of the next generated page
+func (t *Today) SetImageWidth(width int) {
+	t.imageLock.Lock()
+	defer t.imageLock.Unlock()
+	t.imageWidth = width
+}
+
+// ImageWidth returns the width of the latest full size image, or 0 if it
+// isn't known yet
+func (t *Today) ImageWidth() int {
+	t.imageLock.RLock()
+	defer t.imageLock.RUnlock()
+	return t.imageWidth
+}
+
+// Derivatives returns the configured image sizes, smallest first, ending
+// with the full size image
+func (t *Today) Derivatives() []Derivative {
+	return append([]Derivative(nil), t.derivatives...)
 }
 
 // SetTodayPage sets up an index.html for the static site with today's date and sunrise/sunset info
 func (t *Today) SetTodayPage() error {
-	if t.offline {
-		// if we're in "webcam offline" mode, don't set up the new page
-		return nil
+	// if we're in "webcam offline" mode, don't set up the new page
+	return t.publishIndex(false)
+}
+
+// publishIndex publishes the page for the current state as index.html:
+// today's page, or while offline the offline page if withOffline is set.
+// Publishing is serialized by the page lock, and each page is rendered from
+// the state when it gets the lock, so the last page published always
+// matches the last state change even though the upload happens without the
+// offline lock held
+func (t *Today) publishIndex(withOffline bool) error {
+	t.pageLock.Lock()
+	defer t.pageLock.Unlock()
+
+	t.offlineLock.Lock()
+	if t.offline != nil {
+		if !withOffline {
+			t.offlineLock.Unlock()
+			return nil
+		}
+		data := t.offlinePageData()
+		t.offlineLock.Unlock()
+		// keep the offline page short lived so that returning online is
+		// visible quickly
+		return t.publishPage(PageOffline, data,
+			PublishOptions{ContentType: "text/html", CacheControl: "public, max-age=60"})
 	}
+	data := t.pageData()
+	t.offlineLock.Unlock()
+
 	// change the website page with today's info
 	// set up an expiration time for our index page one day from now
 	// TODO: set this up to expire at midnight, not just adding 24hr to "now"
 	tomorrow := time.Now().Add(24 * time.Hour)
-	expires := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 6, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	expires := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 6, 0, 0, 0, time.UTC)
 
+	opts := PublishOptions{ContentType: "text/html", Expires: expires}
+	if t.immutableImages {
+		// the page changes with every image, so it is only cached briefly
+		opts = PublishOptions{ContentType: "text/html", CacheControl: "public, max-age=60"}
+	}
+	return t.publishPage(PageIndex, data, opts)
+}
+
+// PageData returns the data today's page is rendered with
+func (t *Today) PageData() PageData {
+	t.offlineLock.Lock()
+	defer t.offlineLock.Unlock()
+	return t.pageData()
+}
+
+// pageData must be called with the offline lock held
+func (t *Today) pageData() PageData {
 	riseTime := time.Unix(t.GetSunrise(), 0)
 	setTime := time.Unix(t.GetSunset(), 0)
 	sunriseStr := fmt.Sprintf("%02d:%02d", riseTime.Hour(), riseTime.Minute())
@@ -128,45 +291,89 @@ func (t *Today) SetTodayPage() error {
 		Today:   t.GetDate(),
 		Sunrise: sunriseStr,
 		Sunset:  sunsetStr,
+		Images:  t.derivatives,
 	}
-	tmpFile, err := os.CreateTemp("/tmp", "index")
-	if err != nil {
-		t.errChan <- err
-		return errors.Wrap(err, "unable to create temp file for index page generation")
+	if t.latestKeys != nil {
+		data.Images = make([]Derivative, len(t.derivatives))
+		for i, d := range t.derivatives {
+			if key, ok := t.latestKeys[d.Name]; ok {
+				d.Name = key
+			}
+			data.Images[i] = d
+		}
 	}
-	writer := bufio.NewWriter(tmpFile)
-	if err := t.pageTemplate.ExecuteTemplate(writer, t.pageTemplateName, data); err != nil {
-		t.errChan <- err
-		return errors.Wrap(err, "unable to execute template for index page")
+	data.Srcset = srcset(data.Images, t.ImageWidth())
+	if weather, _ := t.weatherService.CachedWeather(); weather != nil {
+		data.Weather = weather
+		if weather.Coord.Lat != 0 || weather.Coord.Lon != 0 {
+			data.Almanac = newAlmanac(time.Now(), t.templates.location, weather.Coord.Lat, weather.Coord.Lon)
+		}
 	}
-	if err := writer.Flush(); err != nil {
-		t.errChan <- err
-		return errors.Wrap(err, "unable to flush bytes to temp file")
+	return data
+}
+
+// Published is the ImageProcessor publish hook; with immutable image keys
+// it points today's page at the new image's keys. It runs only after every
+// size of the image is uploaded, so the page never links to a missing image
+func (t *Today) Published(img PublishedImage) {
+	if !img.Immutable {
+		return
 	}
-	if err := tmpFile.Close(); err != nil {
-		t.errChan <- err
-		return errors.Wrap(err, "unable to close temp file")
+	t.offlineLock.Lock()
+	t.latestKeys = img.Keys
+	if err := saveLatestKeys(t.latestKeysFile, img.Keys); err != nil {
+		logrus.Errorf("unable to persist latest image keys: %v", err)
 	}
+	t.offlineLock.Unlock()
+	// publishing errors are already reported by publishPage
+	t.publishIndex(false)
+}
+
+// RefreshPage publishes today's page, or the offline page while offline,
+// again, e.g. after the templates change
+func (t *Today) RefreshPage() error {
+	return t.publishIndex(true)
+}
 
-	awscpIndexCmd[3] = tmpFile.Name()
-	out, err := util.RunCommand(t.homeDir, append(awscpIndexCmd, expires))
+// publishPage renders a page template with data and publishes it as the
+// site's index.html
+func (t *Today) publishPage(page string, data interface{}, opts PublishOptions) error {
+	err := t.publisher.PublishTemplate(t.templates, page, data, "index.html", opts)
 	if err != nil {
 		t.errChan <- err
-		logrus.Errorf("Error calling 'aws cp' from tmp file %s to S3: %v", tmpFile.Name(), err)
-		logrus.Errorf(">      Command: %s", strings.Join(awscpIndexCmd, " "))
-		logrus.Errorf(">  Full output: %s", out)
 	}
-	os.Remove(tmpFile.Name())
 	return err
 }
 
-func (t *Today) SetOffline() {
-	t.offline = true
+// loadLatestKeys reads the keys of the latest image saved when it was
+// published, so that the page keeps pointing at it across restarts
+func loadLatestKeys(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+	return keys, nil
 }
 
-func (t *Today) SetOnline() error {
-	t.offline = false
-	return t.SetTodayPage()
+// saveLatestKeys writes the keys to a temporary file and renames it into
+// place, so a crash never leaves a truncated file behind
+func saveLatestKeys(file string, keys map[string]string) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
 }
 
 // WatchDate starts a goroutine that triggers the daily update of the index page
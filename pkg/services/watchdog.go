@@ -0,0 +1,124 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/estesp/onimage/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultWatchdogMessage = "The camera is not responding; new images will appear as soon as it is back."
+
+// Watchdog takes the webcam offline when captures stop arriving during the
+// capture window, and brings it back online when they resume
+type Watchdog struct {
+	enabled      bool
+	missed       int
+	message      string
+	frequency    time.Duration
+	todayService *Today
+	errChan      chan error
+
+	lock        sync.Mutex
+	lastCapture time.Time
+	// the start of the current capture window, or zero outside of it
+	windowStart time.Time
+}
+
+func NewWatchdog(config map[string]interface{}, errChan chan error, todayService *Today, imageProcessor *ImageProcessor) (*Watchdog, error) {
+	enabled, err := util.GetBoolFromConfig(config, "watchdog.enabled")
+	if err != nil && !util.IsNoConfigError(err) {
+		return nil, err
+	}
+	if !enabled {
+		return &Watchdog{}, nil
+	}
+	missed, err := util.GetIntFromConfig(config, "watchdog.missed_captures")
+	if err != nil || missed <= 0 {
+		missed = 3
+	}
+	message, err := util.GetStringFromConfig(config, "watchdog.message")
+	if err != nil || message == "" {
+		message = defaultWatchdogMessage
+	}
+	return &Watchdog{
+		enabled:      true,
+		missed:       int(missed),
+		message:      message,
+		frequency:    imageProcessor.Frequency(),
+		todayService: todayService,
+		errChan:      errChan,
+		lastCapture:  time.Now(),
+	}, nil
+}
+
+// Start checks for missed captures every minute
+func (wd *Watchdog) Start() {
+	if !wd.enabled {
+		return
+	}
+	go func() {
+		tick := time.NewTicker(time.Minute)
+		for now := range tick.C {
+			wd.check(now)
+		}
+	}()
+}
+
+// CaptureProcessed records a processed capture, restoring the webcam if the
+// watchdog had taken it offline
+func (wd *Watchdog) CaptureProcessed(dir string) error {
+	if !wd.enabled {
+		return nil
+	}
+	wd.lock.Lock()
+	wd.lastCapture = time.Now()
+	wd.lock.Unlock()
+
+	if state := wd.todayService.OfflineStatus(); state != nil && state.Reason == OfflineWatchdog {
+		logrus.Infof("Captures have resumed with %s; restoring online page", dir)
+		// unlike a manual return online, this doesn't skip a maintenance
+		// window
+		return wd.todayService.setOnline(false)
+	}
+	return nil
+}
+
+func (wd *Watchdog) check(now time.Time) {
+	wd.lock.Lock()
+	in, _ := wd.todayService.captureWindow(now)
+	if !in {
+		// captures aren't expected overnight
+		wd.windowStart = time.Time{}
+		wd.lock.Unlock()
+		return
+	}
+	if wd.windowStart.IsZero() {
+		wd.windowStart = now
+	}
+	since := wd.lastCapture
+	if wd.windowStart.After(since) {
+		since = wd.windowStart
+	}
+	wd.lock.Unlock()
+
+	missed := int(now.Sub(since) / wd.frequency)
+	if missed < wd.missed {
+		return
+	}
+	// a webcam already offline, for whatever reason, is left as it is
+	offline, err := wd.todayService.setOffline(OfflineWatchdog, wd.message, nil, true)
+	if !offline {
+		return
+	}
+	outage := fmt.Errorf("no captures received for %v (%d expected captures missed); setting webcam offline",
+		now.Sub(since).Round(time.Minute), missed)
+	logrus.Error(outage)
+	// the error channel reports the outage to the monitor service
+	wd.errChan <- outage
+	if err != nil {
+		logrus.Errorf("unable to set webcam offline: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestWatchdog(t *testing.T, today *Today, lastCapture time.Time) *Watchdog {
+	t.Helper()
+	return &Watchdog{
+		enabled:      true,
+		missed:       3,
+		message:      "camera down",
+		frequency:    time.Minute,
+		todayService: today,
+		errChan:      make(chan error, 10),
+		lastCapture:  lastCapture,
+	}
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	log, _ := fakeAWS(t)
+	today := newTestToday(t, newTestPublisher(t))
+	now := time.Now()
+	today.sunrise = now.Add(-6 * time.Hour).Unix()
+	today.sunset = now.Add(6 * time.Hour).Unix()
+	wd := newTestWatchdog(t, today, now.Add(-2*time.Minute))
+	wd.windowStart = now.Add(-time.Hour)
+
+	// two missed captures are tolerated
+	wd.check(now)
+	if today.IsOffline() {
+		t.Fatal("offline after two missed captures")
+	}
+	wd.check(now.Add(time.Minute))
+	state := today.OfflineStatus()
+	if state == nil || state.Reason != OfflineWatchdog || state.Message != "camera down" {
+		t.Fatalf("offline state %+v after three missed captures", state)
+	}
+	if page := bucketObject(t, log, "index.html"); page != "offline camera down" {
+		t.Errorf("published %q", page)
+	}
+	select {
+	case <-wd.errChan:
+	default:
+		t.Error("the outage wasn't reported")
+	}
+
+	// the outage is only reported once
+	wd.check(now.Add(2 * time.Minute))
+	select {
+	case err := <-wd.errChan:
+		t.Errorf("outage reported again: %v", err)
+	default:
+	}
+
+	if err := wd.CaptureProcessed("2023-06-30/1200"); err != nil {
+		t.Fatal(err)
+	}
+	if today.IsOffline() {
+		t.Error("still offline after a capture")
+	}
+	if page := bucketObject(t, log, "index.html"); page != "index 2023-06-30" {
+		t.Errorf("published %q after a capture", page)
+	}
+}
+
+func TestWatchdogKeepsOfflineState(t *testing.T) {
+	fakeAWS(t)
+	today := newTestToday(t, newTestPublisher(t))
+	now := time.Now()
+	today.sunrise = now.Add(-6 * time.Hour).Unix()
+	today.sunset = now.Add(6 * time.Hour).Unix()
+	wd := newTestWatchdog(t, today, now.Add(-time.Hour))
+	if err := today.SetOffline(OfflineManual, "cleaning", nil); err != nil {
+		t.Fatal(err)
+	}
+	wd.check(now)
+	if state := today.OfflineStatus(); state == nil || state.Reason != OfflineManual || state.Message != "cleaning" {
+		t.Errorf("offline state %+v, want the manual one kept", state)
+	}
+	select {
+	case err := <-wd.errChan:
+		t.Errorf("outage reported while offline: %v", err)
+	default:
+	}
+	// nor does a capture end a manual offline period
+	wd.CaptureProcessed("2023-06-30/1200")
+	if !today.IsOffline() {
+		t.Error("a capture ended a manual offline period")
+	}
+}
+
+func TestPhotoFrequencyInvalid(t *testing.T) {
+	// the watchdog divides by the frequency
+	for _, freq := range []int64{0, -3} {
+		_, err := NewImageProcessingService(map[string]interface{}{
+			"images": map[string]interface{}{
+				"directory":       t.TempDir(),
+				"site_text":       "example.com",
+				"runtime":         "docker",
+				"photo_frequency": freq,
+			},
+		}, nil, nil, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "photo_frequency") {
+			t.Errorf("photo_frequency %d: got %v, want it rejected", freq, err)
+		}
+	}
+}
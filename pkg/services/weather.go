@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/dghubble/sling"
+	"github.com/estesp/onimage/pkg/metrics"
 	"github.com/estesp/onimage/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -19,6 +21,13 @@ type WeatherData struct {
 	baseURL    string
 	units      string
 	errChan    chan error
+
+	lock        sync.Mutex
+	lastWeather *Weather
+	lastFetched time.Time
+	// the time and result of the most recent request, successful or not
+	lastAttempt time.Time
+	lastErr     error
 }
 
 type Params struct {
@@ -36,6 +45,11 @@ type MainSection struct {
 	TempMin   float32 `json:"temp_min"`
 }
 
+type CoordSection struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
 type SysSection struct {
 	Sunrise int64 `json:"sunrise"`
 	Sunset  int64 `json:"sunset"`
@@ -55,6 +69,7 @@ type WindSection struct {
 }
 
 type Weather struct {
+	Coord       CoordSection  `json:"coord"`
 	Main        MainSection   `json:"main"`
 	Sys         SysSection    `json:"sys"`
 	WeatherDesc []WeatherDesc `json:"weather"`
@@ -91,6 +106,26 @@ func (w *WeatherData) GetCurrentWeather() (*Weather, error) {
 
 	var err error
 
+	for i := 0; i < retries; i++ {
+		var weather *Weather
+		weather, err = w.fetch()
+		if err != nil {
+			logrus.Infof("Try %d: failed to query openweathermap for current conditions: %v", i+1, err)
+			if i == retries-1 {
+				break
+			}
+			metrics.WeatherRetries.Inc()
+			time.Sleep(time.Duration(int(math.Pow(float64(i+1), 2))) * time.Second)
+			continue
+		}
+		return weather, nil
+	}
+	return nil, fmt.Errorf("weather conditions failed after %d retries calling openweathermap: %w", retries, err)
+}
+
+// fetch makes a single request for the current conditions and caches the
+// result on success
+func (w *WeatherData) fetch() (*Weather, error) {
 	params := &Params{
 		Id:    w.locationId,
 		AppId: w.appId,
@@ -102,17 +137,46 @@ func (w *WeatherData) GetCurrentWeather() (*Weather, error) {
 	}
 
 	weather := new(Weather)
+	start := time.Now()
+	_, err := sling.New().Client(toClient).Get(w.baseURL).QueryStruct(params).ReceiveSuccess(weather)
+	metrics.WeatherLatency.Observe(time.Since(start).Seconds())
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastAttempt = time.Now()
+	w.lastErr = err
+	if err != nil {
+		return nil, err
+	}
+	w.lastWeather = weather
+	w.lastFetched = w.lastAttempt
+	return weather, nil
+}
 
-	for i := 0; i < retries; i++ {
-		_, err = sling.New().Client(toClient).Get(w.baseURL).QueryStruct(params).ReceiveSuccess(weather)
-		if err != nil {
-			logrus.Infof("Try %d: failed to query openweathermap for current conditions: %v", i+1, err)
-			time.Sleep(time.Duration(int(math.Pow(float64(i+1), 2))) * time.Second)
-			continue
-		}
-		return weather, nil
+// check reports whether the weather API is reachable without calling it
+// more than once per maxAge: a cached observation younger than maxAge is
+// enough, and otherwise the result of a request made within maxAge is
+// reused, so a failing API isn't queried on every readiness probe
+func (w *WeatherData) check(maxAge time.Duration) error {
+	w.lock.Lock()
+	if time.Since(w.lastFetched) <= maxAge {
+		w.lock.Unlock()
+		return nil
 	}
-	return nil, fmt.Errorf("weather conditions failed after %d retries calling openweathermap: %w", retries, err)
+	if time.Since(w.lastAttempt) <= maxAge {
+		defer w.lock.Unlock()
+		return w.lastErr
+	}
+	w.lock.Unlock()
+	_, err := w.fetch()
+	return err
+}
+
+// CachedWeather returns the most recent successful observation and the time
+// it was retrieved; the weather is nil if none has been retrieved yet
+func (w *WeatherData) CachedWeather() (*Weather, time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.lastWeather, w.lastFetched
 }
 
 func (w *WeatherData) GetCurrentTempStr() (string, error) {
@@ -2,19 +2,30 @@ package util
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/estesp/onimage/pkg/metrics"
 )
 
 type NoConfigSectionError struct{}
 type NoConfigEntryError struct{}
 
-func RunCommand(workdir string, command []string) (string, error) {
+// RunCommand runs command in workdir and returns its combined output. name
+// identifies what the command does (e.g. "enfuse") in the failure metrics,
+// since the executable is often just a container runtime or sudo
+func RunCommand(name, workdir string, command []string) (string, error) {
 	cmd := exec.Command(command[0], command[1:]...)
 	cmd.Env = append(cmd.Env, fmt.Sprintf("HOME=%s", workdir))
 	cmd.Dir = workdir
 	out, err := cmd.CombinedOutput()
+	if err != nil {
+		metrics.CommandFailures.WithLabelValues(name).Inc()
+	}
 	return string(out), err
 }
 
@@ -30,6 +41,59 @@ func GetDateString() string {
 	return time.Now().Format("2006-01-02")
 }
 
+// DiskFree returns the number of bytes available to unprivileged users on
+// the filesystem containing path
+func DiskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// SameFilesystem reports whether paths a and b are on the same filesystem;
+// a path that doesn't exist yet is checked by its nearest existing parent
+func SameFilesystem(a, b string) (bool, error) {
+	devA, err := deviceOf(a)
+	if err != nil {
+		return false, err
+	}
+	devB, err := deviceOf(b)
+	if err != nil {
+		return false, err
+	}
+	return devA == devB, nil
+}
+
+func deviceOf(path string) (uint64, error) {
+	path = filepath.Clean(path)
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return 0, fmt.Errorf("unable to determine the filesystem of %s", path)
+			}
+			return uint64(stat.Dev), nil
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
+// IsNoConfigError reports whether err means that a config section or entry
+// is missing, as opposed to being present with an invalid value
+func IsNoConfigError(err error) bool {
+	switch err.(type) {
+	case *NoConfigSectionError, *NoConfigEntryError:
+		return true
+	}
+	return false
+}
+
 func GetStringFromConfig(config map[string]interface{}, key string) (string, error) {
 	val, err := getValueFromConfig(config, key)
 	if err != nil {
@@ -66,6 +130,71 @@ func GetIntFromConfig(config map[string]interface{}, key string) (int64, error)
 	return valInt, nil
 }
 
+func GetIntSliceFromConfig(config map[string]interface{}, key string) ([]int64, error) {
+	val, err := getValueFromConfig(config, key)
+	if err != nil {
+		return nil, err
+	}
+	valSlice, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config item %s must be an array of integers", key)
+	}
+	ints := make([]int64, 0, len(valSlice))
+	for _, v := range valSlice {
+		valInt, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("config item %s must be an array of integers", key)
+		}
+		ints = append(ints, valInt)
+	}
+	return ints, nil
+}
+
+func GetStringSliceFromConfig(config map[string]interface{}, key string) ([]string, error) {
+	val, err := getValueFromConfig(config, key)
+	if err != nil {
+		return nil, err
+	}
+	valSlice, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config item %s must be an array of strings", key)
+	}
+	strs := make([]string, 0, len(valSlice))
+	for _, v := range valSlice {
+		valStr, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("config item %s must be an array of strings", key)
+		}
+		strs = append(strs, valStr)
+	}
+	return strs, nil
+}
+
+// GetTableSliceFromConfig returns an array of tables (e.g. [[section.key]]
+// entries in TOML) from the config
+func GetTableSliceFromConfig(config map[string]interface{}, key string) ([]map[string]interface{}, error) {
+	val, err := getValueFromConfig(config, key)
+	if err != nil {
+		return nil, err
+	}
+	valSlice, ok := val.([]interface{})
+	if !ok {
+		if tables, ok := val.([]map[string]interface{}); ok {
+			return tables, nil
+		}
+		return nil, fmt.Errorf("config item %s must be an array of tables", key)
+	}
+	tables := make([]map[string]interface{}, 0, len(valSlice))
+	for _, v := range valSlice {
+		table, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config item %s must be an array of tables", key)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
 func getValueFromConfig(config map[string]interface{}, key string) (interface{}, error) {
 	parts := strings.Split(key, ".")
 	if len(parts) == 1 {